@@ -1,20 +1,29 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"mime"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
 
+// Path segment in place of a trench for the routes about all the trenches of
+// a project, so that they can't shadow trenches with the same name
+const ProjectRoutes = "_"
+
 type Server struct {
 	RootDir string
 
@@ -29,15 +38,43 @@ func NewServer(rootDir string) *Server {
 	config.AllowAllOrigins = true
 	config.AllowMethods = []string{"PUT", "POST", "GET"}
 	config.AllowHeaders = []string{"*"}
+	config.ExposeHeaders = []string{"X-Next-Cursor"}
 	s.r.Use(cors.New(config))
 
 	s.Handle(http.MethodGet, "/idig", s.ListTrenches)
+	if Metrics {
+		// For Prometheus scrapers, which don't belong to any project
+		s.r.GET("/metrics", s.Metrics)
+	}
 	s.HandleTrench(http.MethodPost, "/idig/:project/:trench", s.SyncTrench)
 	s.HandleTrench(http.MethodGet, "/idig/:project/:trench", s.ReadTrench)
 	s.HandleTrench(http.MethodGet, "/idig/:project/:trench/attachments", s.ListAttachments)
+	s.HandleTrench(http.MethodGet, "/idig/:project/:trench/attachments.zip", s.DownloadAttachments)
 	s.HandleTrench(http.MethodGet, "/idig/:project/:trench/attachments/:name", s.ReadAttachment)
+	s.HandleTrench(http.MethodGet, "/idig/:project/:trench/attachments/:name/usage", s.ReadAttachmentUsage)
+	s.HandleTrench(http.MethodGet, "/idig/:project/:trench/attachments/:name/tiles", s.ReadTileInfo)
+	s.HandleTrench(http.MethodGet, "/idig/:project/:trench/attachments/:name/tiles/:z/:x/:y", s.ReadTile)
 	s.HandleTrench(http.MethodPut, "/idig/:project/:trench/attachments/:name", s.WriteAttachment)
+	s.HandleTrench(http.MethodPost, "/idig/:project/:trench/attachments/check", s.CheckAttachments)
 	s.HandleTrench(http.MethodGet, "/idig/:project/:trench/surveys", s.ReadSurveys)
+	s.HandleTrench(http.MethodGet, "/idig/:project/:trench/surveys.csv", s.ExportSurveysCSV)
+	s.HandleTrench(http.MethodGet, "/idig/:project/:trench/surveys.geojson", s.ExportTrenchGeometry)
+	s.HandleTrench(http.MethodGet, "/idig/:project/:trench/surveys.kml", s.ExportTrenchGeometry)
+	s.HandleProject(http.MethodGet, "/idig/:project/_/surveys.geojson", s.ExportProjectGeometry)
+	s.HandleProject(http.MethodGet, "/idig/:project/_/surveys.kml", s.ExportProjectGeometry)
+	s.HandleTrench(http.MethodGet, "/idig/:project/:trench/surveys.jsonld", s.ExportTrenchLinkedData)
+	s.HandleTrench(http.MethodGet, "/idig/:project/:trench/surveys.ttl", s.ExportTrenchLinkedData)
+	s.HandleProject(http.MethodGet, "/idig/:project/_/surveys.jsonld", s.ExportProjectLinkedData)
+	s.HandleProject(http.MethodGet, "/idig/:project/_/surveys.ttl", s.ExportProjectLinkedData)
+	s.HandleTrench(http.MethodGet, "/idig/:project/:trench/harris.json", s.TrenchHarrisMatrix)
+	s.HandleTrench(http.MethodGet, "/idig/:project/:trench/harris.dot", s.TrenchHarrisMatrix)
+	s.HandleTrench(http.MethodGet, "/idig/:project/:trench/harris.graphml", s.TrenchHarrisMatrix)
+	s.HandleProject(http.MethodGet, "/idig/:project/_/harris.json", s.ProjectHarrisMatrix)
+	s.HandleProject(http.MethodGet, "/idig/:project/_/harris.dot", s.ProjectHarrisMatrix)
+	s.HandleProject(http.MethodGet, "/idig/:project/_/harris.graphml", s.ProjectHarrisMatrix)
+	s.HandleTrench(http.MethodGet, "/idig/:project/:trench/stratigraphy", s.CheckTrenchStratigraphy)
+	s.HandleProject(http.MethodGet, "/idig/:project/_/stratigraphy", s.CheckProjectStratigraphy)
+	s.HandleProject(http.MethodGet, "/idig/:project/_/search", s.Search)
 	s.HandleTrench(http.MethodGet, "/idig/:project/:trench/surveys/:uuid/versions", s.ReadSurveyVersions)
 	s.HandleTrench(http.MethodGet, "/idig/:project/:trench/versions", s.ListVersions)
 	return s
@@ -48,42 +85,60 @@ type HandlerFunc func(*gin.Context) (int, any)
 func (s *Server) Handle(httpMethod, relativePath string, handler HandlerFunc) gin.IRoutes {
 	h := func(c *gin.Context) {
 		code, resp := handler(c)
-		if resp == nil {
-			c.Status(code)
-		} else if err, ok := resp.(error); ok {
-			c.JSON(code, map[string]string{"error": err.Error()})
-		} else {
-			c.JSON(code, resp)
-		}
+		respond(c, code, resp)
 	}
 	return s.r.Handle(httpMethod, relativePath, h)
 }
 
+// authorize checks the credentials of a request for a project. On failure
+// it responds and returns false.
+func (s *Server) authorize(c *gin.Context) (projectDir, user string, userDB *UserDB, ok bool) {
+	user, password, ok := c.Request.BasicAuth()
+	if !ok {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return "", "", nil, false
+	}
+
+	project := c.Param("project")
+	projectDir = filepath.Join(s.RootDir, project)
+
+	userDB, err := NewUserDB(projectDir)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return "", "", nil, false
+	}
+
+	if !userDB.HasAccess(user, password) {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return "", "", nil, false
+	}
+	return projectDir, user, userDB, true
+}
+
+func respond(c *gin.Context, code int, resp any) {
+	if resp == nil {
+		c.Status(code)
+	} else if err, ok := resp.(error); ok {
+		c.JSON(code, map[string]string{"error": err.Error()})
+	} else {
+		c.JSON(code, resp)
+	}
+}
+
 type TrenchHandlerFunc func(*gin.Context, *Backend) (int, any)
 
 func (s *Server) HandleTrench(httpMethod, relativePath string, handler TrenchHandlerFunc) gin.IRoutes {
 	h := func(c *gin.Context) {
-		user, password, ok := c.Request.BasicAuth()
+		projectDir, user, userDB, ok := s.authorize(c)
 		if !ok {
-			c.AbortWithStatus(http.StatusUnauthorized)
-			return
-		}
-
-		project := c.Param("project")
-		projectDir := filepath.Join(s.RootDir, project)
-
-		userDB, err := NewUserDB(projectDir)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 			return
 		}
 
-		if !userDB.HasAccess(user, password) {
-			c.AbortWithStatus(http.StatusUnauthorized)
+		trench := c.Param("trench")
+		if strings.HasPrefix(trench, ".") || trench == ProjectRoutes {
+			c.AbortWithStatus(http.StatusNotFound)
 			return
 		}
-
-		trench := c.Param("trench")
 		b, err := NewBackend(projectDir, user, trench)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
@@ -93,17 +148,43 @@ func (s *Server) HandleTrench(httpMethod, relativePath string, handler TrenchHan
 		b.ReadOnly = !userDB.CanWriteTrench(user, trench)
 
 		code, resp := handler(c, b)
-		if resp == nil {
-			c.Status(code)
-		} else if err, ok := resp.(error); ok {
-			c.JSON(code, map[string]string{"error": err.Error()})
-		} else {
-			c.JSON(code, resp)
+		respond(c, code, resp)
+	}
+	return s.r.Handle(httpMethod, relativePath, h)
+}
+
+// ProjectHandlerFunc handles requests about all the trenches of a project,
+// which are opened on behalf of user.
+type ProjectHandlerFunc func(c *gin.Context, projectDir, user string) (int, any)
+
+func (s *Server) HandleProject(httpMethod, relativePath string, handler ProjectHandlerFunc) gin.IRoutes {
+	h := func(c *gin.Context) {
+		projectDir, user, _, ok := s.authorize(c)
+		if !ok {
+			return
 		}
+		code, resp := handler(c, projectDir, user)
+		respond(c, code, resp)
 	}
 	return s.r.Handle(httpMethod, relativePath, h)
 }
 
+// Metrics reports the survey cache metrics in the Prometheus text format.
+func (s *Server) Metrics(c *gin.Context) {
+	stats := surveyCache.Stats()
+	var b strings.Builder
+	metric := func(name, kind, help string, value int64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+	}
+	metric("idig_survey_cache_hits_total", "counter", "Surveys and survey lists read from the cache.", stats.Hits)
+	metric("idig_survey_cache_misses_total", "counter", "Surveys and survey lists not found in the cache.", stats.Misses)
+	metric("idig_survey_cache_evictions_total", "counter", "Entries evicted to stay within the memory bound.", stats.Evictions)
+	metric("idig_survey_cache_entries", "gauge", "Entries in the cache.", int64(stats.Entries))
+	metric("idig_survey_cache_bytes", "gauge", "Estimated memory used by the cache.", stats.Bytes)
+	metric("idig_survey_cache_max_bytes", "gauge", "Memory bound of the cache.", stats.MaxBytes)
+	c.String(http.StatusOK, b.String())
+}
+
 type ListTrenchesResponse struct {
 	Trenches []Trench `json:"trenches"`
 }
@@ -141,13 +222,12 @@ func (s *Server) ListTrenches(c *gin.Context) (int, any) {
 			continue
 		}
 
-		entries, err := os.ReadDir(projectDir)
+		names, err := ListTrenchNames(projectDir)
 		if err != nil {
 			return http.StatusInternalServerError, fmt.Errorf("Failed to list trenches")
 		}
 
-		for _, e := range entries {
-			trench := e.Name()
+		for _, trench := range names {
 			b, err := NewBackend(projectDir, user, trench)
 			if err != nil {
 				continue
@@ -192,6 +272,7 @@ type SyncResponse struct {
 	Preferences []byte   `json:"preferences,omitempty"` // Serialized preferences if different
 	Missing     []string `json:"missing,omitempty"`     // List of missing attachments
 	Updates     []Patch  `json:"updates,omitempty"`     // List of patches need to be applied on the client
+	Warnings    []string `json:"warnings,omitempty"`    // Problems found in the pushed surveys
 }
 
 func (r SyncResponse) String() string {
@@ -209,6 +290,9 @@ func (r SyncResponse) String() string {
 	if len(r.Updates) > 0 {
 		s += fmt.Sprintf(", updates: [%d patches]", len(r.Updates))
 	}
+	if len(r.Warnings) > 0 {
+		s += fmt.Sprintf(", warnings: [%d]", len(r.Warnings))
+	}
 	return s + "}"
 }
 
@@ -312,7 +396,11 @@ func (s *Server) SyncTrench(c *gin.Context, b *Backend) (int, any) {
 	missingAttachments := make(Set)
 	for _, survey := range req.Surveys {
 		for _, a := range survey.Attachments() {
-			if !b.ExistsAttachment(a.Name, a.Checksum) {
+			exists, err := b.ExistsAttachment(a.Name, a.Checksum)
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
+			if !exists {
 				missingAttachments.Insert(a.Name)
 			}
 		}
@@ -328,11 +416,28 @@ func (s *Server) SyncTrench(c *gin.Context, b *Backend) (int, any) {
 	}
 
 	newHead, err := b.WriteTrench(req.Device, req.Message, req.Preferences, req.Surveys)
-	if err != nil {
+	if errors.Is(err, ErrLowDiskSpace) {
+		return http.StatusInsufficientStorage, err
+	} else if errors.Is(err, ErrAttachmentClash) {
+		return http.StatusConflict, err
+	} else if err != nil {
 		return http.StatusBadRequest, err
 	}
 
 	resp := SyncResponse{Version: newHead}
+	for _, clash := range FindAttachmentClashes(req.Surveys) {
+		resp.Warnings = append(resp.Warnings, fmt.Sprintf("Attachment name clash: %s", clash))
+	}
+	if strat := b.cfg.Stratigraphy; strat != nil && strat.SyncWarnings {
+		problems := CheckStratigraphy(req.Surveys, b.Trench, strat)
+		for i, p := range problems {
+			if i == MaxSyncStratigraphyWarnings {
+				resp.Warnings = append(resp.Warnings, fmt.Sprintf("%d more stratigraphic problems", len(problems)-i))
+				break
+			}
+			resp.Warnings = append(resp.Warnings, p.String())
+		}
+	}
 	if newHead != head {
 		resp.Status = StatusPushed
 	} else {
@@ -343,9 +448,9 @@ func (s *Server) SyncTrench(c *gin.Context, b *Backend) (int, any) {
 }
 
 func (s *Server) ReadTrench(c *gin.Context, b *Backend) (int, any) {
-	version, _ := c.GetQuery("version")
-	if version == "" {
-		version = b.Head()
+	version, status, err := queryVersion(c, b)
+	if err != nil {
+		return status, err
 	}
 
 	log.Printf("> PULL %s %s", b.Trench, version)
@@ -410,6 +515,89 @@ func (s *Server) ReadAttachment(c *gin.Context, b *Backend) (int, any) {
 	return http.StatusOK, nil
 }
 
+// ReadTileInfo returns the size of the tile pyramid of an image attachment.
+// While its tiles are being generated, it answers 202 Accepted.
+func (s *Server) ReadTileInfo(c *gin.Context, b *Backend) (int, any) {
+	name := c.Param("name")
+	checksum, _ := c.GetQuery("checksum")
+	if checksum == "" {
+		return http.StatusBadRequest, fmt.Errorf("Missing attachment checksum")
+	}
+	if exists, err := b.ExistsAttachment(name, checksum); err != nil {
+		return http.StatusInternalServerError, err
+	} else if !exists {
+		return http.StatusNotFound, fmt.Errorf("Attachment '%s' not found", name)
+	}
+
+	info, err := b.ReadTileInfo(name, checksum)
+	if errors.Is(err, ErrTilesPending) {
+		c.Header("Retry-After", "5")
+		return http.StatusAccepted, err
+	} else if errors.Is(err, ErrUnsupportedImage) {
+		return http.StatusUnsupportedMediaType, err
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, info
+}
+
+// ReadTile returns a tile of an image attachment. Tiles are generated in the
+// background on first use and cached by blob hash.
+func (s *Server) ReadTile(c *gin.Context, b *Backend) (int, any) {
+	name := c.Param("name")
+	checksum, _ := c.GetQuery("checksum")
+	if checksum == "" {
+		return http.StatusBadRequest, fmt.Errorf("Missing attachment checksum")
+	}
+	z, err1 := strconv.Atoi(c.Param("z"))
+	x, err2 := strconv.Atoi(c.Param("x"))
+	y, err3 := strconv.Atoi(strings.TrimSuffix(c.Param("y"), ".jpg"))
+	if err1 != nil || err2 != nil || err3 != nil {
+		return http.StatusBadRequest, fmt.Errorf("Invalid tile coordinates")
+	}
+	if exists, err := b.ExistsAttachment(name, checksum); err != nil {
+		return http.StatusInternalServerError, err
+	} else if !exists {
+		return http.StatusNotFound, fmt.Errorf("Attachment '%s' not found", name)
+	}
+
+	data, err := b.ReadTile(name, checksum, z, x, y)
+	if errors.Is(err, ErrTilesPending) {
+		c.Header("Retry-After", "5")
+		return http.StatusAccepted, err
+	} else if errors.Is(err, ErrUnsupportedImage) {
+		return http.StatusUnsupportedMediaType, err
+	} else if errors.Is(err, ErrTileNotFound) {
+		return http.StatusNotFound, err
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	// The checksum identifies the content, so tiles never change
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.Data(http.StatusOK, "image/jpeg", data)
+	return http.StatusOK, nil
+}
+
+type AttachmentUsageResponse struct {
+	Name       string                `json:"name"`
+	References []AttachmentReference `json:"references"`
+}
+
+// ReadAttachmentUsage lists the surveys and versions referencing an
+// attachment. The optional checksum narrows it down to a single file.
+func (s *Server) ReadAttachmentUsage(c *gin.Context, b *Backend) (int, any) {
+	name := c.Param("name")
+	checksum := c.Query("checksum")
+	refs, err := b.AttachmentReferences(name, checksum)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if len(refs) == 0 {
+		return http.StatusNotFound, fmt.Errorf("Attachment '%s' is not used by any survey", name)
+	}
+	return http.StatusOK, &AttachmentUsageResponse{Name: name, References: refs}
+}
+
 func (s *Server) WriteAttachment(c *gin.Context, b *Backend) (int, any) {
 	defer func() {
 		// Drain any leftovers and close
@@ -432,22 +620,45 @@ func (s *Server) WriteAttachment(c *gin.Context, b *Backend) (int, any) {
 	}
 
 	err = b.WriteAttachment(name, checksum, data)
-	if err != nil {
+	if errors.Is(err, ErrQuotaExceeded) || errors.Is(err, ErrLowDiskSpace) {
+		return http.StatusInsufficientStorage, err
+	} else if err != nil {
 		return http.StatusInternalServerError, err
 	}
 
 	return http.StatusOK, nil
 }
 
+// queryVersion resolves the version query parameter to a full hash,
+// defaulting to the latest version.
+func queryVersion(c *gin.Context, b *Backend) (string, int, error) {
+	version := c.Query("version")
+	if version == "" {
+		version = b.Head()
+		if version == "" {
+			return "", http.StatusNotFound, fmt.Errorf("Trench %s has no versions", b.Trench)
+		}
+	}
+	commit, err := b.ResolveVersion(version)
+	if errors.Is(err, ErrAmbiguousVersion) {
+		return "", http.StatusBadRequest, err
+	} else if errors.Is(err, ErrInvalidVersion) {
+		return "", http.StatusNotFound, err
+	} else if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	return commit.Hash.String(), http.StatusOK, nil
+}
+
 type ReadSurveysResponse struct {
 	Version string   `json:"version"`
 	Surveys []Survey `json:"surveys"`
 }
 
 func (s *Server) ReadSurveys(c *gin.Context, b *Backend) (int, any) {
-	version, _ := c.GetQuery("version")
-	if version == "" {
-		version = b.Head()
+	version, status, err := queryVersion(c, b)
+	if err != nil {
+		return status, err
 	}
 	surveys, err := b.ReadSurveysAtVersion(version)
 	if err != nil {
@@ -461,6 +672,250 @@ func (s *Server) ReadSurveys(c *gin.Context, b *Backend) (int, any) {
 	return http.StatusOK, &resp
 }
 
+// ExportSurveysCSV returns the surveys of a version as CSV, one row per
+// survey, optionally filtered by a comma separated list of types.
+func (s *Server) ExportSurveysCSV(c *gin.Context, b *Backend) (int, any) {
+	version, status, err := queryVersion(c, b)
+	if err != nil {
+		return status, err
+	}
+	surveys, fields, err := b.ExportSurveys(version, c.Query("type"))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	columns := SurveyColumns(surveys, fields)
+
+	filename := fmt.Sprintf("%s-%s.csv", b.Trench, Prefix(version, 7))
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	c.Status(http.StatusOK)
+	if err := WriteSurveysCSV(c.Writer, surveys, columns); err != nil {
+		log.Printf("Error writing %s.csv: %s", b.Trench, err)
+	}
+	return http.StatusOK, nil
+}
+
+// ExportTrenchGeometry returns the surveys of a version that have coordinates
+// as GeoJSON or KML, depending on the extension of the path.
+func (s *Server) ExportTrenchGeometry(c *gin.Context, b *Backend) (int, any) {
+	version, status, err := queryVersion(c, b)
+	if err != nil {
+		return status, err
+	}
+	surveys, _, err := b.ExportSurveys(version, c.Query("type"))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	name := fmt.Sprintf("%s-%s", b.Trench, Prefix(version, 7))
+	return writeFeatures(c, name, surveys, b.cfg.Geometry)
+}
+
+// ExportProjectGeometry returns the surveys with coordinates of the latest
+// version of all the trenches of a project, as GeoJSON or KML.
+func (s *Server) ExportProjectGeometry(c *gin.Context, projectDir, user string) (int, any) {
+	cfg, err := LoadProjectConfig(projectDir)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	surveys, _, err := ExportProjectSurveys(projectDir, user, "HEAD", c.Query("type"))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return writeFeatures(c, filepath.Base(projectDir), surveys, cfg.Geometry)
+}
+
+func writeFeatures(c *gin.Context, name string, surveys []Survey, cfg *GeometryConfig) (int, any) {
+	features, problems := SurveyFeatures(surveys, cfg)
+	if len(problems) > 0 {
+		log.Printf("Skipped %d invalid geometries in %s: %s", len(problems), name, problems[0])
+	}
+
+	ext := path.Ext(c.FullPath())
+	contentType := "application/geo+json"
+	if ext == ".kml" {
+		contentType = "application/vnd.google-earth.kml+xml"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ext}))
+	c.Status(http.StatusOK)
+
+	var err error
+	if ext == ".kml" {
+		err = WriteKML(c.Writer, name, features)
+	} else {
+		err = WriteGeoJSON(c.Writer, features)
+	}
+	if err != nil {
+		log.Printf("Error writing %s%s: %s", name, ext, err)
+	}
+	return http.StatusOK, nil
+}
+
+// ExportTrenchLinkedData returns the surveys of a version as JSON-LD or
+// Turtle, depending on the extension of the path, following the linked data
+// mapping of the project.
+func (s *Server) ExportTrenchLinkedData(c *gin.Context, b *Backend) (int, any) {
+	m, err := LoadLinkedDataMapping(b.dir)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	version, status, err := queryVersion(c, b)
+	if err != nil {
+		return status, err
+	}
+	surveys, _, err := b.ExportSurveys(version, c.Query("type"))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	name := fmt.Sprintf("%s-%s", b.Trench, Prefix(version, 7))
+	return writeLinkedData(c, name, LinkedDataGraph(m, b.Trench, surveys))
+}
+
+// ExportProjectLinkedData returns the latest version of all the trenches of a
+// project as JSON-LD or Turtle.
+func (s *Server) ExportProjectLinkedData(c *gin.Context, projectDir, user string) (int, any) {
+	m, err := LoadLinkedDataMapping(projectDir)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	surveys, _, err := ExportProjectSurveys(projectDir, user, "HEAD", c.Query("type"))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return writeLinkedData(c, filepath.Base(projectDir), LinkedDataGraph(m, "", surveys))
+}
+
+func writeLinkedData(c *gin.Context, name string, g *Graph) (int, any) {
+	ext := path.Ext(c.FullPath())
+	contentType := "application/ld+json"
+	if ext == ".ttl" {
+		contentType = "text/turtle; charset=utf-8"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ext}))
+	c.Status(http.StatusOK)
+
+	var err error
+	if ext == ".ttl" {
+		err = g.WriteTurtle(c.Writer)
+	} else {
+		err = g.WriteJSONLD(c.Writer)
+	}
+	if err != nil {
+		log.Printf("Error writing %s%s: %s", name, ext, err)
+	}
+	return http.StatusOK, nil
+}
+
+// TrenchHarrisMatrix returns the Harris matrix of a version of the trench as
+// JSON, DOT or GraphML, depending on the extension of the path.
+func (s *Server) TrenchHarrisMatrix(c *gin.Context, b *Backend) (int, any) {
+	version, status, err := queryVersion(c, b)
+	if err != nil {
+		return status, err
+	}
+	surveys, _, err := b.ExportSurveys(version, c.Query("type"))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	name := fmt.Sprintf("%s-%s", b.Trench, Prefix(version, 7))
+	return writeHarrisMatrix(c, name, BuildHarrisMatrix(surveys, b.Trench, b.cfg.Stratigraphy))
+}
+
+// ProjectHarrisMatrix returns the Harris matrix of the latest version of all
+// the trenches of a project.
+func (s *Server) ProjectHarrisMatrix(c *gin.Context, projectDir, user string) (int, any) {
+	cfg, err := LoadProjectConfig(projectDir)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	surveys, _, err := ExportProjectSurveys(projectDir, user, "HEAD", c.Query("type"))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	name := filepath.Base(projectDir)
+	return writeHarrisMatrix(c, name, BuildHarrisMatrix(surveys, "", cfg.Stratigraphy))
+}
+
+func writeHarrisMatrix(c *gin.Context, name string, m *HarrisMatrix) (int, any) {
+	ext := path.Ext(c.FullPath())
+	if ext == ".json" {
+		return http.StatusOK, m
+	}
+	contentType := "text/vnd.graphviz; charset=utf-8"
+	if ext == ".graphml" {
+		contentType = "application/graphml+xml"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ext}))
+	c.Status(http.StatusOK)
+
+	var err error
+	if ext == ".graphml" {
+		err = m.WriteGraphML(c.Writer)
+	} else {
+		err = m.WriteDOT(c.Writer, name)
+	}
+	if err != nil {
+		log.Printf("Error writing %s%s: %s", name, ext, err)
+	}
+	return http.StatusOK, nil
+}
+
+type StratigraphyResponse struct {
+	Problems []StratigraphyProblem `json:"problems"`
+}
+
+// CheckTrenchStratigraphy reports the problems of the stratigraphic
+// relations of a version of the trench.
+func (s *Server) CheckTrenchStratigraphy(c *gin.Context, b *Backend) (int, any) {
+	version, status, err := queryVersion(c, b)
+	if err != nil {
+		return status, err
+	}
+	surveys, err := b.ReadSurveysAtVersion(version)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	problems := CheckStratigraphy(surveys, b.Trench, b.cfg.Stratigraphy)
+	return http.StatusOK, &StratigraphyResponse{Problems: problems}
+}
+
+// CheckProjectStratigraphy reports the problems of the stratigraphic
+// relations of the latest version of all the trenches of a project.
+func (s *Server) CheckProjectStratigraphy(c *gin.Context, projectDir, user string) (int, any) {
+	cfg, err := LoadProjectConfig(projectDir)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	surveys, _, err := ExportProjectSurveys(projectDir, user, "HEAD", "")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	problems := CheckStratigraphy(surveys, "", cfg.Stratigraphy)
+	return http.StatusOK, &StratigraphyResponse{Problems: problems}
+}
+
+type SearchResponse struct {
+	Total   int            `json:"total"` // Matching surveys, of which a page is returned
+	Results []SearchResult `json:"results"`
+}
+
+// Search returns the surveys of the latest version of the trenches of a
+// project matching the filters and text of the query.
+func (s *Server) Search(c *gin.Context, projectDir, user string) (int, any) {
+	q, err := ParseSearchQuery(c.Request.URL.RawQuery)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	idx, err := ProjectSearchIndex(projectDir, user)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	results, total := idx.Search(q)
+	return http.StatusOK, &SearchResponse{Total: total, Results: results}
+}
+
 func (s *Server) ReadSurveyVersions(c *gin.Context, b *Backend) (int, any) {
 	id := c.Param("uuid")
 	versions, err := b.ReadAllSurveyVersions(id)
@@ -470,11 +925,45 @@ func (s *Server) ReadSurveyVersions(c *gin.Context, b *Backend) (int, any) {
 	return http.StatusOK, versions
 }
 
+// ListVersions lists the versions of a trench, newest first. They can be
+// filtered by since, until, user and device, and paginated with limit. When
+// there are more versions, the X-Next-Cursor header holds the cursor to pass
+// to get them.
 func (s *Server) ListVersions(c *gin.Context, b *Backend) (int, any) {
-	versions, err := b.ListVersions()
-	if err != nil {
+	q := VersionQuery{
+		Limit:  DefaultVersionLimit,
+		Cursor: c.Query("cursor"),
+		User:   c.Query("user"),
+		Device: c.Query("device"),
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > MaxVersionLimit {
+			return http.StatusBadRequest, fmt.Errorf("Invalid limit '%s'", limit)
+		}
+		q.Limit = n
+	}
+	var err error
+	if since := c.Query("since"); since != "" {
+		if q.Since, err = ParseVersionTime(since, false); err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+	if until := c.Query("until"); until != "" {
+		if q.Until, err = ParseVersionTime(until, true); err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+
+	versions, next, err := b.QueryVersions(q)
+	if errors.Is(err, ErrInvalidCursor) {
+		return http.StatusBadRequest, err
+	} else if err != nil {
 		return http.StatusInternalServerError, err
 	}
+	if next != "" {
+		c.Header("X-Next-Cursor", next)
+	}
 	return http.StatusOK, versions
 }
 
@@ -487,5 +976,122 @@ func (s *Server) ListAttachments(c *gin.Context, b *Backend) (int, any) {
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
+	if c.Query("metadata") == "true" {
+		for i, a := range attachments {
+			m, err := b.ReadAttachmentMetadata(a.Name, a.Checksum)
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
+			attachments[i].Metadata = m
+		}
+	}
 	return http.StatusOK, &ListAttachmentsResponse{Attachments: attachments}
 }
+
+// DownloadAttachments streams a ZIP file with the attachments of a version,
+// laid out as <Type>/<Identifier>/<Name>. Surveys can be filtered by uuid and
+// type.
+func (s *Server) DownloadAttachments(c *gin.Context, b *Backend) (int, any) {
+	version, status, err := queryVersion(c, b)
+	if err != nil {
+		return status, err
+	}
+	uuid := c.Query("uuid")
+	surveyType := c.Query("type")
+
+	v, err := b.VersionAt(version)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	surveys, err := b.ReadSurveysAtVersion(version)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	type zipEntry struct {
+		Path       string
+		Attachment Attachment
+	}
+	var entries []zipEntry
+	seen := make(Set)
+	for _, survey := range surveys {
+		if uuid != "" && survey.ID() != uuid {
+			continue
+		}
+		if surveyType != "" && survey["Type"] != surveyType {
+			continue
+		}
+		dir := path.Join(safeFilename(survey["Type"], "Untyped"), safeFilename(survey["Identifier"], survey.ID()))
+		for _, a := range survey.Attachments() {
+			p := path.Join(dir, safeFilename(a.Name, "attachment"))
+			if _, ok := seen[p]; ok {
+				continue
+			}
+			seen.Insert(p)
+			entries = append(entries, zipEntry{Path: p, Attachment: a})
+		}
+	}
+
+	filename := fmt.Sprintf("%s-%s.zip", b.Trench, Prefix(version, 7))
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	c.Status(http.StatusOK)
+
+	zw := zip.NewWriter(c.Writer)
+	for _, e := range entries {
+		data, err := b.ReadAttachmentAtVersion(e.Attachment.Name, e.Attachment.Checksum, version)
+		if err != nil {
+			// Headers have already been sent, all we can do is cut the stream short
+			log.Printf("Error reading attachment %s of %s: %s", e.Attachment.Name, b.Trench, err)
+			c.Abort()
+			return http.StatusOK, nil
+		}
+		// Attachments are mostly photos that don't compress well
+		header := &zip.FileHeader{Name: e.Path, Method: zip.Store, Modified: v.Date}
+		w, err := zw.CreateHeader(header)
+		if err == nil {
+			_, err = w.Write(data)
+		}
+		if err != nil {
+			log.Printf("Error writing %s.zip: %s", b.Trench, err)
+			c.Abort()
+			return http.StatusOK, nil
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("Error writing %s.zip: %s", b.Trench, err)
+	}
+	return http.StatusOK, nil
+}
+
+type CheckAttachmentsRequest struct {
+	Attachments []Attachment `json:"attachments"`
+}
+
+type CheckAttachmentsResponse struct {
+	Missing []Attachment `json:"missing"` // Attachments the server does not have
+}
+
+// CheckAttachments lets clients find out which attachments need uploading
+// before they sync.
+func (s *Server) CheckAttachments(c *gin.Context, b *Backend) (int, any) {
+	var req CheckAttachmentsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	missing := []Attachment{}
+	for _, a := range req.Attachments {
+		if a.Name == "" || a.Checksum == "" {
+			return http.StatusBadRequest, fmt.Errorf("Missing attachment name or checksum")
+		}
+		exists, err := b.ExistsAttachment(a.Name, a.Checksum)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if !exists {
+			missing = append(missing, Attachment{Name: a.Name, Checksum: a.Checksum})
+		}
+	}
+	return http.StatusOK, &CheckAttachmentsResponse{Missing: missing}
+}
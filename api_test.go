@@ -0,0 +1,267 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestServer returns a server with project P and user bruce
+func newTestServer(t *testing.T) (*Server, string) {
+	gin.SetMode(gin.TestMode)
+	root := t.TempDir()
+	assertNoError(t, addUserCmd(root, []string{"P", "bruce", "pw"}))
+	return NewServer(root), filepath.Join(root, "P")
+}
+
+func serve(s *Server, method, path string, body io.Reader) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, body)
+	req.SetBasicAuth("bruce", "pw")
+	w := httptest.NewRecorder()
+	s.r.ServeHTTP(w, req)
+	return w
+}
+
+func TestDownloadAttachments(t *testing.T) {
+	s, projectDir := newTestServer(t)
+	b, err := NewBackend(projectDir, "bruce", "BZ")
+	assertNoError(t, err)
+
+	assertNoError(t, b.WriteAttachment("a.jpg", "sum1", []byte("data-a1")))
+	assertNoError(t, b.WriteAttachment("a.jpg", "sum2", []byte("data-a2")))
+	assertNoError(t, b.WriteAttachment("b.pdf", "sum1", []byte("data-b")))
+	surveys := []Survey{
+		{"IdentifierUUID": "u1", "Identifier": "1", "Type": "Context", "RelationAttachments": "n=a.jpg\nd=sum1"},
+		{"IdentifierUUID": "u2", "Type": "Find", "RelationAttachments": "n=b.pdf\nd=sum1"},
+	}
+	v1, err := b.WriteTrench("test-dev", "", nil, surveys)
+	assertNoError(t, err)
+	surveys[0]["RelationAttachments"] = "n=a.jpg\nd=sum2"
+	_, err = b.WriteTrench("test-dev", v1, nil, surveys)
+	assertNoError(t, err)
+
+	files := func(path string) map[string]string {
+		t.Helper()
+		w := serve(s, http.MethodGet, path, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d %s", path, w.Code, w.Body)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+		assertNoError(t, err)
+		contents := make(map[string]string)
+		for _, f := range zr.File {
+			r, err := f.Open()
+			assertNoError(t, err)
+			data, err := io.ReadAll(r)
+			assertNoError(t, err)
+			contents[f.Name] = string(data)
+		}
+		return contents
+	}
+	names := func(files map[string]string) string {
+		var names []string
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+
+	zipped := files("/idig/P/BZ/attachments.zip")
+	assertEqual(t, names(zipped), "Context/1/a.jpg,Find/u2/b.pdf")
+	assertEqual(t, zipped["Context/1/a.jpg"], "data-a2")
+	assertEqual(t, zipped["Find/u2/b.pdf"], "data-b")
+
+	zipped = files("/idig/P/BZ/attachments.zip?version=" + v1)
+	assertEqual(t, zipped["Context/1/a.jpg"], "data-a1")
+
+	zipped = files("/idig/P/BZ/attachments.zip?type=Find")
+	assertEqual(t, names(zipped), "Find/u2/b.pdf")
+	zipped = files("/idig/P/BZ/attachments.zip?uuid=u1")
+	assertEqual(t, names(zipped), "Context/1/a.jpg")
+
+	w := serve(s, http.MethodGet, "/idig/P/BZ/attachments.zip?version="+v1, nil)
+	assertEqual(t, w.Header().Get("Content-Disposition"), "attachment; filename=BZ-"+v1[:7]+".zip")
+	w = serve(s, http.MethodGet, "/idig/P/BZ/attachments.zip?version=0000000", nil)
+	if w.Code == http.StatusOK {
+		t.Error("Expected an error for an unknown version")
+	}
+}
+
+func TestCheckAttachments(t *testing.T) {
+	s, projectDir := newTestServer(t)
+	b, err := NewBackend(projectDir, "bruce", "BZ")
+	assertNoError(t, err)
+	assertNoError(t, b.WriteAttachment("a.jpg", "sum1", []byte("data-a")))
+
+	check := func(body string) (int, string) {
+		w := serve(s, http.MethodPost, "/idig/P/BZ/attachments/check", strings.NewReader(body))
+		return w.Code, w.Body.String()
+	}
+
+	code, body := check(`{"attachments": [
+		{"Name": "a.jpg", "Checksum": "sum1"},
+		{"Name": "a.jpg", "Checksum": "sum2"},
+		{"Name": "b.jpg", "Checksum": "sum1"}
+	]}`)
+	assertEqual(t, code, http.StatusOK)
+	var resp CheckAttachmentsResponse
+	assertNoError(t, json.Unmarshal([]byte(body), &resp))
+	assertEqual(t, len(resp.Missing), 2)
+	if len(resp.Missing) == 2 {
+		assertEqual(t, resp.Missing[0].Name+"/"+resp.Missing[0].Checksum, "a.jpg/sum2")
+		assertEqual(t, resp.Missing[1].Name+"/"+resp.Missing[1].Checksum, "b.jpg/sum1")
+	}
+
+	// Nothing missing is an empty list, not null
+	code, body = check(`{"attachments": [{"Name": "a.jpg", "Checksum": "sum1"}]}`)
+	assertEqual(t, code, http.StatusOK)
+	assertEqual(t, body, `{"missing":[]}`)
+
+	code, body = check(`{"attachments": [{"Name": "a.jpg"}]}`)
+	assertEqual(t, code, http.StatusBadRequest)
+	assertEqual(t, body, `{"error":"Missing attachment name or checksum"}`)
+	code, _ = check(`{"attachments": "a.jpg"}`)
+	assertEqual(t, code, http.StatusBadRequest)
+}
+
+func TestAttachmentStoreErrors(t *testing.T) {
+	s, projectDir := newTestServer(t)
+	_, store := newFakeS3(t)
+	store.SecretKey = "wrong-secret"
+	assertNoError(t, (&ProjectConfig{AttachmentStore: store}).Save(projectDir))
+
+	w := serve(s, http.MethodPost, "/idig/P/BZ/attachments/check",
+		strings.NewReader(`{"attachments": [{"Name": "a.jpg", "Checksum": "sum1"}]}`))
+	assertEqual(t, w.Code, http.StatusInternalServerError)
+
+	// Clients must not be told to upload attachments the server may have
+	w = serve(s, http.MethodPost, "/idig/P/BZ", strings.NewReader(`{"device": "test-dev", "surveys": [
+		{"IdentifierUUID": "u1", "RelationAttachments": "n=a.jpg\nd=sum1"}
+	]}`))
+	assertEqual(t, w.Code, http.StatusInternalServerError)
+}
+
+func TestReadTiles(t *testing.T) {
+	s, projectDir := newTestServer(t)
+	b, err := NewBackend(projectDir, "bruce", "BZ")
+	assertNoError(t, err)
+	var buf bytes.Buffer
+	assertNoError(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, 300, 200))))
+	assertNoError(t, b.WriteAttachment("plan.png", "sum1", buf.Bytes()))
+
+	// Tiles are generated in the background
+	w := serve(s, http.MethodGet, "/idig/P/BZ/attachments/plan.png/tiles/0/0/0.jpg?checksum=sum1", nil)
+	assertEqual(t, w.Code, http.StatusAccepted)
+	assertEqual(t, w.Header().Get("Retry-After"), "5")
+	for deadline := time.Now().Add(10 * time.Second); w.Code == http.StatusAccepted && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		w = serve(s, http.MethodGet, "/idig/P/BZ/attachments/plan.png/tiles?checksum=sum1", nil)
+	}
+	assertEqual(t, w.Code, http.StatusOK)
+	w = serve(s, http.MethodGet, "/idig/P/BZ/attachments/plan.png/tiles/0/0/0.jpg?checksum=sum1", nil)
+	assertEqual(t, w.Code, http.StatusOK)
+	assertEqual(t, w.Header().Get("Content-Type"), "image/jpeg")
+}
+
+func TestProjectRoutes(t *testing.T) {
+	s, projectDir := newTestServer(t)
+	b, err := NewBackend(projectDir, "bruce", "BZ")
+	assertNoError(t, err)
+	_, err = b.WriteTrench("test-dev", "", nil, generateSurveys(1))
+	assertNoError(t, err)
+	err = os.WriteFile(filepath.Join(projectDir, "linkeddata.json"), []byte(`{"base": "https://example.org/"}`), 0o644)
+	assertNoError(t, err)
+
+	for _, path := range []string{
+		"/idig/P/_/surveys.geojson",
+		"/idig/P/_/surveys.kml",
+		"/idig/P/_/surveys.jsonld",
+		"/idig/P/_/surveys.ttl",
+		"/idig/P/_/search",
+		"/idig/P/_/harris.json",
+		"/idig/P/_/harris.dot",
+		"/idig/P/_/harris.graphml",
+		"/idig/P/_/stratigraphy",
+	} {
+		w := serve(s, http.MethodGet, path, nil)
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s: %d %s", path, w.Code, w.Body)
+		}
+
+		// Trenches can have the name of a project route
+		trench := strings.TrimPrefix(path, "/idig/P/_/")
+		tb, err := NewBackend(projectDir, "bruce", trench)
+		assertNoError(t, err)
+		version, err := tb.WriteTrench("test-dev", "", nil, generateSurveys(1))
+		assertNoError(t, err)
+		w = serve(s, http.MethodGet, "/idig/P/"+trench, nil)
+		var resp SyncResponse
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &resp) != nil {
+			t.Fatalf("GET trench %s: %d %s", trench, w.Code, w.Body)
+		}
+		assertEqual(t, resp.Version, version)
+	}
+
+	w := serve(s, http.MethodGet, "/idig/P/_", nil)
+	assertEqual(t, w.Code, http.StatusNotFound)
+}
+
+func TestMetrics(t *testing.T) {
+	s, _ := newTestServer(t)
+	w := serve(s, http.MethodGet, "/metrics", nil)
+	assertEqual(t, w.Code, http.StatusNotFound)
+
+	Metrics = true
+	defer func() { Metrics = false }()
+	s, _ = newTestServer(t)
+	w = serve(s, http.MethodGet, "/metrics", nil)
+	assertEqual(t, w.Code, http.StatusOK)
+	if !strings.Contains(w.Body.String(), "idig_survey_cache_hits_total ") {
+		t.Errorf("Unexpected metrics: %s", w.Body)
+	}
+}
+
+func TestListVersions(t *testing.T) {
+	s, projectDir := newTestServer(t)
+	b, err := NewBackend(projectDir, "bruce", "BZ")
+	assertNoError(t, err)
+	surveys := generateSurveys(3)
+	for i := range surveys {
+		_, err = b.WriteTrench("test-dev", "", nil, surveys[:i+1])
+		assertNoError(t, err)
+	}
+
+	w := serve(s, http.MethodGet, "/idig/P/BZ/versions", nil)
+	assertEqual(t, w.Code, http.StatusOK)
+	var versions []TrenchVersion
+	assertNoError(t, json.Unmarshal(w.Body.Bytes(), &versions))
+	assertEqual(t, len(versions), 3)
+	assertEqual(t, w.Header().Get("X-Next-Cursor"), "")
+
+	w = serve(s, http.MethodGet, "/idig/P/BZ/versions?limit=2", nil)
+	assertNoError(t, json.Unmarshal(w.Body.Bytes(), &versions))
+	assertEqual(t, len(versions), 2)
+	assertEqual(t, versions[1].Added, 1)
+	if w.Header().Get("X-Next-Cursor") == "" {
+		t.Error("Expected a cursor to the next page")
+	}
+
+	for _, limit := range []string{"0", "x", "1001"} {
+		w = serve(s, http.MethodGet, "/idig/P/BZ/versions?limit="+limit, nil)
+		assertEqual(t, w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BagWriter stores the files of a BagIt bag, by slash separated path
+// relative to the top of the bag.
+type BagWriter interface {
+	Create(name string, modTime time.Time) (io.Writer, error)
+	Close() error
+}
+
+// dirBag writes a bag as a directory.
+type dirBag struct {
+	dir string
+	f   *os.File
+}
+
+// NewDirBag returns a BagWriter creating dir, which must not exist or be
+// empty.
+func NewDirBag(dir string) (BagWriter, error) {
+	entries, err := os.ReadDir(dir)
+	if err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("Directory '%s' is not empty", dir)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &dirBag{dir: dir}, nil
+}
+
+func (d *dirBag) Create(name string, modTime time.Time) (io.Writer, error) {
+	if err := d.Close(); err != nil {
+		return nil, err
+	}
+	filename := filepath.Join(d.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	d.f = f
+	return f, nil
+}
+
+func (d *dirBag) Close() error {
+	if d.f == nil {
+		return nil
+	}
+	err := d.f.Close()
+	d.f = nil
+	return err
+}
+
+// zipBag writes a bag as a ZIP file holding a single directory, as required
+// for serialized bags.
+type zipBag struct {
+	root string
+	zw   *zip.Writer
+}
+
+// NewZipBag returns a BagWriter writing a ZIP file to w, with the bag in
+// directory root.
+func NewZipBag(w io.Writer, root string) BagWriter {
+	return &zipBag{root: root, zw: zip.NewWriter(w)}
+}
+
+func (z *zipBag) Create(name string, modTime time.Time) (io.Writer, error) {
+	return z.zw.CreateHeader(&zip.FileHeader{
+		Name:     z.root + "/" + name,
+		Method:   zip.Deflate,
+		Modified: modTime.UTC(),
+	})
+}
+
+func (z *zipBag) Close() error {
+	return z.zw.Close()
+}
+
+// ArchiveSummary describes an archived version.
+type ArchiveSummary struct {
+	Version     string
+	Surveys     int
+	Attachments int
+	Files       int   // In the payload
+	Bytes       int64 // Of the payload
+}
+
+func (s ArchiveSummary) String() string {
+	return fmt.Sprintf("version %s, %d surveys, %d attachments, %d files (%s)",
+		Prefix(s.Version, 7), s.Surveys, s.Attachments, s.Files, FormatSize(s.Bytes))
+}
+
+// Archive writes a version of the trench as a BagIt bag, with SHA-256
+// manifests, for deposition. The payload in data/ holds the surveys as JSON
+// and CSV, the preferences, the attachments under their original names and
+// the log of versions up to the archived one. Files are dated and ordered
+// by the version alone, so archiving the same version twice gives the same
+// bag.
+func (b *Backend) Archive(version string, bag BagWriter) (*ArchiveSummary, error) {
+	c, err := b.ResolveVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	version = c.Hash.String()
+	date := c.Author.When
+
+	surveys, fields, err := b.ExportSurveys(version, "")
+	if err != nil {
+		return nil, err
+	}
+	// Trenches synced without preferences have none to archive
+	preferences, _ := b.ReadPreferencesAtVersion(version)
+	versions, _, err := b.QueryVersions(VersionQuery{Cursor: version})
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &ArchiveSummary{Version: version, Surveys: len(surveys)}
+	manifest := make(map[string]string)
+	writeFile := func(name string, write func(w io.Writer) error) error {
+		w, err := bag.Create(name, date)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		cw := &countingWriter{w: io.MultiWriter(w, h)}
+		if err := write(cw); err != nil {
+			return fmt.Errorf("Error writing %s: %w", name, err)
+		}
+		manifest[name] = hex.EncodeToString(h.Sum(nil))
+		if strings.HasPrefix(name, "data/") {
+			summary.Files++
+			summary.Bytes += cw.n
+		}
+		return nil
+	}
+	writeData := func(name string, data []byte) error {
+		return writeFile(name, func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		})
+	}
+	writeJSON := func(name string, v any) error {
+		data, err := json.MarshalIndent(v, "", " ")
+		if err != nil {
+			return err
+		}
+		return writeData(name, append(data, '\n'))
+	}
+
+	if err := writeJSON("data/surveys.json", surveys); err != nil {
+		return nil, err
+	}
+	err = writeFile("data/surveys.csv", func(w io.Writer) error {
+		return WriteSurveysCSV(w, surveys, SurveyColumns(surveys, fields))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if preferences != nil {
+		if err := writeData("data/Preferences.json", preferences); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeJSON("data/versions.json", versions); err != nil {
+		return nil, err
+	}
+
+	// Attachments in the order of their names, clashing names get renamed
+	attachments := make(map[string]Attachment)
+	for _, s := range surveys {
+		for _, a := range s.Attachments() {
+			name := safeFilename(a.Name, "attachment")
+			if other, ok := attachments[name]; ok && other.Checksum != a.Checksum {
+				name = clashName(name, a.Checksum)
+			}
+			attachments[name] = a
+		}
+	}
+	names := make([]string, 0, len(attachments))
+	for name := range attachments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		a := attachments[name]
+		data, err := b.ReadAttachmentAtVersion(a.Name, a.Checksum, version)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading attachment '%s': %w", a.Name, err)
+		}
+		if err := writeData("data/attachments/"+name, data); err != nil {
+			return nil, err
+		}
+		summary.Attachments++
+	}
+
+	// Tag files, see RFC 8493
+	err = writeData("bagit.txt", []byte("BagIt-Version: 1.0\nTag-File-Character-Encoding: UTF-8\n"))
+	if err != nil {
+		return nil, err
+	}
+	var info bytes.Buffer
+	fmt.Fprintf(&info, "Bag-Software-Agent: idig-server\n")
+	fmt.Fprintf(&info, "Bagging-Date: %s\n", date.Format(time.DateOnly))
+	fmt.Fprintf(&info, "External-Description: iDig trench %s, version %s\n", b.Trench, version)
+	fmt.Fprintf(&info, "External-Identifier: %s\n", version)
+	fmt.Fprintf(&info, "Payload-Oxum: %d.%d\n", summary.Bytes, summary.Files)
+	fmt.Fprintf(&info, "Version-Date: %s\n", date.Format(time.RFC3339))
+	if err := writeData("bag-info.txt", info.Bytes()); err != nil {
+		return nil, err
+	}
+	payload := bagManifest(manifest, func(name string) bool { return strings.HasPrefix(name, "data/") })
+	if err := writeData("manifest-sha256.txt", payload); err != nil {
+		return nil, err
+	}
+	tags := bagManifest(manifest, func(name string) bool { return !strings.HasPrefix(name, "data/") })
+	if err := writeData("tagmanifest-sha256.txt", tags); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// bagManifest returns the lines of a manifest for the files matching keep,
+// sorted by path.
+func bagManifest(checksums map[string]string, keep func(name string) bool) []byte {
+	var names []string
+	for name := range checksums {
+		if keep(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	// Line breaks and percent signs in paths are percent-encoded
+	escape := strings.NewReplacer("%", "%25", "\n", "%0A", "\r", "%0D")
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s  %s\n", checksums[name], escape.Replace(path.Clean(name)))
+	}
+	return buf.Bytes()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
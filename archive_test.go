@@ -0,0 +1,120 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestArchive(t *testing.T) {
+	b, err := NewMemoryBackend("test-user", "BZ")
+	assertNoError(t, err)
+	assertNoError(t, b.WriteAttachment("a.jpg", "sum1", []byte("photo")))
+	surveys := []Survey{
+		{"IdentifierUUID": "u1", "Identifier": "1", "Type": "Context", "RelationAttachments": "n=a.jpg\nd=sum1"},
+	}
+	version, err := b.WriteTrench("test-dev", "", []byte(testPreferences), surveys)
+	assertNoError(t, err)
+	surveys = append(surveys, Survey{"IdentifierUUID": "u2", "Identifier": "2", "Type": "Find"})
+	_, err = b.WriteTrench("test-dev", "", []byte(testPreferences), surveys)
+	assertNoError(t, err)
+
+	dir := filepath.Join(t.TempDir(), "bag")
+	bag, err := NewDirBag(dir)
+	assertNoError(t, err)
+	summary, err := b.Archive(version, bag)
+	assertNoError(t, err)
+	assertNoError(t, bag.Close())
+	assertEqual(t, summary.Version, version)
+	assertEqual(t, summary.Surveys, 1)
+	assertEqual(t, summary.Attachments, 1)
+	assertEqual(t, summary.Files, 5)
+
+	photo, err := os.ReadFile(filepath.Join(dir, "data", "attachments", "a.jpg"))
+	assertNoError(t, err)
+	assertEqual(t, string(photo), "photo")
+	info, err := os.ReadFile(filepath.Join(dir, "bag-info.txt"))
+	assertNoError(t, err)
+	if !strings.Contains(string(info), "Payload-Oxum: ") || !strings.Contains(string(info), ".5\n") {
+		t.Errorf("Unexpected bag-info.txt: %s", info)
+	}
+
+	// Every manifest line matches its file
+	checkManifest := func(name string, count int) {
+		manifest, err := os.ReadFile(filepath.Join(dir, name))
+		assertNoError(t, err)
+		lines := strings.Split(strings.TrimSpace(string(manifest)), "\n")
+		assertEqual(t, len(lines), count)
+		for _, line := range lines {
+			sum, path, _ := strings.Cut(line, "  ")
+			data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(path)))
+			assertNoError(t, err)
+			h := sha256.Sum256(data)
+			assertEqual(t, hex.EncodeToString(h[:]), sum)
+		}
+	}
+	checkManifest("manifest-sha256.txt", 5)
+	checkManifest("tagmanifest-sha256.txt", 3)
+
+	bag, err = NewDirBag(dir)
+	if err == nil {
+		t.Error("Expected an error archiving to a directory that isn't empty")
+	}
+
+	// Archiving a version again gives the same ZIP
+	archiveZip := func() []byte {
+		var buf bytes.Buffer
+		bag := NewZipBag(&buf, "BZ")
+		_, err := b.Archive("HEAD~1", bag)
+		assertNoError(t, err)
+		assertNoError(t, bag.Close())
+		return buf.Bytes()
+	}
+	data := archiveZip()
+	assertEqual(t, bytes.Equal(data, archiveZip()), true)
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	assertNoError(t, err)
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	assertEqual(t, strings.Join(names, ","), "BZ/data/surveys.json,BZ/data/surveys.csv,BZ/data/Preferences.json,"+
+		"BZ/data/versions.json,BZ/data/attachments/a.jpg,BZ/bagit.txt,BZ/bag-info.txt,BZ/manifest-sha256.txt,BZ/tagmanifest-sha256.txt")
+}
+
+func TestArchiveCmdFailure(t *testing.T) {
+	root := t.TempDir()
+	b, err := NewBackend(filepath.Join(root, "P"), "test-user", "BZ")
+	assertNoError(t, err)
+	assertNoError(t, b.WriteAttachment("a.jpg", "sum1", []byte("photo")))
+	surveys := []Survey{
+		{"IdentifierUUID": "u1", "Identifier": "1", "Type": "Context", "RelationAttachments": "n=a.jpg\nd=sum1"},
+	}
+	_, err = b.WriteTrench("test-dev", "", nil, surveys)
+	assertNoError(t, err)
+	// Archiving fails after writing part of the bag
+	h := plumbing.ComputeHash(plumbing.BlobObject, []byte("photo")).String()
+	assertNoError(t, os.Remove(filepath.Join(root, "P", "BZ", "objects", h[:2], h[2:])))
+
+	out := t.TempDir()
+	empty := filepath.Join(out, "empty")
+	assertNoError(t, os.Mkdir(empty, 0o755))
+	for _, output := range []string{filepath.Join(out, "BZ.zip"), filepath.Join(out, "BZ"), empty} {
+		if err := archiveCmd(root, []string{"P/BZ", output}); err == nil {
+			t.Fatalf("Expected an error archiving to %s", output)
+		}
+	}
+	entries, err := os.ReadDir(out)
+	assertNoError(t, err)
+	assertEqual(t, len(entries), 1)
+	entries, err = os.ReadDir(empty)
+	assertNoError(t, err)
+	assertEqual(t, len(entries), 0)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// How to handle different attachments with the same name
+const (
+	ClashRename = "rename" // Store them under distinct names in the version
+	ClashReject = "reject" // Refuse the sync
+)
+
+var ErrAttachmentClash = errors.New("Attachment name clash")
+
+// AttachmentClash is a name used by different attachments.
+type AttachmentClash struct {
+	Name      string   `json:"name"`
+	Checksums []string `json:"checksums"`
+	Surveys   []string `json:"surveys"` // UUIDs of the surveys using the name
+}
+
+func (c AttachmentClash) String() string {
+	return fmt.Sprintf("'%s' is used by %d different attachments in surveys %s",
+		c.Name, len(c.Checksums), strings.Join(c.Surveys, ", "))
+}
+
+// FindAttachmentClashes returns the attachment names that surveys use for
+// more than one file, sorted by name.
+func FindAttachmentClashes(surveys []Survey) []AttachmentClash {
+	checksums := make(map[string]Set)
+	users := make(map[string]Set)
+	for _, survey := range surveys {
+		for _, a := range survey.Attachments() {
+			if checksums[a.Name] == nil {
+				checksums[a.Name] = make(Set)
+				users[a.Name] = make(Set)
+			}
+			checksums[a.Name].Insert(a.Checksum)
+			users[a.Name].Insert(survey.ID())
+		}
+	}
+
+	var clashes []AttachmentClash
+	for name, sums := range checksums {
+		if len(sums) < 2 {
+			continue
+		}
+		clash := AttachmentClash{Name: name, Checksums: sums.Array(), Surveys: users[name].Array()}
+		sort.Strings(clash.Checksums)
+		sort.Strings(clash.Surveys)
+		clashes = append(clashes, clash)
+	}
+	sort.Slice(clashes, func(i, j int) bool {
+		return clashes[i].Name < clashes[j].Name
+	})
+	return clashes
+}
+
+// clashName returns the name under which an attachment is stored in the
+// attachments tree of a version when its name clashes with another
+// attachment, e.g. IMG_0001~2024-06-01T10_41_07Z.jpg. The whole checksum is
+// kept, as checksums are often timestamps sharing long prefixes.
+func clashName(name, checksum string) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	return fmt.Sprintf("%s~%s%s", base, safeFilename(checksum, "_"), ext)
+}
+
+// shortClashName returns the clash name of an attachment in versions that
+// kept only the first 8 characters of checksums.
+func shortClashName(name, checksum string) string {
+	return clashName(name, Prefix(checksum, 8))
+}
+
+// AttachmentReference is a survey referencing an attachment.
+type AttachmentReference struct {
+	Survey     string   `json:"survey"` // UUID
+	Identifier string   `json:"identifier,omitempty"`
+	Type       string   `json:"type,omitempty"`
+	Checksum   string   `json:"checksum"`
+	Current    bool     `json:"current"`  // Referenced by the latest version
+	Versions   []string `json:"versions"` // Newest first
+}
+
+// AttachmentReferences returns the surveys referencing an attachment in any
+// version, along with those versions. An empty checksum matches all the
+// attachments with that name.
+func (b *Backend) AttachmentReferences(name, checksum string) ([]AttachmentReference, error) {
+	head := b.Head()
+	if head == "" {
+		return nil, nil
+	}
+	it, err := b.r.Log(&git.LogOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Error getting version list: %w", err)
+	}
+
+	var refs []*AttachmentReference
+	byKey := make(map[string]*AttachmentReference)
+	parsed := make(map[plumbing.Hash][]AttachmentReference) // By survey blob
+
+	err = it.ForEach(func(c *object.Commit) error {
+		rootTree, err := b.r.TreeObject(c.TreeHash)
+		if err != nil {
+			return err
+		}
+		surveysTree, err := rootTree.Tree("surveys")
+		if errors.Is(err, object.ErrDirectoryNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		version := c.Hash.String()
+		for _, e := range surveysTree.Entries {
+			found, ok := parsed[e.Hash]
+			if !ok {
+				if found, err = b.surveyReferences(e.Hash, name, checksum); err != nil {
+					return fmt.Errorf("Error reading survey %s: %w", e.Name, err)
+				}
+				parsed[e.Hash] = found
+			}
+			for _, ref := range found {
+				key := ref.Survey + "/" + ref.Checksum
+				r := byKey[key]
+				if r == nil {
+					r = &AttachmentReference{
+						Survey:     ref.Survey,
+						Identifier: ref.Identifier,
+						Type:       ref.Type,
+						Checksum:   ref.Checksum,
+						Current:    version == head,
+					}
+					byKey[key] = r
+					refs = append(refs, r)
+				}
+				r.Versions = append(r.Versions, version)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]AttachmentReference, len(refs))
+	for i, r := range refs {
+		result[i] = *r
+	}
+	return result, nil
+}
+
+func (b *Backend) surveyReferences(h plumbing.Hash, name, checksum string) ([]AttachmentReference, error) {
+	survey, err := b.readSurvey(h)
+	if err != nil {
+		return nil, err
+	}
+	var refs []AttachmentReference
+	for _, a := range survey.Attachments() {
+		if a.Name != name || (checksum != "" && a.Checksum != checksum) {
+			continue
+		}
+		refs = append(refs, AttachmentReference{
+			Survey:     survey.ID(),
+			Identifier: survey["Identifier"],
+			Type:       survey["Type"],
+			Checksum:   a.Checksum,
+		})
+	}
+	return refs, nil
+}
@@ -1,37 +1,62 @@
 package main
 
 import (
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 	"time"
 
+	"github.com/go-git/go-billy/v5/osfs"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
 	"github.com/go-git/go-git/v5/plumbing/filemode"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/filesystem"
 	"github.com/go-git/go-git/v5/storage/memory"
 )
 
+// Directory inside a project holding the project-wide attachment store
+const SharedAttachmentsDir = ".attachments"
+
+// Device of the versions made by the server itself, e.g. to add reciprocal
+// relations
+const ServerDevice = "server"
+
 type Backend struct {
 	User     string
 	Trench   string
 	ReadOnly bool
 	r        *git.Repository
+	shared   *git.Repository // Project-wide attachment store, if enabled
+	store    AttachmentStore
+	dir      string // Project directory, empty for memory backends
+	cfg      *ProjectConfig
+	keys     *Keyring // Encryption keys, nil if the project is not encrypted
 }
 
 func NewBackend(root, user, trench string) (*Backend, error) {
-	gitDir := filepath.Join(root, trench)
-	r, err := git.PlainOpen(gitDir)
-	if errors.Is(err, git.ErrRepositoryNotExists) {
-		r, err = git.PlainInit(gitDir, true)
+	cfg, err := LoadProjectConfig(root)
+	if err != nil {
+		return nil, err
 	}
+	keys, err := ProjectKeyring(root)
+	if err != nil {
+		return nil, err
+	}
+
+	gitDir := filepath.Join(root, trench)
+	r, err := openRepository(root, gitDir)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to open repository for '%s': %w", trench, err)
 	}
@@ -39,10 +64,105 @@ func NewBackend(root, user, trench string) (*Backend, error) {
 		User:   user,
 		Trench: trench,
 		r:      r,
+		dir:    root,
+		cfg:    cfg,
+		keys:   keys,
+	}
+
+	if cfg.SharedAttachments {
+		b.shared, err = openRepository(root, filepath.Join(root, SharedAttachmentsDir))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open attachment store: %w", err)
+		}
+		if err := linkSharedAttachments(gitDir); err != nil {
+			return nil, fmt.Errorf("Failed to link attachment store for '%s': %w", trench, err)
+		}
+	}
+
+	b.store, err = NewAttachmentStore(cfg, root, trench, b.r, b.shared)
+	if err != nil {
+		return nil, err
 	}
 	return b, nil
 }
 
+// openRepository opens the bare repository at gitDir, creating it if needed.
+// Alternate object directories are resolved inside the project directory,
+// which is where the shared attachment store lives.
+func openRepository(projectDir, gitDir string) (*git.Repository, error) {
+	_, err := git.PlainOpen(gitDir)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		_, err = git.PlainInit(gitDir, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	st := filesystem.NewStorageWithOptions(osfs.New(gitDir), cache.NewObjectLRUDefault(), filesystem.Options{
+		AlternatesFS: osfs.New(projectDir),
+	})
+	return git.Open(st, nil)
+}
+
+// linkSharedAttachments adds the shared attachment store to the alternate
+// object directories of a trench, so that the trench can read its blobs. The
+// path is relative to the objects directory, as git expects.
+func linkSharedAttachments(gitDir string) error {
+	alternate := path.Join("..", "..", SharedAttachmentsDir, "objects")
+	alternatesFile := filepath.Join(gitDir, "objects", "info", "alternates")
+	lines, err := ReadLines(alternatesFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if slices.Contains(lines, alternate) {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(alternatesFile), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(alternatesFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, alternate)
+	return err
+}
+
+// ListTrenchNames returns the names of all trenches in a project.
+func ListTrenchNames(projectDir string) ([]string, error) {
+	entries, err := os.ReadDir(projectDir)
+	if err != nil {
+		return nil, err
+	}
+	var trenches []string
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if !FileExists(filepath.Join(projectDir, e.Name(), "HEAD")) {
+			continue
+		}
+		trenches = append(trenches, e.Name())
+	}
+	return trenches, nil
+}
+
+// ListProjects returns the names of all projects in the root directory.
+func ListProjects(rootDir string) ([]string, error) {
+	entries, err := os.ReadDir(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	var projects []string
+	for _, e := range entries {
+		if e.IsDir() && FileExists(filepath.Join(rootDir, e.Name(), "users.txt")) {
+			projects = append(projects, e.Name())
+		}
+	}
+	return projects, nil
+}
+
 func NewMemoryBackend(user, trench string) (*Backend, error) {
 	storage := memory.NewStorage()
 	r, err := git.Init(storage, nil)
@@ -53,19 +173,14 @@ func NewMemoryBackend(user, trench string) (*Backend, error) {
 		User:   user,
 		Trench: trench,
 		r:      r,
+		store:  &GitAttachmentStore{r: r, blobs: r},
+		cfg:    &ProjectConfig{},
 	}
 	return b, nil
 }
 
-func (b *Backend) ExistsAttachment(name, checksum string) bool {
-	refName := b.attachmentReference(name, checksum)
-	_, err := b.r.Reference(plumbing.ReferenceName(refName), false)
-	return err == nil
-}
-
-type TrenchVersion struct {
-	Version string    `json:"version"`
-	Date    time.Time `json:"date"`
+func (b *Backend) ExistsAttachment(name, checksum string) (bool, error) {
+	return b.store.Exists(name, checksum)
 }
 
 func (b *Backend) Version() (TrenchVersion, error) {
@@ -73,44 +188,74 @@ func (b *Backend) Version() (TrenchVersion, error) {
 	if err != nil {
 		return TrenchVersion{}, err
 	}
-	c, err := b.r.CommitObject(head.Hash())
+	return b.VersionAt(head.Hash().String())
+}
+
+func (b *Backend) VersionAt(version string) (TrenchVersion, error) {
+	c, err := b.ResolveVersion(version)
 	if err != nil {
 		return TrenchVersion{}, err
 	}
-	version := TrenchVersion{
-		Version: c.Hash.String(),
-		Date:    c.Author.When,
-	}
-	return version, nil
+	return b.trenchVersion(c, nil, nil)
 }
 
 func (b *Backend) ListVersions() ([]TrenchVersion, error) {
-	var versions []TrenchVersion
-	it, err := b.r.Log(&git.LogOptions{})
+	versions, _, err := b.QueryVersions(VersionQuery{})
+	return versions, err
+}
+
+func (b *Backend) ReadAttachment(name, checksum string) ([]byte, error) {
+	data, err := b.store.Read(name, checksum)
 	if err != nil {
-		return nil, fmt.Errorf("Error getting version list: %w", err)
+		return nil, err
 	}
-	err = it.ForEach(func(c *object.Commit) error {
-		version := TrenchVersion{
-			Version: c.Hash.String(),
-			Date:    c.Author.When,
+	return b.decrypt(data)
+}
+
+// ReadAttachmentAtVersion reads an attachment from the attachments tree of a
+// version, so it is still available after its reference has been deleted.
+// The checksum, if given, selects between attachments with the same name.
+func (b *Backend) ReadAttachmentAtVersion(name, checksum, version string) ([]byte, error) {
+	commit, err := b.ResolveVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	rootTree, err := b.r.TreeObject(commit.TreeHash)
+	if err != nil {
+		return nil, err
+	}
+	attachmentsTree, err := rootTree.Tree("attachments")
+	if err != nil {
+		return nil, err
+	}
+	entry, err := attachmentsTree.FindEntry(name)
+	if checksum != "" {
+		for _, clash := range []string{clashName(name, checksum), shortClashName(name, checksum)} {
+			if clashEntry, err1 := attachmentsTree.FindEntry(clash); err1 == nil {
+				entry, err = clashEntry, nil
+				break
+			}
 		}
-		versions = append(versions, version)
-		return nil
-	})
+	}
 	if err != nil {
-		return nil, fmt.Errorf("Error getting version list: %w", err)
+		return nil, fmt.Errorf("Attachment '%s' not found: %w", name, err)
+	}
+	data, err := b.readBlob(entry.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if a, ok := parseAttachmentPointer(data); ok {
+		return b.ReadAttachment(a.Name, a.Checksum)
 	}
-	return versions, nil
+	return data, nil
 }
 
-func (b *Backend) ReadAttachment(name, checksum string) ([]byte, error) {
-	refName := b.attachmentReference(name, checksum)
-	ref, err := b.r.Reference(plumbing.ReferenceName(refName), false)
+func (b *Backend) ReadAttachmentMetadata(name, checksum string) (*AttachmentMetadata, error) {
+	data, err := b.ReadAttachment(name, checksum)
 	if err != nil {
-		return nil, fmt.Errorf("Attachment '%s' not found: %w", name, err)
+		return nil, err
 	}
-	return b.readBlob(ref.Hash())
+	return ParseAttachmentMetadata(data), nil
 }
 
 func (b *Backend) ReadPreferences() ([]byte, error) {
@@ -123,10 +268,9 @@ func (b *Backend) ReadPreferences() ([]byte, error) {
 }
 
 func (b *Backend) ReadPreferencesAtVersion(version string) ([]byte, error) {
-	h := plumbing.NewHash(version)
-	commit, err := b.r.CommitObject(h)
+	commit, err := b.ResolveVersion(version)
 	if err != nil {
-		return nil, fmt.Errorf("Invalid version %s", version)
+		return nil, err
 	}
 	rootTree, err := b.r.TreeObject(commit.TreeHash)
 	if err != nil {
@@ -149,10 +293,9 @@ func (b *Backend) ReadSurveys() ([]Survey, error) {
 }
 
 func (b *Backend) ReadSurveysAtVersion(version string) ([]Survey, error) {
-	h := plumbing.NewHash(version)
-	commit, err := b.r.CommitObject(h)
+	commit, err := b.ResolveVersion(version)
 	if err != nil {
-		return nil, fmt.Errorf("Invalid version %s", version)
+		return nil, err
 	}
 	rootTree, err := b.r.TreeObject(commit.TreeHash)
 	if err != nil {
@@ -162,31 +305,47 @@ func (b *Backend) ReadSurveysAtVersion(version string) ([]Survey, error) {
 	if err != nil {
 		return nil, err
 	}
+	if surveys, ok := surveyCache.Surveys(surveysTree.Hash); ok {
+		return surveys, nil
+	}
 	var surveys []Survey
 	for _, e := range surveysTree.Entries {
 		if strings.HasPrefix(e.Name, ".") || !e.Mode.IsFile() {
 			log.Printf("Warning: skipping %s", e.Name)
 			continue
 		}
-		data, err := b.readBlob(e.Hash)
-		if err != nil {
-			return nil, fmt.Errorf("Error reading survey %s: %w", e.Name, err)
-		}
-		var survey Survey
-		err = json.Unmarshal(data, &survey)
+		survey, err := b.readSurvey(e.Hash)
 		if err != nil {
 			return nil, fmt.Errorf("Error reading survey %s: %w", e.Name, err)
 		}
 		surveys = append(surveys, survey)
 	}
+	surveyCache.AddSurveys(surveysTree.Hash, surveys)
 	return surveys, nil
 }
 
+// readSurvey parses the survey stored in blob h, or returns it from the
+// survey cache.
+func (b *Backend) readSurvey(h plumbing.Hash) (Survey, error) {
+	if survey, ok := surveyCache.Survey(h); ok {
+		return survey, nil
+	}
+	data, err := b.readBlob(h)
+	if err != nil {
+		return nil, err
+	}
+	var survey Survey
+	if err := json.Unmarshal(data, &survey); err != nil {
+		return nil, err
+	}
+	surveyCache.AddSurvey(h, survey)
+	return survey, nil
+}
+
 func (b *Backend) ReadSurveyAtVersion(id, version string) (Survey, error) {
-	h := plumbing.NewHash(version)
-	commit, err := b.r.CommitObject(h)
+	commit, err := b.ResolveVersion(version)
 	if err != nil {
-		return nil, fmt.Errorf("Invalid version %s", version)
+		return nil, err
 	}
 	rootTree, err := b.r.TreeObject(commit.TreeHash)
 	if err != nil {
@@ -199,13 +358,11 @@ func (b *Backend) ReadSurveyAtVersion(id, version string) (Survey, error) {
 	name := fmt.Sprintf("%s.survey", id)
 	for _, e := range surveysTree.Entries {
 		if e.Name == name {
-			data, err := b.readBlob(e.Hash)
+			survey, err := b.readSurvey(e.Hash)
 			if err != nil {
 				return nil, fmt.Errorf("Error reading survey %s: %w", id, err)
 			}
-			var survey Survey
-			err = json.Unmarshal(data, &survey)
-			return survey, err
+			return survey, nil
 		}
 	}
 	return nil, fmt.Errorf("Survey %s not found", id)
@@ -242,26 +399,170 @@ func (b *Backend) WriteAttachment(name, checksum string, data []byte) error {
 	if b.ReadOnly {
 		return fmt.Errorf("Forbidden")
 	}
+	if err := b.checkDiskSpace(); err != nil {
+		return err
+	}
+	exists, err := b.store.Exists(name, checksum)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := b.checkQuota(name, checksum, int64(len(data))); err != nil {
+			return err
+		}
+	}
+
+	data = b.encrypt(data)
+	if err := b.store.Write(name, checksum, data); err != nil {
+		return err
+	}
+	b.updateUsage(name, checksum, int64(len(data)))
+	return nil
+}
+
+// MoveAttachments moves the attachments kept in the trench repository to the
+// configured attachment store: the shared git store, or an external store.
+// It returns the number of attachments moved.
+func (b *Backend) MoveAttachments() (int, error) {
+	if b.ReadOnly {
+		return 0, fmt.Errorf("Forbidden")
+	}
+	if _, ok := b.store.(*GitAttachmentStore); ok {
+		if b.shared == nil {
+			return 0, nil
+		}
+		return b.MoveAttachmentsToSharedStore()
+	}
+
+	gs := &GitAttachmentStore{r: b.r, blobs: b.r}
+	attachments, err := gs.List()
+	if err != nil {
+		return 0, err
+	}
+	for i, a := range attachments {
+		exists, err := b.store.Exists(a.Name, a.Checksum)
+		if err != nil {
+			return i, err
+		}
+		if !exists {
+			data, err := gs.Read(a.Name, a.Checksum)
+			if err != nil {
+				return i, err
+			}
+			if err := b.store.Write(a.Name, a.Checksum, data); err != nil {
+				return i, err
+			}
+		}
+		// Older versions still point to the blob, so it stays readable
+		if err := gs.Delete(a.Name, a.Checksum); err != nil {
+			return i, err
+		}
+	}
+	return len(attachments), nil
+}
+
+// MoveAttachmentsToSharedStore copies the attachment blobs of the trench into
+// the shared attachment store and deletes them from the trench repository.
+// It returns the number of blobs moved. Packed blobs are copied but stay in
+// the trench pack.
+func (b *Backend) MoveAttachmentsToSharedStore() (int, error) {
+	if b.shared == nil {
+		return 0, fmt.Errorf("Shared attachments are not enabled")
+	}
+	los, ok := b.r.Storer.(storer.LooseObjectStorer)
+	if !ok {
+		return 0, git.ErrLooseObjectsNotSupported
+	}
 
-	h, err := b.addBlob(data)
+	hashes, err := b.attachmentBlobs()
 	if err != nil {
-		return fmt.Errorf("Failed to write git blob: %w", err)
+		return 0, err
 	}
 
-	refName := b.attachmentReference(name, checksum)
-	ref := plumbing.NewReferenceFromStrings(refName, h.String())
-	err = b.r.Storer.SetReference(ref)
+	moved := 0
+	for h := range hashes {
+		if b.shared.Storer.HasEncodedObject(h) != nil {
+			data, err := readBlob(b.r, h)
+			if err != nil {
+				return moved, fmt.Errorf("Error reading blob %s: %w", h, err)
+			}
+			if _, err := writeBlob(b.shared, data); err != nil {
+				return moved, fmt.Errorf("Error writing blob %s: %w", h, err)
+			}
+		}
+		if _, err := los.LooseObjectTime(h); err != nil {
+			// Not a loose object of this trench
+			continue
+		}
+		if err := los.DeleteLooseObject(h); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// attachmentBlobs returns the blobs of all attachment references and of the
+// attachments trees of every version.
+func (b *Backend) attachmentBlobs() (map[plumbing.Hash]bool, error) {
+	hashes := make(map[plumbing.Hash]bool)
+
+	refs, err := b.r.References()
+	if err != nil {
+		return nil, err
+	}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if strings.HasPrefix(ref.Name().String(), "refs/attachments/") {
+			hashes[ref.Hash()] = true
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("Failed to create attachment reference: %w", err)
+		return nil, err
 	}
 
-	return nil
+	if b.Head() == "" {
+		return hashes, nil
+	}
+	it, err := b.r.Log(&git.LogOptions{})
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[plumbing.Hash]bool)
+	err = it.ForEach(func(c *object.Commit) error {
+		rootTree, err := b.r.TreeObject(c.TreeHash)
+		if err != nil {
+			return err
+		}
+		entry, err := rootTree.FindEntry("attachments")
+		if errors.Is(err, object.ErrEntryNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if seen[entry.Hash] {
+			return nil
+		}
+		seen[entry.Hash] = true
+		attachmentsTree, err := b.r.TreeObject(entry.Hash)
+		if err != nil {
+			return err
+		}
+		for _, e := range attachmentsTree.Entries {
+			hashes[e.Hash] = true
+		}
+		return nil
+	})
+	return hashes, err
 }
 
 func (b *Backend) WritePreferences(preferences []byte) error {
 	if b.ReadOnly {
 		return fmt.Errorf("Forbidden")
 	}
+	if err := b.checkDiskSpace(); err != nil {
+		return err
+	}
 
 	rootEntries := []object.TreeEntry{}
 
@@ -310,51 +611,111 @@ func (b *Backend) WritePreferences(preferences []byte) error {
 	return err
 }
 
+// WriteTrench commits the surveys and preferences sent by a device, and
+// returns the new version. When the project maintains reciprocal relations,
+// the reciprocals missing from the surveys are committed next by the server,
+// so that devices pull them on their next sync.
 func (b *Backend) WriteTrench(device, message string, preferences []byte, surveys []Survey) (string, error) {
 	if b.ReadOnly {
 		return "", fmt.Errorf("Forbidden")
 	}
+	if err := b.checkDiskSpace(); err != nil {
+		return "", err
+	}
+
+	clashes := make(Set)
+	for _, clash := range FindAttachmentClashes(surveys) {
+		if b.cfg.AttachmentNameClash == ClashReject {
+			return "", fmt.Errorf("%w: %s", ErrAttachmentClash, clash)
+		}
+		clashes.Insert(clash.Name)
+	}
+	// Surveys the device started from, to tell removed relations from new ones
+	var old []Survey
+	if strat := b.cfg.Stratigraphy; strat != nil && len(strat.Reciprocals) > 0 {
+		var err error
+		if old, err = b.ReadSurveys(); err != nil {
+			return "", err
+		}
+	}
+
+	rootTree, err := b.trenchTree(preferences, surveys, clashes)
+	if err != nil {
+		return "", err
+	}
+	commit, err := b.commit(b.User, device, message, rootTree)
+	if err != nil {
+		return "", err
+	}
+
+	maintained, changes := MaintainReciprocals(old, surveys, b.Trench, b.cfg.Stratigraphy)
+	if changes > 0 {
+		rootTree, err := b.trenchTree(preferences, maintained, clashes)
+		if err != nil {
+			return "", err
+		}
+		if _, err := b.commit(b.User, ServerDevice, "Update reciprocal relations", rootTree); err != nil {
+			return "", err
+		}
+	}
+	return commit.String(), nil
+}
 
+// trenchTree writes the tree of a version of the trench with the surveys,
+// their attachments and the preferences.
+func (b *Backend) trenchTree(preferences []byte, surveys []Survey, clashes Set) (plumbing.Hash, error) {
 	var surveyEntries []object.TreeEntry
 	var attachmentEntries []object.TreeEntry
+	seenAttachments := make(map[string]string) // Checksums by name in the tree
 
 	preferencesHash, err := b.addBlob(preferences)
 	if err != nil {
-		return "", fmt.Errorf("Failed to write preferences: %w", err)
+		return plumbing.ZeroHash, fmt.Errorf("Failed to write preferences: %w", err)
 	}
 
 	for _, survey := range surveys {
 		id := survey.ID()
 		data, err := json.MarshalIndent(survey, "", "  ")
 		if err != nil {
-			return "", fmt.Errorf("Failed to write survey %s: %w", id, err)
+			return plumbing.ZeroHash, fmt.Errorf("Failed to write survey %s: %w", id, err)
 		}
 		name := id + ".survey"
 		h, err := b.addBlob(data)
 		if err != nil {
-			return "", fmt.Errorf("Failed to write survey %s data: %w", id, err)
+			return plumbing.ZeroHash, fmt.Errorf("Failed to write survey %s data: %w", id, err)
 		}
 		e := object.TreeEntry{Name: name, Mode: filemode.Regular, Hash: h}
 		surveyEntries = append(surveyEntries, e)
 
 		for _, a := range survey.Attachments() {
-			refName := b.attachmentReference(a.Name, a.Checksum)
-			ref, err := b.r.Reference(plumbing.ReferenceName(refName), false)
+			name := a.Name
+			if _, ok := clashes[name]; ok {
+				name = clashName(a.Name, a.Checksum)
+			}
+			if checksum, ok := seenAttachments[name]; ok {
+				if checksum != a.Checksum {
+					return plumbing.ZeroHash, fmt.Errorf("%w: '%s' and '%s' would both be stored as '%s'",
+						ErrAttachmentClash, a.Checksum, checksum, name)
+				}
+				continue
+			}
+			seenAttachments[name] = a.Checksum
+
+			h, err := b.attachmentBlob(a)
 			if err != nil {
-				return "", err
+				return plumbing.ZeroHash, err
 			}
-			_ = ref
-			e := object.TreeEntry{Name: a.Name, Mode: filemode.Regular, Hash: ref.Hash()}
+			e := object.TreeEntry{Name: name, Mode: filemode.Regular, Hash: h}
 			attachmentEntries = append(attachmentEntries, e)
 		}
 	}
 	surveysTree, err := b.addTree(surveyEntries)
 	if err != nil {
-		return "", err
+		return plumbing.ZeroHash, err
 	}
 	attachmentsTree, err := b.addTree(attachmentEntries)
 	if err != nil {
-		return "", err
+		return plumbing.ZeroHash, err
 	}
 
 	rootEntries := []object.TreeEntry{
@@ -362,22 +723,16 @@ func (b *Backend) WriteTrench(device, message string, preferences []byte, survey
 		{Name: "surveys", Mode: filemode.Dir, Hash: surveysTree},
 		{Name: "Preferences.json", Mode: filemode.Regular, Hash: preferencesHash},
 	}
-	rootTree, err := b.addTree(rootEntries)
-	if err != nil {
-		return "", err
-	}
-
-	commit, err := b.commit(b.User, device, message, rootTree)
-	if err != nil {
-		return "", err
-	}
-	return commit.String(), nil
+	return b.addTree(rootEntries)
 }
 
 func (b *Backend) Rollback(version string) error {
-	commit := b.findCommit(version)
-	if commit == nil {
-		return fmt.Errorf("Invalid version %s", version)
+	if err := b.checkDiskSpace(); err != nil {
+		return err
+	}
+	commit, err := b.ResolveVersion(version)
+	if err != nil {
+		return err
 	}
 	rootTree, err := b.r.TreeObject(commit.TreeHash)
 	if err != nil {
@@ -388,52 +743,292 @@ func (b *Backend) Rollback(version string) error {
 	return err
 }
 
-func (b *Backend) attachmentReference(name, checksum string) string {
-	enc := base64.URLEncoding.WithPadding(base64.NoPadding)
-	h := enc.EncodeToString([]byte(fmt.Sprintf("%s/%s", name, checksum)))
-	return fmt.Sprintf("refs/attachments/%s", h)
+// attachmentBlob returns the blob to use for an attachment in the attachments
+// tree of a version. Attachments kept outside of git get a pointer blob.
+func (b *Backend) attachmentBlob(a Attachment) (plumbing.Hash, error) {
+	if gs, ok := b.store.(*GitAttachmentStore); ok {
+		return gs.Blob(a.Name, a.Checksum)
+	}
+	if exists, err := b.store.Exists(a.Name, a.Checksum); err != nil {
+		return plumbing.ZeroHash, err
+	} else if !exists {
+		return plumbing.ZeroHash, fmt.Errorf("Attachment '%s' not found", a.Name)
+	}
+	return b.addBlob(attachmentPointer(a.Name, a.Checksum))
 }
 
 func (b *Backend) ListAttachments() ([]Attachment, error) {
-	refs, err := b.r.References()
+	return b.store.List()
+}
+
+// OrphanedAttachments returns the attachments that are not referenced by any
+// survey at HEAD. When allVersions is set, an attachment referenced by a survey
+// in any version is not considered orphaned. Attachments stored within the
+// PruneGracePeriod are never orphaned, as their sync may still be on its way.
+func (b *Backend) OrphanedAttachments(allVersions bool) ([]Attachment, error) {
+	used, err := b.referencedAttachments(allVersions)
 	if err != nil {
 		return nil, err
 	}
 
-	var attachments []Attachment
-	err = refs.ForEach(func(ref *plumbing.Reference) error {
-		if !strings.HasPrefix(ref.Name().String(), "refs/attachments/") {
+	attachments, err := b.ListAttachments()
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-PruneGracePeriod)
+	var orphaned []Attachment
+	for _, a := range attachments {
+		if a.Modified.After(cutoff) {
+			continue
+		}
+		if _, ok := used[attachmentKey(a.Name, a.Checksum)]; !ok {
+			orphaned = append(orphaned, a)
+		}
+	}
+	sort.Slice(orphaned, func(i, j int) bool {
+		return orphaned[i].Name < orphaned[j].Name
+	})
+	return orphaned, nil
+}
+
+// referencedAttachments returns the keys of the attachments used by the
+// surveys at HEAD, or by the surveys of every version.
+func (b *Backend) referencedAttachments(allVersions bool) (Set, error) {
+	used := make(Set)
+	head, err := b.r.Head()
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return used, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[plumbing.Hash]bool)
+	addCommit := func(c *object.Commit) error {
+		rootTree, err := b.r.TreeObject(c.TreeHash)
+		if err != nil {
+			return err
+		}
+		surveysTree, err := rootTree.Tree("surveys")
+		if errors.Is(err, object.ErrDirectoryNotFound) {
 			return nil
+		} else if err != nil {
+			return err
 		}
+		for _, e := range surveysTree.Entries {
+			if seen[e.Hash] {
+				continue
+			}
+			seen[e.Hash] = true
+			survey, err := b.readSurvey(e.Hash)
+			if err != nil {
+				return fmt.Errorf("Error reading survey %s: %w", e.Name, err)
+			}
+			for _, a := range survey.Attachments() {
+				used.Insert(attachmentKey(a.Name, a.Checksum))
+			}
+		}
+		return nil
+	}
 
-		enc := base64.URLEncoding.WithPadding(base64.NoPadding)
-		encoded := strings.TrimPrefix(ref.Name().String(), "refs/attachments/")
-		decoded, err := enc.DecodeString(encoded)
+	if !allVersions {
+		c, err := b.r.CommitObject(head.Hash())
 		if err != nil {
+			return nil, err
+		}
+		return used, addCommit(c)
+	}
+
+	it, err := b.r.Log(&git.LogOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return used, it.ForEach(addCommit)
+}
+
+// ReclaimableSize returns the bytes freed by deleting the orphaned
+// attachments and pruning: all of them for attachments kept outside of git,
+// otherwise those of the blobs that no version or other attachment refers
+// to. Blobs of the shared store may be used by other trenches and are not
+// counted.
+func (b *Backend) ReclaimableSize(orphaned []Attachment) (int64, error) {
+	gs, ok := b.store.(*GitAttachmentStore)
+	if !ok {
+		var total int64
+		for _, a := range orphaned {
+			total += a.Size
+		}
+		return total, nil
+	}
+	if b.shared != nil {
+		return 0, nil
+	}
+
+	deleted := make(Set)
+	for _, a := range orphaned {
+		deleted.Insert(attachmentReference(a.Name, a.Checksum))
+	}
+	reachable, err := b.reachableObjectsExcept(deleted)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, a := range orphaned {
+		h, err := gs.Blob(a.Name, a.Checksum)
+		if err != nil || reachable[h] {
+			continue
+		}
+		reachable[h] = true // Count blobs once
+		total += a.Size
+	}
+	return total, nil
+}
+
+func (b *Backend) DeleteAttachment(name, checksum string) error {
+	if b.ReadOnly {
+		return fmt.Errorf("Forbidden")
+	}
+	if b.dir != "" {
+		if err := b.DeleteTiles(name, checksum); err != nil {
+			log.Printf("Warning: cannot delete tiles of '%s': %s", name, err)
+		}
+	}
+	if err := b.store.Delete(name, checksum); err != nil {
+		return err
+	}
+	b.updateUsage(name, checksum, -1)
+	return nil
+}
+
+// Objects and attachments written more recently than this may belong to a
+// sync that is still in progress, and are never removed
+const PruneGracePeriod = time.Hour
+
+// Prune deletes loose objects that are no longer reachable from any
+// reference. Objects written within the PruneGracePeriod are kept.
+func (b *Backend) Prune() (int, error) {
+	if b.ReadOnly {
+		return 0, fmt.Errorf("Forbidden")
+	}
+
+	reachable, err := b.reachableObjects()
+	if err != nil {
+		return 0, err
+	}
+	return pruneLooseObjects(b.r, reachable, time.Now().Add(-PruneGracePeriod))
+}
+
+// pruneLooseObjects deletes the loose objects of r that are not in keep and
+// were written before cutoff.
+func pruneLooseObjects(r *git.Repository, keep map[plumbing.Hash]bool, cutoff time.Time) (int, error) {
+	los, ok := r.Storer.(storer.LooseObjectStorer)
+	if !ok {
+		return 0, git.ErrLooseObjectsNotSupported
+	}
+
+	var unreachable []plumbing.Hash
+	err := los.ForEachObjectHash(func(h plumbing.Hash) error {
+		if keep[h] {
 			return nil
 		}
+		if t, err := los.LooseObjectTime(h); err != nil || !t.Before(cutoff) {
+			return nil
+		}
+		unreachable = append(unreachable, h)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, h := range unreachable {
+		if err := los.DeleteLooseObject(h); err != nil {
+			return 0, err
+		}
+	}
+	return len(unreachable), nil
+}
+
+// reachableObjects returns every object reachable from any reference. Unlike
+// the go-git object walker, it handles references that point directly to
+// blobs, which is how attachments are stored.
+func (b *Backend) reachableObjects() (map[plumbing.Hash]bool, error) {
+	return b.reachableObjectsExcept(nil)
+}
+
+// reachableObjectsExcept returns every object reachable from any reference
+// but those in skip.
+func (b *Backend) reachableObjectsExcept(skip Set) (map[plumbing.Hash]bool, error) {
+	seen := make(map[plumbing.Hash]bool)
+	var stack []plumbing.Hash
 
-		parts := strings.SplitN(string(decoded), "/", 2)
-		if len(parts) == 2 {
-			attachments = append(attachments, Attachment{
-				Name:     parts[0],
-				Checksum: parts[1],
-			})
+	refs, err := b.r.References()
+	if err != nil {
+		return nil, err
+	}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && !skip.Contains(ref.Name().String()) {
+			stack = append(stack, ref.Hash())
 		}
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	return attachments, err
+	for len(stack) > 0 {
+		h := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+
+		obj, err := b.r.Storer.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading object %s: %w", h, err)
+		}
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			var c object.Commit
+			if err := c.Decode(obj); err != nil {
+				return nil, err
+			}
+			stack = append(stack, c.TreeHash)
+			stack = append(stack, c.ParentHashes...)
+		case plumbing.TreeObject:
+			var t object.Tree
+			if err := t.Decode(obj); err != nil {
+				return nil, err
+			}
+			for _, e := range t.Entries {
+				if e.Mode != filemode.Submodule {
+					stack = append(stack, e.Hash)
+				}
+			}
+		case plumbing.TagObject:
+			var t object.Tag
+			if err := t.Decode(obj); err != nil {
+				return nil, err
+			}
+			stack = append(stack, t.Target)
+		}
+	}
+	return seen, nil
 }
 
 func (b *Backend) addBlob(data []byte) (plumbing.Hash, error) {
+	return writeBlob(b.r, b.encrypt(data))
+}
+
+func writeBlob(r *git.Repository, data []byte) (plumbing.Hash, error) {
 	// Check if blob already exists
 	hash := plumbing.ComputeHash(plumbing.BlobObject, data)
-	if b.r.Storer.HasEncodedObject(hash) == nil {
+	if r.Storer.HasEncodedObject(hash) == nil {
 		return hash, nil
 	}
 
-	obj := b.r.Storer.NewEncodedObject()
+	obj := r.Storer.NewEncodedObject()
 	obj.SetType(plumbing.BlobObject)
 	obj.SetSize(int64(len(data)))
 
@@ -451,7 +1046,7 @@ func (b *Backend) addBlob(data []byte) (plumbing.Hash, error) {
 		return plumbing.ZeroHash, fmt.Errorf("Error writing blob data")
 	}
 
-	return b.r.Storer.SetEncodedObject(obj)
+	return r.Storer.SetEncodedObject(obj)
 }
 
 func (b *Backend) commit(user, device, message string, tree plumbing.Hash) (plumbing.Hash, error) {
@@ -496,6 +1091,7 @@ func (b *Backend) commit(user, device, message string, tree plumbing.Hash) (plum
 	if err != nil {
 		return plumbing.ZeroHash, err
 	}
+	indexCommit(b)
 
 	return h, nil
 }
@@ -514,16 +1110,24 @@ func (b *Backend) addTree(entries []object.TreeEntry) (plumbing.Hash, error) {
 }
 
 func (b *Backend) readBlob(h plumbing.Hash) ([]byte, error) {
-	blob, err := b.r.BlobObject(h)
+	data, err := readBlob(b.r, h)
+	if err != nil {
+		return nil, err
+	}
+	return b.decrypt(data)
+}
+
+func readBlob(r *git.Repository, h plumbing.Hash) ([]byte, error) {
+	blob, err := r.BlobObject(h)
 	if err != nil {
 		return nil, err
 	}
-	r, err := blob.Reader()
+	rd, err := blob.Reader()
 	if err != nil {
 		return nil, err
 	}
-	defer r.Close()
-	return io.ReadAll(r)
+	defer rd.Close()
+	return io.ReadAll(rd)
 }
 
 func (b *Backend) updateHEAD(commit plumbing.Hash) error {
@@ -541,34 +1145,6 @@ func (b *Backend) updateHEAD(commit plumbing.Hash) error {
 	return b.r.Storer.SetReference(ref)
 }
 
-func (b *Backend) findCommit(hash string) *object.Commit {
-	if len(hash) == 40 {
-		// Full hash
-		h := plumbing.NewHash(hash)
-		commit, err := b.r.CommitObject(h)
-		if err != nil {
-			return nil
-		}
-		return commit
-	}
-
-	// This is a short version, iterate all commits to find it
-	it, err := b.r.CommitObjects()
-	if err != nil {
-		return nil
-	}
-
-	for {
-		commit, err := it.Next()
-		if err != nil {
-			return nil
-		}
-		if strings.HasPrefix(commit.Hash.String(), hash) {
-			return commit
-		}
-	}
-}
-
 func (b *Backend) Head() string {
 	ref, err := b.r.Head()
 	if err != nil {
@@ -582,6 +1158,9 @@ type Survey map[string]string
 type Attachment struct {
 	Name     string
 	Checksum string
+	Size     int64               `json:",omitempty"`
+	Metadata *AttachmentMetadata `json:",omitempty"`
+	Modified time.Time           `json:"-"` // When it was stored, if known
 }
 
 type SurveyMap map[string]Survey
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
 
 	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
@@ -63,7 +69,9 @@ func TestAttachments(t *testing.T) {
 					t.Errorf("Test Case #%d", i)
 				}
 			case "exists":
-				if b.ExistsAttachment(tc.Name, tc.Checksum) == tc.ShouldFail {
+				exists, err := b.ExistsAttachment(tc.Name, tc.Checksum)
+				assertNoError(t, err)
+				if exists == tc.ShouldFail {
 					t.Errorf("Test Case #%d", i)
 				}
 			}
@@ -166,6 +174,115 @@ func TestWritePreferences(t *testing.T) {
 	assertEqualSurveys(t, surveys, surveysAtHead)
 }
 
+func TestOrphanedAttachments(t *testing.T) {
+	b, err := NewMemoryBackend("test-user", "test-trench")
+	assertNoError(t, err)
+
+	assertNoError(t, b.WriteAttachment("a.jpg", "sum1", []byte("data-a1")))
+	assertNoError(t, b.WriteAttachment("a.jpg", "sum2", []byte("data-a2")))
+	assertNoError(t, b.WriteAttachment("b.jpg", "sum1", []byte("data-b")))
+
+	surveys := generateSurveys(2)
+	surveys[0]["RelationAttachments"] = "n=a.jpg\nd=sum1"
+	_, err = b.WriteTrench("test-dev", "", nil, surveys)
+	assertNoError(t, err)
+
+	surveys[0]["RelationAttachments"] = "n=a.jpg\nd=sum2"
+	_, err = b.WriteTrench("test-dev", "", nil, surveys)
+	assertNoError(t, err)
+
+	orphaned, err := b.OrphanedAttachments(false)
+	assertNoError(t, err)
+	assertEqual(t, len(orphaned), 2)
+	if len(orphaned) == 2 {
+		assertEqual(t, orphaned[0].Name+"/"+orphaned[0].Checksum, "a.jpg/sum1")
+		assertEqual(t, orphaned[0].Size, int64(len("data-a1")))
+		assertEqual(t, orphaned[1].Name+"/"+orphaned[1].Checksum, "b.jpg/sum1")
+	}
+
+	// Only b.jpg is freed, a.jpg is still in the first version
+	reclaimable, err := b.ReclaimableSize(orphaned)
+	assertNoError(t, err)
+	assertEqual(t, reclaimable, int64(len("data-b")))
+
+	orphaned, err = b.OrphanedAttachments(true)
+	assertNoError(t, err)
+	assertEqual(t, len(orphaned), 1)
+
+	assertNoError(t, b.DeleteAttachment("b.jpg", "sum1"))
+	exists, err := b.ExistsAttachment("b.jpg", "sum1")
+	assertNoError(t, err)
+	assertEqual(t, exists, false)
+	exists, err = b.ExistsAttachment("a.jpg", "sum1")
+	assertNoError(t, err)
+	assertEqual(t, exists, true)
+}
+
+func TestOrphanedAttachmentsGracePeriod(t *testing.T) {
+	root := t.TempDir()
+	b, err := NewBackend(root, "test-user", "BZ")
+	assertNoError(t, err)
+	assertNoError(t, b.WriteAttachment("a.jpg", "sum1", []byte("data-a")))
+
+	// Just uploaded, its sync may be on its way
+	orphaned, err := b.OrphanedAttachments(false)
+	assertNoError(t, err)
+	assertEqual(t, len(orphaned), 0)
+
+	old := time.Now().Add(-2 * PruneGracePeriod)
+	ref := filepath.Join(root, "BZ", attachmentReference("a.jpg", "sum1"))
+	assertNoError(t, os.Chtimes(ref, old, old))
+	orphaned, err = b.OrphanedAttachments(false)
+	assertNoError(t, err)
+	assertEqual(t, len(orphaned), 1)
+}
+
+func TestSharedAttachments(t *testing.T) {
+	root := t.TempDir()
+
+	// Start with a per-trench attachment
+	b1, err := NewBackend(root, "test-user", "T1")
+	assertNoError(t, err)
+	assertNoError(t, b1.WriteAttachment("a.jpg", "sum1", []byte("shared data")))
+
+	cfg := &ProjectConfig{SharedAttachments: true}
+	assertNoError(t, cfg.Save(root))
+
+	b1, err = NewBackend(root, "test-user", "T1")
+	assertNoError(t, err)
+	moved, err := b1.MoveAttachmentsToSharedStore()
+	assertNoError(t, err)
+	assertEqual(t, moved, 1)
+
+	b2, err := NewBackend(root, "test-user", "T2")
+	assertNoError(t, err)
+	assertNoError(t, b2.WriteAttachment("b.jpg", "sum1", []byte("shared data")))
+
+	h := plumbing.ComputeHash(plumbing.BlobObject, []byte("shared data"))
+	for _, b := range []*Backend{b1, b2} {
+		if b.r.Storer.HasEncodedObject(h) == nil {
+			t.Errorf("Blob found in trench %s", b.Trench)
+		}
+	}
+	assertNoError(t, b1.shared.Storer.HasEncodedObject(h))
+
+	surveys := generateSurveys(1)
+	surveys[0]["RelationAttachments"] = "n=b.jpg\nd=sum1"
+	v, err := b2.WriteTrench("test-dev", "", nil, surveys)
+	assertNoError(t, err)
+
+	data, err := b1.ReadAttachment("a.jpg", "sum1")
+	assertNoError(t, err)
+	assertEqual(t, string(data), "shared data")
+	data, err = b2.ReadAttachmentAtVersion("b.jpg", "sum1", v)
+	assertNoError(t, err)
+	assertEqual(t, string(data), "shared data")
+
+	trenches, err := ListTrenchNames(root)
+	assertNoError(t, err)
+	assertEqual(t, strings.Join(trenches, ","), "T1,T2")
+}
+
 // Benchmark adding a single survey to a trench containing a lot of surveys
 func BenchmarkAddSurvey(b *testing.B) {
 	root, err := os.MkdirTemp("", "idig-server.bench")
@@ -231,3 +348,161 @@ func generateSurveys(count int) []Survey {
 	}
 	return surveys
 }
+
+func TestQuota(t *testing.T) {
+	root := t.TempDir()
+	err := os.WriteFile(filepath.Join(root, "config.json"), []byte(`{
+		"quota": {"trench_attachments": "10 B", "project_attachments": 15}
+	}`), 0o644)
+	assertNoError(t, err)
+
+	b1, err := NewBackend(root, "test-user", "T1")
+	assertNoError(t, err)
+	assertNoError(t, b1.WriteAttachment("a.jpg", "sum1", []byte("12345678")))
+	err = b1.WriteAttachment("b.jpg", "sum1", []byte("12345"))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected trench quota error, got %v", err)
+	}
+	// Existing attachments can always be written again
+	assertNoError(t, b1.WriteAttachment("a.jpg", "sum1", []byte("12345678")))
+
+	b2, err := NewBackend(root, "test-user", "T2")
+	assertNoError(t, err)
+	assertNoError(t, b2.WriteAttachment("c.jpg", "sum1", []byte("1234567")))
+	err = b2.WriteAttachment("d.jpg", "sum1", []byte("1"))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected project quota error, got %v", err)
+	}
+
+	usage, err := ProjectUsage(root)
+	assertNoError(t, err)
+	assertEqual(t, len(usage), 2)
+	assertEqual(t, usage.AttachmentBytes(), int64(15))
+}
+
+func TestQuotaSharedAttachments(t *testing.T) {
+	root := t.TempDir()
+	cfg := &ProjectConfig{SharedAttachments: true, Quota: &QuotaConfig{ProjectAttachments: 15}}
+	assertNoError(t, cfg.Save(root))
+
+	b1, err := NewBackend(root, "test-user", "T1")
+	assertNoError(t, err)
+	b2, err := NewBackend(root, "test-user", "T2")
+	assertNoError(t, err)
+	assertNoError(t, b1.WriteAttachment("a.jpg", "sum1", []byte("12345678")))
+	// Stored once for both trenches
+	assertNoError(t, b2.WriteAttachment("a.jpg", "sum1", []byte("12345678")))
+	assertNoError(t, b2.WriteAttachment("b.jpg", "sum1", []byte("1234567")))
+	err = b2.WriteAttachment("c.jpg", "sum1", []byte("1"))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected project quota error, got %v", err)
+	}
+
+	// Deleting frees the space without listing the trenches again
+	assertNoError(t, b2.DeleteAttachment("b.jpg", "sum1"))
+	assertNoError(t, b2.WriteAttachment("c.jpg", "sum1", []byte("1")))
+
+	usage, err := ProjectUsage(root)
+	assertNoError(t, err)
+	assertEqual(t, usage[1].AttachmentBytes, int64(9))
+	assertEqual(t, usage.AttachmentBytes(), int64(9))
+}
+
+func TestParseSize(t *testing.T) {
+	for s, expected := range map[string]int64{
+		"100":     100,
+		"10 B":    10,
+		"1.5 KB":  1500,
+		"2GiB":    2 << 30,
+		"500 mb":  500e6,
+		" 1 TiB ": 1 << 40,
+	} {
+		n, err := ParseSize(s)
+		assertNoError(t, err)
+		assertEqual(t, n, expected)
+	}
+	for _, s := range []string{"", "GB", "10 XB", "-1"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("Expected error parsing '%s'", s)
+		}
+	}
+}
+
+func TestAttachmentClashSharedPrefix(t *testing.T) {
+	b, err := NewMemoryBackend("test-user", "test-trench")
+	assertNoError(t, err)
+	// iDig checksums are often timestamps, alike up to the day
+	sum1, sum2 := "2024-06-01T10:00:00Z", "2024-06-15T08:30:00Z"
+	assertNoError(t, b.WriteAttachment("IMG_0001.jpg", sum1, []byte("first")))
+	assertNoError(t, b.WriteAttachment("IMG_0001.jpg", sum2, []byte("second")))
+
+	surveys := generateSurveys(2)
+	surveys[0]["RelationAttachments"] = "n=IMG_0001.jpg\nd=" + sum1
+	surveys[1]["RelationAttachments"] = "n=IMG_0001.jpg\nd=" + sum2
+	v, err := b.WriteTrench("test-dev", "", nil, surveys)
+	assertNoError(t, err)
+	data, err := b.ReadAttachmentAtVersion("IMG_0001.jpg", sum1, v)
+	assertNoError(t, err)
+	assertEqual(t, string(data), "first")
+	data, err = b.ReadAttachmentAtVersion("IMG_0001.jpg", sum2, v)
+	assertNoError(t, err)
+	assertEqual(t, string(data), "second")
+	assertEqual(t, clashName("IMG_0001.jpg", sum1), "IMG_0001~2024-06-01T10_00_00Z.jpg")
+
+	// Checksums that differ in unsafe characters only can't share a name
+	assertNoError(t, b.WriteAttachment("IMG_0001.jpg", "2024-06-01T10_00_00Z", []byte("third")))
+	surveys[1]["RelationAttachments"] = "n=IMG_0001.jpg\nd=2024-06-01T10_00_00Z"
+	_, err = b.WriteTrench("test-dev", "", nil, surveys)
+	if !errors.Is(err, ErrAttachmentClash) {
+		t.Errorf("Expected attachment clash, got %v", err)
+	}
+}
+
+func TestAttachmentClash(t *testing.T) {
+	b, err := NewMemoryBackend("test-user", "test-trench")
+	assertNoError(t, err)
+	assertNoError(t, b.WriteAttachment("photo.jpg", "sum1", []byte("first")))
+	assertNoError(t, b.WriteAttachment("photo.jpg", "sum2", []byte("second")))
+
+	surveys := generateSurveys(3)
+	surveys[0]["RelationAttachments"] = "n=photo.jpg\nd=sum1"
+	surveys[1]["RelationAttachments"] = "n=photo.jpg\nd=sum2"
+	surveys[2]["RelationAttachments"] = "n=photo.jpg\nd=sum1"
+
+	clashes := FindAttachmentClashes(surveys)
+	assertEqual(t, len(clashes), 1)
+	assertEqual(t, clashes[0].Name, "photo.jpg")
+	assertEqual(t, strings.Join(clashes[0].Checksums, ","), "sum1,sum2")
+
+	v1, err := b.WriteTrench("test-dev", "", nil, surveys[:1])
+	assertNoError(t, err)
+	v2, err := b.WriteTrench("test-dev", "", nil, surveys)
+	assertNoError(t, err)
+	data, err := b.ReadAttachmentAtVersion("photo.jpg", "sum1", v2)
+	assertNoError(t, err)
+	assertEqual(t, string(data), "first")
+	data, err = b.ReadAttachmentAtVersion("photo.jpg", "sum2", v2)
+	assertNoError(t, err)
+	assertEqual(t, string(data), "second")
+
+	refs, err := b.AttachmentReferences("photo.jpg", "sum1")
+	assertNoError(t, err)
+	assertEqual(t, len(refs), 2)
+	for _, ref := range refs {
+		assertEqual(t, ref.Current, true)
+		if ref.Survey == surveys[0].ID() {
+			assertEqual(t, strings.Join(ref.Versions, ","), v2+","+v1)
+		} else {
+			assertEqual(t, strings.Join(ref.Versions, ","), v2)
+		}
+	}
+	refs, err = b.AttachmentReferences("photo.jpg", "")
+	assertNoError(t, err)
+	assertEqual(t, len(refs), 3)
+
+	b.cfg.AttachmentNameClash = ClashReject
+	_, err = b.WriteTrench("test-dev", "", nil, surveys[1:])
+	if !errors.Is(err, ErrAttachmentClash) {
+		t.Errorf("Expected name clash error, got %v", err)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"container/list"
+	"maps"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// Default memory bound of the survey cache
+const DefaultSurveyCacheSize = 64 << 20
+
+// Surveys parsed by any backend, shared across requests. Blob and tree hashes
+// identify their contents, so entries never go stale.
+var surveyCache = NewSurveyCache(DefaultSurveyCacheSize)
+
+// SurveyCache is an LRU cache of parsed surveys by blob hash, and of the
+// surveys of whole versions by the hash of their surveys tree. Its memory use
+// is estimated from the size of the keys and values of the surveys.
+type SurveyCache struct {
+	mu        sync.Mutex
+	maxBytes  int64
+	bytes     int64
+	ll        *list.List // Most recently used first
+	items     map[surveyCacheKey]*list.Element
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+type surveyCacheKey struct {
+	Tree bool
+	Hash plumbing.Hash
+}
+
+type surveyCacheEntry struct {
+	Key     surveyCacheKey
+	Size    int64
+	Survey  Survey
+	Surveys []Survey
+}
+
+// CacheStats are the metrics of a SurveyCache.
+type CacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	MaxBytes  int64 `json:"max_bytes"`
+}
+
+// NewSurveyCache returns a cache using about maxBytes of memory at most. A
+// zero maxBytes disables it.
+func NewSurveyCache(maxBytes int64) *SurveyCache {
+	return &SurveyCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[surveyCacheKey]*list.Element),
+	}
+}
+
+// Survey returns a copy of the survey stored in blob h.
+func (c *SurveyCache) Survey(h plumbing.Hash) (Survey, bool) {
+	e := c.get(surveyCacheKey{Hash: h})
+	if e == nil {
+		return nil, false
+	}
+	return maps.Clone(e.Survey), true
+}
+
+// AddSurvey stores a copy of the survey stored in blob h.
+func (c *SurveyCache) AddSurvey(h plumbing.Hash, survey Survey) {
+	if c.disabled() {
+		return
+	}
+	c.add(&surveyCacheEntry{
+		Key:    surveyCacheKey{Hash: h},
+		Size:   surveySize(survey),
+		Survey: maps.Clone(survey),
+	})
+}
+
+// Surveys returns a copy of the surveys of surveys tree h.
+func (c *SurveyCache) Surveys(h plumbing.Hash) ([]Survey, bool) {
+	e := c.get(surveyCacheKey{Tree: true, Hash: h})
+	if e == nil {
+		return nil, false
+	}
+	return cloneSurveys(e.Surveys), true
+}
+
+// AddSurveys stores a copy of the surveys of surveys tree h.
+func (c *SurveyCache) AddSurveys(h plumbing.Hash, surveys []Survey) {
+	if c.disabled() {
+		return
+	}
+	size := int64(24 * len(surveys))
+	for _, s := range surveys {
+		size += surveySize(s)
+	}
+	c.add(&surveyCacheEntry{
+		Key:     surveyCacheKey{Tree: true, Hash: h},
+		Size:    size,
+		Surveys: cloneSurveys(surveys),
+	})
+}
+
+// SetMaxBytes changes the memory bound of the cache, evicting entries as
+// needed.
+func (c *SurveyCache) SetMaxBytes(maxBytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxBytes = maxBytes
+	c.evict()
+}
+
+func (c *SurveyCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Entries:   c.ll.Len(),
+		Bytes:     c.bytes,
+		MaxBytes:  c.maxBytes,
+	}
+}
+
+func (c *SurveyCache) disabled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.maxBytes <= 0
+}
+
+func (c *SurveyCache) get(key surveyCacheKey) *surveyCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil
+	}
+	c.hits++
+	c.ll.MoveToFront(el)
+	return el.Value.(*surveyCacheEntry)
+}
+
+func (c *SurveyCache) add(e *surveyCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// An entry taking most of the cache would only push everything else out
+	if e.Size > c.maxBytes/2 {
+		return
+	}
+	if el, ok := c.items[e.Key]; ok {
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[e.Key] = c.ll.PushFront(e)
+	c.bytes += e.Size
+	c.evict()
+}
+
+func (c *SurveyCache) evict() {
+	for c.bytes > c.maxBytes && c.ll.Len() > 0 {
+		el := c.ll.Back()
+		e := el.Value.(*surveyCacheEntry)
+		c.ll.Remove(el)
+		delete(c.items, e.Key)
+		c.bytes -= e.Size
+		c.evictions++
+	}
+}
+
+// surveySize estimates the memory used by a parsed survey.
+func surveySize(s Survey) int64 {
+	size := int64(48)
+	for k, v := range s {
+		size += int64(len(k) + len(v) + 32)
+	}
+	return size
+}
+
+func cloneSurveys(surveys []Survey) []Survey {
+	if surveys == nil {
+		return nil
+	}
+	clone := make([]Survey, len(surveys))
+	for i, s := range surveys {
+		clone[i] = maps.Clone(s)
+	}
+	return clone
+}
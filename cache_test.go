@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestSurveyCache(t *testing.T) {
+	survey := Survey{"IdentifierUUID": "ID000", "Title": "Wall"}
+	size := surveySize(survey)
+	c := NewSurveyCache(3 * size)
+
+	h := func(i byte) plumbing.Hash { return plumbing.Hash{i} }
+	c.AddSurvey(h(1), survey)
+	c.AddSurvey(h(2), survey)
+	c.AddSurvey(h(3), survey)
+
+	// Copies are returned, the cache is not affected by changes
+	s, ok := c.Survey(h(1))
+	assertEqual(t, ok, true)
+	s["Title"] = "Changed"
+	s, _ = c.Survey(h(1))
+	assertEqual(t, s["Title"], "Wall")
+
+	// The least recently used entry goes first
+	c.AddSurvey(h(4), survey)
+	_, ok = c.Survey(h(2))
+	assertEqual(t, ok, false)
+	_, ok = c.Survey(h(1))
+	assertEqual(t, ok, true)
+
+	stats := c.Stats()
+	assertEqual(t, stats.Entries, 3)
+	assertEqual(t, stats.Bytes, 3*size)
+	assertEqual(t, stats.Hits, int64(3))
+	assertEqual(t, stats.Misses, int64(1))
+	assertEqual(t, stats.Evictions, int64(1))
+
+	// Lists too large for the cache are not kept
+	c.AddSurveys(h(5), []Survey{survey, survey})
+	_, ok = c.Surveys(h(5))
+	assertEqual(t, ok, false)
+
+	c.SetMaxBytes(size)
+	assertEqual(t, c.Stats().Entries, 1)
+	c.SetMaxBytes(0)
+	assertEqual(t, c.Stats().Entries, 0)
+	c.AddSurvey(h(1), survey)
+	assertEqual(t, c.Stats().Entries, 0)
+}
+
+func TestSurveyCacheBackend(t *testing.T) {
+	b, err := NewMemoryBackend("test-user", "T1")
+	assertNoError(t, err)
+	surveys := generateSurveys(10)
+	version, err := b.WriteTrench("test-dev", "", []byte("{}"), surveys)
+	assertNoError(t, err)
+
+	read, err := b.ReadSurveysAtVersion(version)
+	assertNoError(t, err)
+	read[0]["Title"] = "Changed"
+
+	before := surveyCache.Stats()
+	read, err = b.ReadSurveysAtVersion(version)
+	assertNoError(t, err)
+	assertEqualSurveys(t, read, surveys)
+	assertEqual(t, surveyCache.Stats().Hits, before.Hits+1)
+
+	survey, err := b.ReadSurveyAtVersion(surveys[3].ID(), version)
+	assertNoError(t, err)
+	assertEqual(t, survey.IsEqual(surveys[3]), true)
+	assertEqual(t, surveyCache.Stats().Hits, before.Hits+2)
+}
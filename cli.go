@@ -3,9 +3,12 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 )
@@ -19,16 +22,29 @@ func startCmd(rootDir string, args []string) error {
 	fs.BoolVar(&ListenAll, "a", false, "")
 	fs.StringVar(&ListenAddr, "A", "", "")
 	fs.BoolVar(&Verbose, "v", false, "")
+	fs.BoolVar(&Metrics, "metrics", false, "")
+	fs.StringVar(&KeyFile, "k", KeyFile, "")
+	cacheSize := fs.String("cache", "", "")
 	fs.Usage = func() {
 		stderr.Println("Usage: idig-server run")
 		stderr.Println("  -p PORT  Port to listen on (default: 9000)")
 		stderr.Println("  -A ADDR  Address to listen on (default: localhost)")
 		stderr.Println("  -a       Listen on all addresses")
 		stderr.Println("  -v       Enable verbose logging")
+		stderr.Println("  -k FILE  Read the passphrase of encrypted projects from FILE")
+		stderr.Println("  -cache SIZE  Memory for parsed surveys, 0 to disable (default: 64MiB)")
+		stderr.Println("  -metrics     Serve the cache metrics at /metrics, without authentication")
 	}
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
+	if *cacheSize != "" {
+		maxCache, err := ParseSize(*cacheSize)
+		if err != nil {
+			return fmt.Errorf("Invalid cache size: %s", err)
+		}
+		surveyCache.SetMaxBytes(maxCache)
+	}
 
 	if Verbose {
 		log.SetFlags(log.Lshortfile)
@@ -63,7 +79,13 @@ func startCmd(rootDir string, args []string) error {
 			stderr.Printf("Warning: Project '%s' does not have any users defined.", project)
 			stderr.Printf("Add a new user with: idig-server adduser %s <USER> <PASSWORD>", project)
 		}
+
+		// Unlock encrypted projects now, requests cannot ask for passphrases
+		if _, err := ProjectKeyring(filepath.Join(rootDir, project)); err != nil {
+			return err
+		}
 	}
+	PromptPassphrase = false
 
 	if ListenAddr == "" && ListenPort == 0 && !ListenAll {
 		// No networking arguments were given, use default values
@@ -278,20 +300,53 @@ func listUsersCmd(rootDir string, args []string) error {
 }
 
 func logCmd(rootDir string, args []string) error {
-	if len(args) != 1 {
-		log.Println("Usage: idig-server log <PROJECT>/<TRENCH>")
-		log.Println("e.g.: idig-server log Agora/BZ")
+	stderr := log.New(os.Stderr, "", 0)
+	fs := flag.NewFlagSet("log", flag.ExitOnError)
+	limit := fs.Int("n", 0, "")
+	cursor := fs.String("cursor", "", "")
+	since := fs.String("since", "", "")
+	until := fs.String("until", "", "")
+	user := fs.String("user", "", "")
+	device := fs.String("device", "", "")
+	fs.Usage = func() {
+		stderr.Println("Usage: idig-server log [-n N] [-cursor VERSION] [-since TIME] [-until TIME] [-user USER] [-device DEVICE] <PROJECT>/<TRENCH>")
+		stderr.Println("e.g.: idig-server log -n 20 -since 2024-06-01 Agora/BZ")
+		stderr.Println("  -n N            Show at most N versions")
+		stderr.Println("  -cursor VERSION Start from the cursor shown by a previous log")
+		stderr.Println("  -since TIME     Only versions made at or after a date or RFC 3339 time")
+		stderr.Println("  -until TIME     Only versions made before a time, or up to a date")
+		stderr.Println("  -user USER      Only versions synced by USER")
+		stderr.Println("  -device DEVICE  Only versions synced from DEVICE")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || *limit < 0 {
+		fs.Usage()
 		os.Exit(1)
 	}
 
-	project, trench, _ := strings.Cut(args[0], "/")
+	q := VersionQuery{Limit: *limit, Cursor: *cursor, User: *user, Device: *device}
+	var err error
+	if *since != "" {
+		if q.Since, err = ParseVersionTime(*since, false); err != nil {
+			return err
+		}
+	}
+	if *until != "" {
+		if q.Until, err = ParseVersionTime(*until, true); err != nil {
+			return err
+		}
+	}
+
+	project, trench, _ := strings.Cut(fs.Arg(0), "/")
 	projectDir := filepath.Join(rootDir, project)
 	b, err := NewBackend(projectDir, "admin", trench)
 	if err != nil {
 		return fmt.Errorf("Error opening trench: %s", err)
 	}
 
-	versions, err := b.ListVersions()
+	versions, next, err := b.QueryVersions(q)
 	if err != nil {
 		return err
 	}
@@ -299,7 +354,12 @@ func logCmd(rootDir string, args []string) error {
 	for _, v := range versions {
 		ts := v.Date.Format(time.DateTime)
 		version := Prefix(v.Version, 7)
-		fmt.Printf("%s  %s\n", ts, version)
+		changes := fmt.Sprintf("+%d ~%d -%d", v.Added, v.Changed, v.Removed)
+		line := fmt.Sprintf("%s  %s  %-12s  %-24s  %s", ts, version, changes, v.Device+" "+v.User, strings.TrimSpace(v.Message))
+		fmt.Println(strings.TrimRight(line, " "))
+	}
+	if next != "" {
+		fmt.Printf("More versions: -cursor %s\n", Prefix(next, 7))
 	}
 
 	return nil
@@ -323,3 +383,709 @@ func rollbackCmd(rootDir string, args []string) error {
 
 	return b.Rollback(version)
 }
+
+func gcCmd(rootDir string, args []string) error {
+	stderr := log.New(os.Stderr, "", 0)
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	del := fs.Bool("delete", false, "")
+	all := fs.Bool("all", false, "")
+	fs.Usage = func() {
+		stderr.Println("Usage: idig-server gc [-delete] [-all] <PROJECT>/<TRENCH>")
+		stderr.Println("e.g.: idig-server gc -delete Agora/BZ")
+		stderr.Println("  -delete  Delete orphaned attachments and prune unreachable objects")
+		stderr.Println("  -all     Keep attachments referenced by any version, not just the latest")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	project, trench, _ := strings.Cut(fs.Arg(0), "/")
+	projectDir := filepath.Join(rootDir, project)
+	b, err := NewBackend(projectDir, "admin", trench)
+	if err != nil {
+		return fmt.Errorf("Error opening trench: %s", err)
+	}
+
+	orphaned, err := b.OrphanedAttachments(*all)
+	if err != nil {
+		return fmt.Errorf("Error finding orphaned attachments: %s", err)
+	}
+
+	for _, a := range orphaned {
+		fmt.Printf("%10s  %s  %s\n", FormatSize(a.Size), a.Checksum, a.Name)
+	}
+	reclaimable, err := b.ReclaimableSize(orphaned)
+	if err != nil {
+		return fmt.Errorf("Error finding unreachable attachments: %s", err)
+	}
+	fmt.Printf("%d orphaned attachments, %s reclaimable\n", len(orphaned), FormatSize(reclaimable))
+
+	if !*del {
+		return nil
+	}
+
+	for _, a := range orphaned {
+		if err := b.DeleteAttachment(a.Name, a.Checksum); err != nil {
+			return fmt.Errorf("Error deleting attachment '%s': %s", a.Name, err)
+		}
+	}
+	pruned, err := b.Prune()
+	if err != nil {
+		return fmt.Errorf("Error pruning objects: %s", err)
+	}
+	fmt.Printf("Deleted %d attachments, pruned %d objects\n", len(orphaned), pruned)
+	return nil
+}
+
+func migrateCmd(rootDir string, args []string) error {
+	if len(args) != 1 {
+		log.Println("Usage: idig-server migrate <PROJECT>")
+		log.Println("e.g.: idig-server migrate Agora")
+		os.Exit(1)
+	}
+
+	project := args[0]
+	projectDir := filepath.Join(rootDir, project)
+	if !FileExists(filepath.Join(projectDir, "users.txt")) {
+		return fmt.Errorf("Project '%s' does not exist", project)
+	}
+
+	cfg, err := LoadProjectConfig(projectDir)
+	if err != nil {
+		return err
+	}
+	if !cfg.ExternalAttachments() && !cfg.SharedAttachments {
+		cfg.SharedAttachments = true
+		if err := cfg.Save(projectDir); err != nil {
+			return fmt.Errorf("Error writing config file: %s", err)
+		}
+		log.Printf("Enabled shared attachments for project '%s'", project)
+	}
+
+	trenches, err := ListTrenchNames(projectDir)
+	if err != nil {
+		return err
+	}
+	for _, trench := range trenches {
+		b, err := NewBackend(projectDir, "admin", trench)
+		if err != nil {
+			return fmt.Errorf("Error opening trench: %s", err)
+		}
+		moved, err := b.MoveAttachments()
+		if err != nil {
+			return fmt.Errorf("Error moving attachments of '%s': %s", trench, err)
+		}
+		log.Printf("%s: moved %d attachments", trench, moved)
+	}
+	return nil
+}
+
+func usageCmd(rootDir string, args []string) error {
+	if len(args) > 1 {
+		log.Println("Usage: idig-server usage [<PROJECT>]")
+		log.Println("e.g.: idig-server usage Agora")
+		os.Exit(1)
+	}
+
+	projects := args
+	if len(args) == 0 {
+		var err error
+		if projects, err = ListProjects(rootDir); err != nil {
+			return err
+		}
+	}
+
+	for i, project := range projects {
+		projectDir := filepath.Join(rootDir, project)
+		if !FileExists(filepath.Join(projectDir, "users.txt")) {
+			return fmt.Errorf("Project '%s' does not exist", project)
+		}
+		cfg, err := LoadProjectConfig(projectDir)
+		if err != nil {
+			return err
+		}
+		usage, err := ProjectUsage(projectDir)
+		if err != nil {
+			return err
+		}
+
+		q := cfg.Quota
+		if q == nil {
+			q = &QuotaConfig{}
+		}
+		limit := func(n ByteSize) string {
+			if n <= 0 {
+				return "-"
+			}
+			return FormatSize(int64(n))
+		}
+
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("%s\n", project)
+		fmt.Printf("  %-20s %11s %10s %10s %10s\n", "TRENCH", "ATTACHMENTS", "SIZE", "QUOTA", "REPOSITORY")
+		var count int
+		var repoSize int64
+		for _, t := range usage {
+			count += t.Attachments
+			repoSize += t.RepositoryBytes
+			fmt.Printf("  %-20s %11d %10s %10s %10s\n", t.Name, t.Attachments,
+				FormatSize(t.AttachmentBytes), limit(q.TrenchAttachments), FormatSize(t.RepositoryBytes))
+		}
+		fmt.Printf("  %-20s %11d %10s %10s %10s\n", "Total", count,
+			FormatSize(usage.AttachmentBytes()), limit(q.ProjectAttachments), FormatSize(repoSize))
+
+		if free, err := FreeDiskSpace(projectDir); err == nil {
+			fmt.Printf("  Free disk space: %s (minimum %s)\n", FormatSize(free), limit(q.MinFreeDisk))
+		}
+	}
+	return nil
+}
+
+func encryptCmd(rootDir string, args []string) error {
+	stderr := log.New(os.Stderr, "", 0)
+	fs := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	keyFile := fs.String("k", "", "")
+	fs.Usage = func() {
+		stderr.Println("Usage: idig-server encrypt [-k FILE] <PROJECT>")
+		stderr.Println("e.g.: idig-server encrypt Agora")
+		stderr.Println("  -k FILE  Read the new passphrase from FILE instead of asking for it")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	project := fs.Arg(0)
+	projectDir := filepath.Join(rootDir, project)
+	if !FileExists(filepath.Join(projectDir, "users.txt")) {
+		return fmt.Errorf("Project '%s' does not exist", project)
+	}
+	if IsEncryptedProject(projectDir) {
+		return fmt.Errorf("Project '%s' is already encrypted, use rekey to change its key", project)
+	}
+
+	passphrase, err := readNewPassphrase(*keyFile)
+	if err != nil {
+		return err
+	}
+	keys, err := NewKeyring()
+	if err != nil {
+		return err
+	}
+	if err := keys.Save(projectDir, passphrase); err != nil {
+		return fmt.Errorf("Error writing keyring: %s", err)
+	}
+	setProjectKeyring(projectDir, keys)
+
+	if err := ReencryptProject(projectDir); err != nil {
+		return err
+	}
+	log.Printf("Encrypted project '%s'", project)
+	return nil
+}
+
+func rekeyCmd(rootDir string, args []string) error {
+	stderr := log.New(os.Stderr, "", 0)
+	fs := flag.NewFlagSet("rekey", flag.ExitOnError)
+	keyFile := fs.String("k", "", "")
+	passphraseOnly := fs.Bool("passphrase", false, "")
+	fs.Usage = func() {
+		stderr.Println("Usage: idig-server rekey [-passphrase] [-k FILE] <PROJECT>")
+		stderr.Println("e.g.: idig-server rekey Agora")
+		stderr.Println("  -passphrase  Only change the passphrase, keep the encryption key")
+		stderr.Println("  -k FILE      Read the new passphrase from FILE instead of asking for it")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	project := fs.Arg(0)
+	projectDir := filepath.Join(rootDir, project)
+	if !IsEncryptedProject(projectDir) {
+		return fmt.Errorf("Project '%s' is not encrypted", project)
+	}
+	keys, err := ProjectKeyring(projectDir)
+	if err != nil {
+		return err
+	}
+
+	passphrase, err := readNewPassphrase(*keyFile)
+	if err != nil {
+		return err
+	}
+	if *passphraseOnly {
+		return keys.Save(projectDir, passphrase)
+	}
+
+	// Keep the old key until everything is encrypted with the new one
+	if err := keys.AddKey(); err != nil {
+		return err
+	}
+	if err := keys.Save(projectDir, passphrase); err != nil {
+		return fmt.Errorf("Error writing keyring: %s", err)
+	}
+	if err := ReencryptProject(projectDir); err != nil {
+		return err
+	}
+	keys.RemoveOldKeys()
+	if err := keys.Save(projectDir, passphrase); err != nil {
+		return fmt.Errorf("Error writing keyring: %s", err)
+	}
+	log.Printf("Encrypted project '%s' with a new key", project)
+	return nil
+}
+
+// trenchesArg returns the trenches named by a [PROJECT[/TRENCH]] argument,
+// by project.
+func trenchesArg(rootDir string, args []string) (map[string][]string, error) {
+	var project, trench string
+	if len(args) == 1 {
+		project, trench, _ = strings.Cut(args[0], "/")
+	}
+
+	projects := []string{project}
+	if project == "" {
+		var err error
+		if projects, err = ListProjects(rootDir); err != nil {
+			return nil, err
+		}
+	} else if !FileExists(filepath.Join(rootDir, project, "users.txt")) {
+		return nil, fmt.Errorf("Project '%s' does not exist", project)
+	}
+
+	result := make(map[string][]string)
+	for _, project := range projects {
+		if trench != "" {
+			if !FileExists(filepath.Join(rootDir, project, trench, "HEAD")) {
+				return nil, fmt.Errorf("Trench '%s' does not exist", trench)
+			}
+			result[project] = []string{trench}
+			continue
+		}
+		trenches, err := ListTrenchNames(filepath.Join(rootDir, project))
+		if err != nil {
+			return nil, err
+		}
+		result[project] = trenches
+	}
+	return result, nil
+}
+
+func fsckCmd(rootDir string, args []string) error {
+	if len(args) > 1 {
+		log.Println("Usage: idig-server fsck [<PROJECT>[/<TRENCH>]]")
+		log.Println("e.g.: idig-server fsck Agora/BZ")
+		os.Exit(1)
+	}
+
+	projects, err := trenchesArg(rootDir, args)
+	if err != nil {
+		return err
+	}
+
+	problems := 0
+	for _, project := range slices.Sorted(maps.Keys(projects)) {
+		for _, trench := range projects[project] {
+			b, err := NewBackend(filepath.Join(rootDir, project), "admin", trench)
+			if err != nil {
+				return fmt.Errorf("Error opening trench: %s", err)
+			}
+			report, err := b.Fsck()
+			if err != nil {
+				return fmt.Errorf("Error checking %s/%s: %s", project, trench, err)
+			}
+			status := "ok"
+			if n := len(report.Problems); n > 0 {
+				status = fmt.Sprintf("%d problems", n)
+			}
+			fmt.Printf("%s/%s: %d objects, %d versions, %d surveys, %d attachments: %s\n", project, trench,
+				report.Objects, report.Versions, report.Surveys, report.Attachments, status)
+			for _, p := range report.Problems {
+				fmt.Printf("  %s\n", p)
+			}
+			problems += len(report.Problems)
+		}
+	}
+	if problems > 0 {
+		return fmt.Errorf("Found %d problems", problems)
+	}
+	return nil
+}
+
+func repackCmd(rootDir string, args []string) error {
+	if len(args) > 1 {
+		log.Println("Usage: idig-server repack [<PROJECT>[/<TRENCH>]]")
+		log.Println("e.g.: idig-server repack Agora")
+		os.Exit(1)
+	}
+
+	projects, err := trenchesArg(rootDir, args)
+	if err != nil {
+		return err
+	}
+
+	var totalBefore, totalAfter int64
+	repack := func(name, dir string, f func() (int, error)) error {
+		objectsDir := filepath.Join(dir, "objects")
+		before, err := dirSize(objectsDir)
+		if err != nil {
+			return err
+		}
+		n, err := f()
+		if err != nil {
+			return fmt.Errorf("Error repacking %s: %s", name, err)
+		}
+		after, err := dirSize(objectsDir)
+		if err != nil {
+			return err
+		}
+		totalBefore += before
+		totalAfter += after
+		fmt.Printf("%s: %d objects, %s -> %s\n", name, n, FormatSize(before), FormatSize(after))
+		return nil
+	}
+
+	for _, project := range slices.Sorted(maps.Keys(projects)) {
+		projectDir := filepath.Join(rootDir, project)
+		for _, trench := range projects[project] {
+			b, err := NewBackend(projectDir, "admin", trench)
+			if err != nil {
+				return fmt.Errorf("Error opening trench: %s", err)
+			}
+			err = repack(project+"/"+trench, filepath.Join(projectDir, trench), b.Repack)
+			if err != nil {
+				return err
+			}
+		}
+
+		// The shared store is only repacked along with all of its trenches
+		sharedDir := filepath.Join(projectDir, SharedAttachmentsDir)
+		if len(args) == 0 || !strings.Contains(args[0], "/") {
+			if FileExists(sharedDir) {
+				err := repack(project+"/"+SharedAttachmentsDir, sharedDir, func() (int, error) {
+					return RepackSharedStore(projectDir)
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	fmt.Printf("Total: %s -> %s\n", FormatSize(totalBefore), FormatSize(totalAfter))
+	return nil
+}
+
+func squashCmd(rootDir string, args []string) error {
+	stderr := log.New(os.Stderr, "", 0)
+	fs := flag.NewFlagSet("squash", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "")
+	days := fs.Int("days", DefaultRetentionDays, "")
+	fs.Usage = func() {
+		stderr.Println("Usage: idig-server squash [-dry-run] [-days N] [<PROJECT>[/<TRENCH>]]")
+		stderr.Println("e.g.: idig-server squash -dry-run Agora/BZ")
+		stderr.Println("  -dry-run  Only show which versions would be kept")
+		stderr.Printf("  -days N   Keep every version of the last N days (default %d)\n", DefaultRetentionDays)
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 || *days < 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	projects, err := trenchesArg(rootDir, fs.Args())
+	if err != nil {
+		return err
+	}
+
+	policy := RetentionPolicy{Recent: time.Duration(*days) * 24 * time.Hour}
+	now := time.Now()
+	for _, project := range slices.Sorted(maps.Keys(projects)) {
+		for _, trench := range projects[project] {
+			b, err := NewBackend(filepath.Join(rootDir, project), "admin", trench)
+			if err != nil {
+				return fmt.Errorf("Error opening trench: %s", err)
+			}
+			summary, err := b.Squash(policy, now, *dryRun)
+			if err != nil {
+				return fmt.Errorf("Error squashing %s/%s: %s", project, trench, err)
+			}
+			fmt.Printf("%s/%s: %s\n", project, trench, summary)
+		}
+	}
+	if !*dryRun {
+		fmt.Println("Removed versions are deleted by the next 'idig-server gc -delete' or 'idig-server repack'")
+	}
+	return nil
+}
+
+func exportCmd(rootDir string, args []string) error {
+	stderr := log.New(os.Stderr, "", 0)
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "csv", "")
+	types := fs.String("type", "", "")
+	version := fs.String("version", "HEAD", "")
+	attachments := fs.Bool("attachments", false, "")
+	fs.Usage = func() {
+		stderr.Println("Usage: idig-server export [-format FORMAT] [-type TYPES] [-version VERSION] <PROJECT>[/<TRENCH>] [<OUTPUT>]")
+		stderr.Println("e.g.: idig-server export -format csv -type Context Agora/BZ BZ.csv")
+		stderr.Println("      idig-server export -format sqlite -version 2024-06-30 Agora Agora.db")
+		stderr.Println("  -format FORMAT    Output format: csv, geojson, kml, jsonld, turtle or sqlite (default: csv)")
+		stderr.Println("  -type TYPES       Only export surveys of these comma separated types")
+		stderr.Println("  -version VERSION  Export an older version, or the versions at a date (default: HEAD)")
+		stderr.Println("  -attachments      Include the content of attachments in SQLite databases")
+		stderr.Println("Without OUTPUT, the export is written to the standard output. SQLite")
+		stderr.Println("exports a whole project and needs an OUTPUT.")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if !slices.Contains([]string{"csv", "geojson", "kml", "jsonld", "turtle", "sqlite"}, *format) {
+		return fmt.Errorf("Unknown export format '%s'", *format)
+	}
+
+	project, trench, _ := strings.Cut(fs.Arg(0), "/")
+	projectDir := filepath.Join(rootDir, project)
+	if *format == "sqlite" {
+		if trench != "" || *types != "" || fs.NArg() != 2 {
+			fs.Usage()
+			os.Exit(1)
+		}
+		summary, err := WriteProjectSQLite(fs.Arg(1), projectDir, "admin", *version, *attachments)
+		if err != nil {
+			return fmt.Errorf("Error exporting %s: %s", project, err)
+		}
+		fmt.Printf("Exported %s to %s\n", summary, fs.Arg(1))
+		return nil
+	}
+	cfg, err := LoadProjectConfig(projectDir)
+	if err != nil {
+		return err
+	}
+	var mapping *LinkedDataMapping
+	if *format == "jsonld" || *format == "turtle" {
+		if mapping, err = LoadLinkedDataMapping(projectDir); err != nil {
+			return err
+		}
+	}
+
+	var surveys []Survey
+	var fields []string
+	if trench == "" {
+		surveys, fields, err = ExportProjectSurveys(projectDir, "admin", *version, *types)
+	} else {
+		var b *Backend
+		if b, err = NewBackend(projectDir, "admin", trench); err != nil {
+			return fmt.Errorf("Error opening trench: %s", err)
+		}
+		surveys, fields, err = b.ExportSurveys(*version, *types)
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading %s: %s", fs.Arg(0), err)
+	}
+
+	var out io.Writer = os.Stdout
+	if fs.NArg() == 2 {
+		f, err := os.Create(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	switch *format {
+	case "csv":
+		return WriteSurveysCSV(out, surveys, SurveyColumns(surveys, fields))
+	case "geojson", "kml":
+		features, problems := SurveyFeatures(surveys, cfg.Geometry)
+		for _, p := range problems {
+			stderr.Printf("Warning: %s", p)
+		}
+		if *format == "kml" {
+			return WriteKML(out, fs.Arg(0), features)
+		}
+		return WriteGeoJSON(out, features)
+	case "jsonld", "turtle":
+		g := LinkedDataGraph(mapping, trench, surveys)
+		if *format == "turtle" {
+			return g.WriteTurtle(out)
+		}
+		return g.WriteJSONLD(out)
+	}
+	return nil
+}
+
+func harrisCmd(rootDir string, args []string) error {
+	stderr := log.New(os.Stderr, "", 0)
+	fs := flag.NewFlagSet("harris", flag.ExitOnError)
+	format := fs.String("format", "dot", "")
+	types := fs.String("type", "", "")
+	version := fs.String("version", "HEAD", "")
+	fs.Usage = func() {
+		stderr.Println("Usage: idig-server harris [-format FORMAT] [-type TYPES] [-version VERSION] <PROJECT>[/<TRENCH>] [<OUTPUT>]")
+		stderr.Println("e.g.: idig-server harris Agora/BZ | dot -Tsvg > BZ.svg")
+		stderr.Println("      idig-server harris -format graphml -type Context Agora Agora.graphml")
+		stderr.Println("  -format FORMAT    Output format: dot, graphml or json (default: dot)")
+		stderr.Println("  -type TYPES       Only include surveys of these comma separated types")
+		stderr.Println("  -version VERSION  Use an older version, or the versions at a date (default: HEAD)")
+		stderr.Println("Without OUTPUT, the matrix is written to the standard output.")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if !slices.Contains([]string{"dot", "graphml", "json"}, *format) {
+		return fmt.Errorf("Unknown matrix format '%s'", *format)
+	}
+
+	project, trench, _ := strings.Cut(fs.Arg(0), "/")
+	projectDir := filepath.Join(rootDir, project)
+	cfg, err := LoadProjectConfig(projectDir)
+	if err != nil {
+		return err
+	}
+	var surveys []Survey
+	if trench == "" {
+		surveys, _, err = ExportProjectSurveys(projectDir, "admin", *version, *types)
+	} else {
+		var b *Backend
+		if b, err = NewBackend(projectDir, "admin", trench); err != nil {
+			return fmt.Errorf("Error opening trench: %s", err)
+		}
+		surveys, _, err = b.ExportSurveys(*version, *types)
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading %s: %s", fs.Arg(0), err)
+	}
+	m := BuildHarrisMatrix(surveys, trench, cfg.Stratigraphy)
+
+	var out io.Writer = os.Stdout
+	if fs.NArg() == 2 {
+		f, err := os.Create(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+		stderr.Printf("%d units, %d edges (%d implied edges left out)", len(m.Nodes), len(m.Edges), m.Removed)
+	}
+
+	switch *format {
+	case "graphml":
+		return m.WriteGraphML(out)
+	case "json":
+		return m.WriteJSON(out)
+	}
+	return m.WriteDOT(out, fs.Arg(0))
+}
+
+func archiveCmd(rootDir string, args []string) error {
+	stderr := log.New(os.Stderr, "", 0)
+	fs := flag.NewFlagSet("archive", flag.ExitOnError)
+	version := fs.String("version", "HEAD", "")
+	fs.Usage = func() {
+		stderr.Println("Usage: idig-server archive [-version VERSION] <PROJECT>/<TRENCH> <OUTPUT>")
+		stderr.Println("e.g.: idig-server archive Agora/BZ BZ-2024/")
+		stderr.Println("      idig-server archive -version 2024-06-30 Agora/BZ BZ-2024.zip")
+		stderr.Println("  -version VERSION  Archive an older version (default: HEAD)")
+		stderr.Println("Writes a BagIt bag to the OUTPUT directory, or to a ZIP file when")
+		stderr.Println("OUTPUT ends with .zip.")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	project, trench, _ := strings.Cut(fs.Arg(0), "/")
+	if fs.NArg() != 2 || trench == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	b, err := NewBackend(filepath.Join(rootDir, project), "admin", trench)
+	if err != nil {
+		return fmt.Errorf("Error opening trench: %s", err)
+	}
+
+	output := fs.Arg(1)
+	var bag BagWriter
+	var zipFile *os.File
+	_, err = os.Stat(output)
+	existed := err == nil
+	if strings.EqualFold(filepath.Ext(output), ".zip") {
+		if zipFile, err = os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644); err != nil {
+			return err
+		}
+		bag = NewZipBag(zipFile, strings.TrimSuffix(filepath.Base(output), filepath.Ext(output)))
+	} else if bag, err = NewDirBag(output); err != nil {
+		return err
+	}
+
+	summary, err := b.Archive(*version, bag)
+	if closeErr := bag.Close(); err == nil {
+		err = closeErr
+	}
+	if zipFile != nil {
+		if closeErr := zipFile.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		// Leave no partial bag behind, only the empty directory if given one
+		if !existed {
+			os.RemoveAll(output)
+		} else if entries, readErr := os.ReadDir(output); readErr == nil {
+			for _, e := range entries {
+				os.RemoveAll(filepath.Join(output, e.Name()))
+			}
+		}
+		return fmt.Errorf("Error archiving %s: %s", fs.Arg(0), err)
+	}
+	fmt.Printf("Archived %s %s to %s\n", fs.Arg(0), summary, output)
+	return nil
+}
+
+func reindexCmd(rootDir string, args []string) error {
+	if len(args) > 1 || (len(args) == 1 && strings.Contains(args[0], "/")) {
+		log.Println("Usage: idig-server reindex [<PROJECT>]")
+		log.Println("e.g.: idig-server reindex Agora")
+		os.Exit(1)
+	}
+
+	projects, err := trenchesArg(rootDir, args)
+	if err != nil {
+		return err
+	}
+	for _, project := range slices.Sorted(maps.Keys(projects)) {
+		projectDir := filepath.Join(rootDir, project)
+		if err := RemoveSearchIndex(projectDir); err != nil {
+			return err
+		}
+		idx, err := ProjectSearchIndex(projectDir, "admin")
+		if err != nil {
+			return fmt.Errorf("Error indexing %s: %s", project, err)
+		}
+		fmt.Printf("%s: %s\n", project, idx.Stats())
+	}
+	return nil
+}
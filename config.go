@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ProjectConfig holds the optional settings of a project. It is stored in
+// config.json, next to users.txt. A missing file means default settings.
+type ProjectConfig struct {
+	// Store attachment blobs once per project instead of once per trench
+	SharedAttachments bool `json:"shared_attachments,omitempty"`
+
+	// Where attachments are stored, in git by default
+	AttachmentStore *AttachmentStoreConfig `json:"attachment_store,omitempty"`
+
+	// Storage limits, all optional
+	Quota *QuotaConfig `json:"quota,omitempty"`
+
+	// What to do when surveys use the same name for different attachments:
+	// rename (default) or reject
+	AttachmentNameClash string `json:"attachment_name_clash,omitempty"`
+
+	// Survey fields holding coordinates, for GeoJSON and KML exports
+	Geometry *GeometryConfig `json:"geometry,omitempty"`
+
+	// Relations between stratigraphic units, for Harris matrices
+	Stratigraphy *StratigraphyConfig `json:"stratigraphy,omitempty"`
+}
+
+type GeometryConfig struct {
+	Fields []string `json:"fields,omitempty"` // Checked in order (default: Coordinates)
+	Order  string   `json:"order,omitempty"`  // Of plain coordinate lists: latlon (default) or lonlat
+}
+
+type StratigraphyConfig struct {
+	Sequence []RelationPair `json:"sequence,omitempty"` // Relations ordering units in time (default: Above/Below, Cuts/CutBy...)
+	Same     []string       `json:"same,omitempty"`     // Relations joining parts of the same unit (default: SameAs, Equals)
+
+	// Report stratigraphic problems as warnings after syncing
+	SyncWarnings bool `json:"sync_warnings,omitempty"`
+
+	// Relations whose reciprocals the server keeps in step, e.g. Above for
+	// Above/Below, or SameAs
+	Reciprocals []string `json:"reciprocals,omitempty"`
+}
+
+// RelationPair is a relation between stratigraphic units and its reciprocal.
+type RelationPair struct {
+	Later   string `json:"later"`   // Relation of a later unit to an earlier one, e.g. Above
+	Earlier string `json:"earlier"` // Relation of an earlier unit to a later one, e.g. Below
+}
+
+type QuotaConfig struct {
+	ProjectAttachments ByteSize `json:"project_attachments,omitempty"` // Max attachment bytes in the project
+	TrenchAttachments  ByteSize `json:"trench_attachments,omitempty"`  // Max attachment bytes per trench
+	MinFreeDisk        ByteSize `json:"min_free_disk,omitempty"`       // Refuse all writes below this
+}
+
+type AttachmentStoreConfig struct {
+	Type string `json:"type"` // One of: git, filesystem, s3
+
+	// Filesystem store: directory, relative to the project (default: .files)
+	Path string `json:"path,omitempty"`
+
+	// S3 store. Credentials can also be given with AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY.
+	Endpoint  string `json:"endpoint,omitempty"` // e.g. http://localhost:9000
+	Region    string `json:"region,omitempty"`
+	Bucket    string `json:"bucket,omitempty"`
+	Prefix    string `json:"prefix,omitempty"`
+	AccessKey string `json:"access_key,omitempty"`
+	SecretKey string `json:"secret_key,omitempty"`
+}
+
+func LoadProjectConfig(projectDir string) (*ProjectConfig, error) {
+	configFile := filepath.Join(projectDir, "config.json")
+	data, err := os.ReadFile(configFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &ProjectConfig{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Invalid config file: %w", err)
+	}
+
+	var cfg ProjectConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("Invalid config file: %w", err)
+	}
+	return &cfg, nil
+}
+
+// ExternalAttachments reports whether attachments are stored outside of git.
+func (cfg *ProjectConfig) ExternalAttachments() bool {
+	sc := cfg.AttachmentStore
+	return sc != nil && sc.Type != "" && sc.Type != StoreGit
+}
+
+func (cfg *ProjectConfig) Save(projectDir string) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	configFile := filepath.Join(projectDir, "config.json")
+	return os.WriteFile(configFile, append(data, '\n'), 0o644)
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// File inside a project holding its encryption keys. Projects without it are
+// not encrypted.
+const KeyringFile = "keyring.json"
+
+// Encrypted data starts with this header, followed by the key id, the nonce
+// and the sealed data.
+const encryptedHeader = "idig-enc1\n"
+
+var ErrLocked = errors.New("Project is encrypted and locked")
+
+// Source of project passphrases
+var (
+	KeyFile          = os.Getenv("IDIG_KEY_FILE") // Read the passphrase from this file
+	PromptPassphrase = true                       // Ask on the terminal
+)
+
+// scrypt parameters for deriving the key that wraps the data keys
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// Keyring holds the data keys of a project. Data is always encrypted with
+// the newest key, older keys are kept to read data written before a rotation.
+type Keyring struct {
+	keys    map[uint32]*dataKey
+	current uint32
+}
+
+type dataKey struct {
+	raw  []byte
+	aead cipher.AEAD
+	mac  []byte // Derives nonces from the plaintext
+}
+
+type keyringFile struct {
+	Salt []byte       `json:"salt"`
+	N    int          `json:"n"`
+	R    int          `json:"r"`
+	P    int          `json:"p"`
+	Keys []wrappedKey `json:"keys"`
+}
+
+type wrappedKey struct {
+	ID      uint32    `json:"id"`
+	Created time.Time `json:"created"`
+	Key     []byte    `json:"key"` // Nonce and sealed key
+}
+
+func newDataKey(raw []byte) (*dataKey, error) {
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &dataKey{raw: raw, aead: aead, mac: hmacSHA256(raw, "nonce")}, nil
+}
+
+// NewKeyring returns a keyring with a new random key.
+func NewKeyring() (*Keyring, error) {
+	k := &Keyring{keys: make(map[uint32]*dataKey)}
+	return k, k.AddKey()
+}
+
+// AddKey adds a new random key and makes it the current one.
+func (k *Keyring) AddKey() error {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	key, err := newDataKey(raw)
+	if err != nil {
+		return err
+	}
+	k.current++
+	k.keys[k.current] = key
+	return nil
+}
+
+// RemoveOldKeys forgets all keys but the current one. Data encrypted with
+// them cannot be read anymore.
+func (k *Keyring) RemoveOldKeys() {
+	for id := range k.keys {
+		if id != k.current {
+			delete(k.keys, id)
+		}
+	}
+}
+
+func deriveKey(passphrase string, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	kek, err := scrypt.Key([]byte(passphrase), salt, n, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func LoadKeyring(projectDir, passphrase string) (*Keyring, error) {
+	data, err := os.ReadFile(filepath.Join(projectDir, KeyringFile))
+	if err != nil {
+		return nil, err
+	}
+	var f keyringFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("Invalid keyring file: %w", err)
+	}
+	kek, err := deriveKey(passphrase, f.Salt, f.N, f.R, f.P)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid keyring file: %w", err)
+	}
+
+	k := &Keyring{keys: make(map[uint32]*dataKey)}
+	for _, wk := range f.Keys {
+		ns := kek.NonceSize()
+		if len(wk.Key) < ns {
+			return nil, fmt.Errorf("Invalid keyring file")
+		}
+		raw, err := kek.Open(nil, wk.Key[:ns], wk.Key[ns:], []byte(KeyringFile))
+		if err != nil {
+			return nil, fmt.Errorf("Wrong passphrase")
+		}
+		if k.keys[wk.ID], err = newDataKey(raw); err != nil {
+			return nil, err
+		}
+		k.current = max(k.current, wk.ID)
+	}
+	if len(k.keys) == 0 {
+		return nil, fmt.Errorf("Invalid keyring file: no keys")
+	}
+	return k, nil
+}
+
+// Save writes the keyring of a project, with its keys wrapped with a key
+// derived from passphrase.
+func (k *Keyring) Save(projectDir, passphrase string) error {
+	f := keyringFile{Salt: make([]byte, 16), N: scryptN, R: scryptR, P: scryptP}
+	if _, err := rand.Read(f.Salt); err != nil {
+		return err
+	}
+	kek, err := deriveKey(passphrase, f.Salt, f.N, f.R, f.P)
+	if err != nil {
+		return err
+	}
+	for id, key := range k.keys {
+		nonce := make([]byte, kek.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		sealed := kek.Seal(nonce, nonce, key.raw, []byte(KeyringFile))
+		f.Keys = append(f.Keys, wrappedKey{ID: id, Created: time.Now().UTC(), Key: sealed})
+	}
+	sort.Slice(f.Keys, func(i, j int) bool {
+		return f.Keys[i].ID < f.Keys[j].ID
+	})
+
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Replace atomically, losing the keyring means losing the data
+	keyringFile := filepath.Join(projectDir, KeyringFile)
+	tmpFile := keyringFile + ".tmp"
+	if err := os.WriteFile(tmpFile, append(data, '\n'), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, keyringFile)
+}
+
+// Encrypt seals data with the current key. The nonce is derived from the
+// data, so the same data always gives the same result and git can still
+// deduplicate it. This reveals which blobs are equal, but nothing else.
+func (k *Keyring) Encrypt(data []byte) []byte {
+	key := k.keys[k.current]
+	nonce := hmacSHA256(key.mac, string(data))[:key.aead.NonceSize()]
+
+	out := []byte(encryptedHeader)
+	out = binary.BigEndian.AppendUint32(out, k.current)
+	out = append(out, nonce...)
+	return key.aead.Seal(out, nonce, data, nil)
+}
+
+// Decrypt opens data sealed with any key of the keyring. Data that is not
+// encrypted is returned as is.
+func (k *Keyring) Decrypt(data []byte) ([]byte, error) {
+	rest, ok := bytes.CutPrefix(data, []byte(encryptedHeader))
+	if !ok {
+		return data, nil
+	}
+	if len(rest) < 4 {
+		return nil, fmt.Errorf("Invalid encrypted data")
+	}
+	id := binary.BigEndian.Uint32(rest)
+	key := k.keys[id]
+	if key == nil {
+		return nil, fmt.Errorf("Unknown encryption key %d", id)
+	}
+	rest = rest[4:]
+	ns := key.aead.NonceSize()
+	if len(rest) < ns {
+		return nil, fmt.Errorf("Invalid encrypted data")
+	}
+	plain, err := key.aead.Open(nil, rest[:ns], rest[ns:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt data: %w", err)
+	}
+	return plain, nil
+}
+
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedHeader))
+}
+
+func IsEncryptedProject(projectDir string) bool {
+	return FileExists(filepath.Join(projectDir, KeyringFile))
+}
+
+// Keyrings of the projects unlocked so far, by project directory
+var (
+	keyringsMu sync.Mutex
+	keyrings   = make(map[string]*Keyring)
+)
+
+// ProjectKeyring returns the keyring of a project, unlocking it if needed.
+// It returns nil for projects that are not encrypted.
+func ProjectKeyring(projectDir string) (*Keyring, error) {
+	if !IsEncryptedProject(projectDir) {
+		return nil, nil
+	}
+
+	keyringsMu.Lock()
+	defer keyringsMu.Unlock()
+	projectDir = filepath.Clean(projectDir)
+	if k, ok := keyrings[projectDir]; ok {
+		return k, nil
+	}
+
+	passphrase, err := readPassphrase(fmt.Sprintf("Passphrase for project '%s': ", filepath.Base(projectDir)))
+	if err != nil {
+		return nil, err
+	}
+	k, err := LoadKeyring(projectDir, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unlock project '%s': %w", filepath.Base(projectDir), err)
+	}
+	keyrings[projectDir] = k
+	return k, nil
+}
+
+func setProjectKeyring(projectDir string, k *Keyring) {
+	keyringsMu.Lock()
+	defer keyringsMu.Unlock()
+	keyrings[filepath.Clean(projectDir)] = k
+}
+
+func readKeyFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Error reading key file: %w", err)
+	}
+	passphrase := strings.TrimRight(string(data), "\r\n")
+	if passphrase == "" {
+		return "", fmt.Errorf("Key file '%s' is empty", path)
+	}
+	return passphrase, nil
+}
+
+func readPassphrase(prompt string) (string, error) {
+	if KeyFile != "" {
+		return readKeyFile(KeyFile)
+	}
+	fd := int(os.Stdin.Fd())
+	if !PromptPassphrase || !term.IsTerminal(fd) {
+		return "", ErrLocked
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return string(passphrase), err
+}
+
+// readNewPassphrase reads a new passphrase from keyFile, or asks for it twice
+// on the terminal.
+func readNewPassphrase(keyFile string) (string, error) {
+	if keyFile != "" {
+		return readKeyFile(keyFile)
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("No terminal to ask for a passphrase, use a key file")
+	}
+	fmt.Fprint(os.Stderr, "New passphrase: ")
+	p1, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+	p2, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if len(p1) == 0 {
+		return "", fmt.Errorf("Empty passphrase")
+	}
+	if !bytes.Equal(p1, p2) {
+		return "", fmt.Errorf("Passphrases do not match")
+	}
+	return string(p1), nil
+}
+
+func (b *Backend) encrypt(data []byte) []byte {
+	if b.keys == nil {
+		return data
+	}
+	return b.keys.Encrypt(data)
+}
+
+func (b *Backend) decrypt(data []byte) ([]byte, error) {
+	if b.keys == nil {
+		if isEncrypted(data) {
+			return nil, ErrLocked
+		}
+		return data, nil
+	}
+	return b.keys.Decrypt(data)
+}
+
+// Reencrypt rewrites the attachments and every version of the trench with
+// the current key of the project. Unencrypted data gets encrypted. Versions
+// get new hashes, so devices pull the whole trench on their next sync.
+func (b *Backend) Reencrypt() error {
+	if b.ReadOnly {
+		return fmt.Errorf("Forbidden")
+	}
+
+	attachments, err := b.store.List()
+	if err != nil {
+		return err
+	}
+	for _, a := range attachments {
+		raw, err := b.store.Read(a.Name, a.Checksum)
+		if err != nil {
+			return err
+		}
+		data, err := b.decrypt(raw)
+		if err != nil {
+			return fmt.Errorf("Error reading attachment '%s': %w", a.Name, err)
+		}
+		if enc := b.encrypt(data); !bytes.Equal(enc, raw) {
+			if err := b.store.Write(a.Name, a.Checksum, enc); err != nil {
+				return err
+			}
+		}
+	}
+
+	head, err := b.r.Head()
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Versions only have one parent, rewrite them oldest first
+	var commits []*object.Commit
+	for h := head.Hash(); ; {
+		c, err := b.r.CommitObject(h)
+		if err != nil {
+			return err
+		}
+		commits = append(commits, c)
+		if len(c.ParentHashes) == 0 {
+			break
+		}
+		h = c.ParentHashes[0]
+	}
+
+	rw := &reencrypter{b: b, done: make(map[plumbing.Hash]plumbing.Hash)}
+	commitMap := make(map[plumbing.Hash]plumbing.Hash)
+	for i := len(commits) - 1; i >= 0; i-- {
+		c := commits[i]
+		tree, err := rw.tree(c.TreeHash)
+		if err != nil {
+			return fmt.Errorf("Error rewriting version %s: %w", c.Hash, err)
+		}
+		var parents []plumbing.Hash
+		for _, p := range c.ParentHashes {
+			parents = append(parents, commitMap[p])
+		}
+		commit := object.Commit{
+			Author:       c.Author,
+			Committer:    c.Committer,
+			Message:      c.Message,
+			TreeHash:     tree,
+			ParentHashes: parents,
+		}
+		obj := b.r.Storer.NewEncodedObject()
+		if err := commit.Encode(obj); err != nil {
+			return err
+		}
+		if commitMap[c.Hash], err = b.r.Storer.SetEncodedObject(obj); err != nil {
+			return err
+		}
+	}
+
+	refs, err := b.r.References()
+	if err != nil {
+		return err
+	}
+	var updated []*plumbing.Reference
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if h, ok := commitMap[ref.Hash()]; ok && ref.Type() == plumbing.HashReference {
+			updated = append(updated, plumbing.NewHashReference(ref.Name(), h))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, ref := range updated {
+		if err := b.r.Storer.SetReference(ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type reencrypter struct {
+	b    *Backend
+	done map[plumbing.Hash]plumbing.Hash
+}
+
+func (rw *reencrypter) tree(h plumbing.Hash) (plumbing.Hash, error) {
+	if newHash, ok := rw.done[h]; ok {
+		return newHash, nil
+	}
+	t, err := rw.b.r.TreeObject(h)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	var entries []object.TreeEntry
+	for _, e := range t.Entries {
+		if e.Mode.IsFile() {
+			e.Hash, err = rw.blob(e.Hash)
+		} else {
+			e.Hash, err = rw.tree(e.Hash)
+		}
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		entries = append(entries, e)
+	}
+	newHash, err := rw.b.addTree(entries)
+	rw.done[h] = newHash
+	return newHash, err
+}
+
+func (rw *reencrypter) blob(h plumbing.Hash) (plumbing.Hash, error) {
+	if newHash, ok := rw.done[h]; ok {
+		return newHash, nil
+	}
+	b := rw.b
+	data, err := b.readBlob(h)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	data = b.encrypt(data)
+
+	// Attachments rewritten in the shared store are already there
+	newHash := plumbing.ComputeHash(plumbing.BlobObject, data)
+	if b.shared == nil || b.shared.Storer.HasEncodedObject(newHash) != nil {
+		if _, err := writeBlob(b.r, data); err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+	rw.done[h] = newHash
+	return newHash, nil
+}
+
+// ReencryptProject rewrites every trench of a project with the current key
+// of the project, then deletes the objects left behind, which may hold
+// unencrypted data. The server should not be running.
+func ReencryptProject(projectDir string) error {
+	trenches, err := ListTrenchNames(projectDir)
+	if err != nil {
+		return err
+	}
+
+	var shared *Backend
+	reachable := make(map[plumbing.Hash]bool)
+	for _, trench := range trenches {
+		b, err := NewBackend(projectDir, "admin", trench)
+		if err != nil {
+			return fmt.Errorf("Error opening trench: %w", err)
+		}
+		if err := b.Reencrypt(); err != nil {
+			return fmt.Errorf("Error encrypting '%s': %w", trench, err)
+		}
+		objects, err := b.reachableObjects()
+		if err != nil {
+			return err
+		}
+		if _, err := pruneLooseObjects(b.r, objects, time.Now()); err != nil {
+			return err
+		}
+		// Packs may still hold the old objects, repacking drops them
+		if hasPacks(b.r) {
+			if _, err := repackObjects(b.r, objects, time.Now()); err != nil {
+				return err
+			}
+		}
+		for h := range objects {
+			reachable[h] = true
+		}
+		if b.shared != nil {
+			shared = b
+		}
+	}
+
+	if shared != nil {
+		if _, err := pruneLooseObjects(shared.shared, reachable, time.Now()); err != nil {
+			return err
+		}
+		if hasPacks(shared.shared) {
+			if _, err := repackObjects(shared.shared, reachable, time.Now()); err != nil {
+				return err
+			}
+		}
+	}
+	// The search index holds the surveys too, and is rebuilt encrypted
+	return RemoveSearchIndex(projectDir)
+}
+
+func hasPacks(r *git.Repository) bool {
+	pos, ok := r.Storer.(storer.PackedObjectStorer)
+	if !ok {
+		return false
+	}
+	packs, err := pos.ObjectPacks()
+	return err == nil && len(packs) > 0
+}
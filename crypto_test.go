@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+func TestKeyring(t *testing.T) {
+	dir := t.TempDir()
+	k, err := NewKeyring()
+	assertNoError(t, err)
+
+	data := []byte("secret survey")
+	enc := k.Encrypt(data)
+	if bytes.Contains(enc, data) {
+		t.Errorf("Data is not encrypted")
+	}
+	assertEqual(t, bytes.Equal(enc, k.Encrypt(data)), true)
+	plain, err := k.Decrypt(enc)
+	assertNoError(t, err)
+	assertEqual(t, string(plain), string(data))
+	plain, err = k.Decrypt(data)
+	assertNoError(t, err)
+	assertEqual(t, string(plain), string(data))
+
+	assertNoError(t, k.Save(dir, "correct horse"))
+	if _, err := LoadKeyring(dir, "wrong horse"); err == nil {
+		t.Errorf("Expected error with wrong passphrase")
+	}
+	loaded, err := LoadKeyring(dir, "correct horse")
+	assertNoError(t, err)
+	plain, err = loaded.Decrypt(enc)
+	assertNoError(t, err)
+	assertEqual(t, string(plain), string(data))
+
+	// Old data stays readable until the old key is removed
+	assertNoError(t, loaded.AddKey())
+	assertEqual(t, bytes.Equal(loaded.Encrypt(data), enc), false)
+	_, err = loaded.Decrypt(enc)
+	assertNoError(t, err)
+	loaded.RemoveOldKeys()
+	if _, err := loaded.Decrypt(enc); err == nil {
+		t.Errorf("Expected error with removed key")
+	}
+}
+
+// assertNoPlaintext checks that no loose object of the repository holds s.
+func assertNoPlaintext(t *testing.T, b *Backend, s string) {
+	t.Helper()
+	los := b.r.Storer.(storer.LooseObjectStorer)
+	err := los.ForEachObjectHash(func(h plumbing.Hash) error {
+		data, err := readBlob(b.r, h)
+		if err == nil && strings.Contains(string(data), s) {
+			t.Errorf("Found unencrypted data in blob %s", h)
+		}
+		return nil
+	})
+	assertNoError(t, err)
+}
+
+func TestEncryptProject(t *testing.T) {
+	root := t.TempDir()
+	b, err := NewBackend(root, "test-user", "T1")
+	assertNoError(t, err)
+
+	assertNoError(t, b.WriteAttachment("a.jpg", "sum1", []byte("photo data")))
+	surveys := generateSurveys(3)
+	surveys[0]["Title"] = "Secret title"
+	surveys[0]["RelationAttachments"] = "n=a.jpg\nd=sum1"
+	v1, err := b.WriteTrench("test-dev", "", []byte("{}"), surveys[:2])
+	assertNoError(t, err)
+	_, err = b.WriteTrench("test-dev", "", []byte("{}"), surveys)
+	assertNoError(t, err)
+
+	k, err := NewKeyring()
+	assertNoError(t, err)
+	assertNoError(t, k.Save(root, "passphrase"))
+	setProjectKeyring(root, k)
+	assertNoError(t, ReencryptProject(root))
+
+	b, err = NewBackend(root, "test-user", "T1")
+	assertNoError(t, err)
+	assertNoPlaintext(t, b, "Secret title")
+	assertNoPlaintext(t, b, "photo data")
+
+	read, err := b.ReadSurveys()
+	assertNoError(t, err)
+	assertEqualSurveys(t, read, surveys)
+	data, err := b.ReadAttachment("a.jpg", "sum1")
+	assertNoError(t, err)
+	assertEqual(t, string(data), "photo data")
+
+	versions, err := b.ListVersions()
+	assertNoError(t, err)
+	assertEqual(t, len(versions), 2)
+	assertEqual(t, versions[1].Version != v1, true)
+	read, err = b.ReadSurveysAtVersion(versions[1].Version)
+	assertNoError(t, err)
+	assertEqualSurveys(t, read, surveys[:2])
+	data, err = b.ReadAttachmentAtVersion("a.jpg", "sum1", versions[1].Version)
+	assertNoError(t, err)
+	assertEqual(t, string(data), "photo data")
+
+	// Rotate the key
+	assertNoError(t, k.AddKey())
+	assertNoError(t, ReencryptProject(root))
+	k.RemoveOldKeys()
+	b, err = NewBackend(root, "test-user", "T1")
+	assertNoError(t, err)
+	read, err = b.ReadSurveys()
+	assertNoError(t, err)
+	assertEqualSurveys(t, read, surveys)
+	data, err = b.ReadAttachment("a.jpg", "sum1")
+	assertNoError(t, err)
+	assertEqual(t, string(data), "photo data")
+}
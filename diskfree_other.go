@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd || windows)
+
+package main
+
+import "fmt"
+
+func FreeDiskSpace(path string) (int64, error) {
+	return 0, fmt.Errorf("Not supported on this platform")
+}
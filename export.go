@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// PreferenceFields returns the keys of the fields defined in a Preferences
+// file, in the order they are defined. Fields are the items of any "fields"
+// array, given either as keys or as objects with a "key".
+func PreferenceFields(preferences []byte) []string {
+	var fields []string
+	seen := make(Set)
+	add := func(key string) {
+		if key != "" && !seen.Contains(key) {
+			seen.Insert(key)
+			fields = append(fields, key)
+		}
+	}
+
+	var walk func(name string, value json.RawMessage) error
+	walk = func(name string, value json.RawMessage) error {
+		var items []json.RawMessage
+		if name == "fields" && json.Unmarshal(value, &items) == nil {
+			for _, item := range items {
+				var key string
+				var field struct {
+					Key string `json:"key"`
+				}
+				if json.Unmarshal(item, &key) == nil {
+					add(key)
+				} else if json.Unmarshal(item, &field) == nil {
+					add(field.Key)
+				}
+			}
+			return nil
+		}
+
+		// Objects are read token by token to keep the order of their keys
+		dec := json.NewDecoder(bytes.NewReader(value))
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if t != json.Delim('{') && t != json.Delim('[') {
+			return nil
+		}
+		for dec.More() {
+			var key string
+			if t == json.Delim('{') {
+				k, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				key, _ = k.(string)
+			}
+			var v json.RawMessage
+			if err := dec.Decode(&v); err != nil {
+				return err
+			}
+			if err := walk(key, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// Preferences that aren't valid JSON define no fields
+	_ = walk("", preferences)
+	return fields
+}
+
+// SurveyColumns returns the keys used by surveys, ordered as in fields, then
+// the keys missing from fields in alphabetical order.
+func SurveyColumns(surveys []Survey, fields []string) []string {
+	used := make(Set)
+	for _, s := range surveys {
+		for k := range s {
+			used.Insert(k)
+		}
+	}
+
+	var columns []string
+	for _, f := range fields {
+		if used.Contains(f) {
+			columns = append(columns, f)
+			delete(used, f)
+		}
+	}
+	return append(columns, used.Array()...)
+}
+
+// FilterSurveys returns the surveys of the given types, a comma separated
+// list. All surveys are returned when types is empty.
+func FilterSurveys(surveys []Survey, types string) []Survey {
+	if types == "" {
+		return surveys
+	}
+	wanted := make(Set)
+	for _, t := range strings.Split(types, ",") {
+		wanted.Insert(strings.TrimSpace(t))
+	}
+	var filtered []Survey
+	for _, s := range surveys {
+		if wanted.Contains(s["Type"]) {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
+
+// sortSurveys sorts surveys by type and identifier, then by UUID.
+func sortSurveys(surveys []Survey) {
+	sort.SliceStable(surveys, func(i, j int) bool {
+		a, b := surveys[i], surveys[j]
+		if a["Type"] != b["Type"] {
+			return a["Type"] < b["Type"]
+		}
+		if a["Identifier"] != b["Identifier"] {
+			return a["Identifier"] < b["Identifier"]
+		}
+		return a.ID() < b.ID()
+	})
+}
+
+// WriteSurveysCSV writes one row per survey, with a header row of columns.
+// Multi-line values such as RelationAttachments are kept in a single quoted
+// cell.
+func WriteSurveysCSV(w io.Writer, surveys []Survey, columns []string) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	row := make([]string, len(columns))
+	for _, s := range surveys {
+		for i, c := range columns {
+			row[i] = s[c]
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ExportSurveys returns the surveys of a version of the trench of the given
+// types, sorted, along with the fields defined in its preferences.
+func (b *Backend) ExportSurveys(version, types string) ([]Survey, []string, error) {
+	surveys, err := b.ReadSurveysAtVersion(version)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Trenches synced without preferences still export, in alphabetical order
+	preferences, _ := b.ReadPreferencesAtVersion(version)
+	surveys = FilterSurveys(surveys, types)
+	sortSurveys(surveys)
+	return surveys, PreferenceFields(preferences), nil
+}
+
+// ExportProjectSurveys returns the surveys of a version of every trench of a
+// project, like ExportSurveys, with a Trench field when they don't have one.
+// Trenches without versions are skipped.
+func ExportProjectSurveys(projectDir, user, version, types string) ([]Survey, []string, error) {
+	trenches, err := ListTrenchNames(projectDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var surveys []Survey
+	fields := []string{"Trench"}
+	for _, trench := range trenches {
+		b, err := NewBackend(projectDir, user, trench)
+		if err != nil {
+			return nil, nil, err
+		}
+		if b.Head() == "" {
+			continue
+		}
+		s, f, err := b.ExportSurveys(version, types)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error reading '%s': %w", trench, err)
+		}
+		for _, survey := range s {
+			if survey["Trench"] == "" {
+				survey["Trench"] = trench
+			}
+		}
+		surveys = append(surveys, s...)
+		fields = append(fields, f...)
+	}
+	return surveys, fields, nil
+}
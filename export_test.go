@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strings"
+	"testing"
+)
+
+const testPreferences = `{
+	"project": "Agora",
+	"types": [
+		{"type": "Context", "fields": ["Identifier", "Type", "Title"]},
+		{"type": "Find", "groups": [{"fields": [{"key": "Material"}, {"key": "Title"}]}]}
+	],
+	"fields": [{"key": "RelationAttachments", "label": "Photos"}]
+}`
+
+func TestPreferenceFields(t *testing.T) {
+	fields := PreferenceFields([]byte(testPreferences))
+	assertEqual(t, strings.Join(fields, ","), "Identifier,Type,Title,Material,RelationAttachments")
+	assertEqual(t, len(PreferenceFields([]byte("not json"))), 0)
+	assertEqual(t, len(PreferenceFields(nil)), 0)
+
+	// Fields that aren't an array are walked like any other value
+	fields = PreferenceFields([]byte(`{
+		"fields": {"layout": {"fields": ["Phase"]}, "columns": 2},
+		"types": [{"fields": ["Identifier"]}]
+	}`))
+	assertEqual(t, strings.Join(fields, ","), "Phase,Identifier")
+}
+
+func TestExportSurveysCSV(t *testing.T) {
+	b, err := NewMemoryBackend("test-user", "T1")
+	assertNoError(t, err)
+	surveys := []Survey{
+		{"IdentifierUUID": "u1", "Identifier": "2", "Type": "Context", "Title": "Wall, north", "Zeta": "z"},
+		{"IdentifierUUID": "u2", "Identifier": "1", "Type": "Context", "Title": "Floor",
+			"RelationAttachments": "n=a.jpg\nd=sum1\nn=b.jpg\nd=sum2"},
+		{"IdentifierUUID": "u3", "Identifier": "3", "Type": "Find", "Material": "Bronze"},
+	}
+	assertNoError(t, b.WriteAttachment("a.jpg", "sum1", []byte("a")))
+	assertNoError(t, b.WriteAttachment("b.jpg", "sum2", []byte("b")))
+	version, err := b.WriteTrench("test-dev", "", []byte(testPreferences), surveys)
+	assertNoError(t, err)
+
+	exported, fields, err := b.ExportSurveys(version, "Context")
+	assertNoError(t, err)
+	columns := SurveyColumns(exported, fields)
+	assertEqual(t, strings.Join(columns, ","), "Identifier,Type,Title,RelationAttachments,IdentifierUUID,Zeta")
+
+	var buf bytes.Buffer
+	assertNoError(t, WriteSurveysCSV(&buf, exported, columns))
+	rows, err := csv.NewReader(&buf).ReadAll()
+	assertNoError(t, err)
+	assertEqual(t, len(rows), 3)
+	assertEqual(t, strings.Join(rows[1], "|"), "1|Context|Floor|n=a.jpg\nd=sum1\nn=b.jpg\nd=sum2|u2|")
+	assertEqual(t, strings.Join(rows[2], "|"), "2|Context|Wall, north||u1|z")
+
+	exported, _, err = b.ExportSurveys(version, "Find, Context")
+	assertNoError(t, err)
+	assertEqual(t, len(exported), 3)
+	assertEqual(t, exported[2].ID(), "u3")
+}
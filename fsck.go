@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/idxfile"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// FsckReport is the result of checking the integrity of a trench.
+type FsckReport struct {
+	Objects     int
+	Versions    int
+	Surveys     int // At the latest version
+	Attachments int
+	Problems    []string
+}
+
+func (r *FsckReport) problem(format string, args ...any) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// Fsck checks that every object reachable from the references of the trench
+// is present and intact, that every survey of every version is valid, and
+// that the attachments of the latest surveys are all stored.
+func (b *Backend) Fsck() (*FsckReport, error) {
+	report := &FsckReport{}
+
+	var stack []plumbing.Hash
+	refs, err := b.r.References()
+	if err != nil {
+		return nil, err
+	}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			stack = append(stack, ref.Hash())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[plumbing.Hash]bool)
+	var commits []*object.Commit
+	for len(stack) > 0 {
+		h := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+
+		obj, err := b.r.Storer.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			report.problem("Missing object %s", h)
+			continue
+		}
+		if err := verifyObject(obj); err != nil {
+			report.problem("Corrupt %s %s: %s", obj.Type(), h, err)
+			continue
+		}
+
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			c := &object.Commit{}
+			if err := c.Decode(obj); err != nil {
+				report.problem("Invalid commit %s: %s", h, err)
+				continue
+			}
+			commits = append(commits, c)
+			stack = append(stack, c.TreeHash)
+			stack = append(stack, c.ParentHashes...)
+		case plumbing.TreeObject:
+			var t object.Tree
+			if err := t.Decode(obj); err != nil {
+				report.problem("Invalid tree %s: %s", h, err)
+				continue
+			}
+			for _, e := range t.Entries {
+				if e.Mode != filemode.Submodule {
+					stack = append(stack, e.Hash)
+				}
+			}
+		case plumbing.TagObject:
+			var t object.Tag
+			if err := t.Decode(obj); err != nil {
+				report.problem("Invalid tag %s: %s", h, err)
+				continue
+			}
+			stack = append(stack, t.Target)
+		}
+	}
+	report.Objects = len(seen)
+	report.Versions = len(commits)
+
+	// Surveys of every version, each distinct blob once
+	checked := make(map[plumbing.Hash]bool)
+	for _, c := range commits {
+		rootTree, err := b.r.TreeObject(c.TreeHash)
+		if err != nil {
+			continue // Already reported
+		}
+		surveysTree, err := rootTree.Tree("surveys")
+		if err != nil {
+			if !errors.Is(err, object.ErrDirectoryNotFound) {
+				report.problem("Version %s: cannot read surveys: %s", Prefix(c.Hash.String(), 7), err)
+			}
+			continue
+		}
+		for _, e := range surveysTree.Entries {
+			if checked[e.Hash] || !e.Mode.IsFile() {
+				continue
+			}
+			checked[e.Hash] = true
+			if err := b.checkSurvey(e); err != nil {
+				report.problem("Version %s: survey %s: %s", Prefix(c.Hash.String(), 7), e.Name, err)
+			}
+		}
+	}
+
+	attachments, err := b.ListAttachments()
+	if err != nil {
+		report.problem("Cannot list attachments: %s", err)
+	}
+	report.Attachments = len(attachments)
+
+	surveys, err := b.ReadSurveys()
+	if err != nil {
+		report.problem("Cannot read latest surveys: %s", err)
+	}
+	report.Surveys = len(surveys)
+	for _, survey := range surveys {
+		for _, a := range survey.Attachments() {
+			if exists, err := b.ExistsAttachment(a.Name, a.Checksum); err != nil {
+				report.problem("Survey %s: cannot check attachment '%s' (%s): %s", survey.ID(), a.Name, a.Checksum, err)
+			} else if !exists {
+				report.problem("Survey %s: attachment '%s' (%s) is missing", survey.ID(), a.Name, a.Checksum)
+			}
+		}
+	}
+
+	sort.Strings(report.Problems)
+	return report, nil
+}
+
+// verifyObject checks that the contents of obj match its hash.
+func verifyObject(obj plumbing.EncodedObject) error {
+	rd, err := obj.Reader()
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	hasher := plumbing.NewHasher(obj.Type(), obj.Size())
+	if _, err := io.Copy(hasher, rd); err != nil {
+		return err
+	}
+	if hasher.Sum() != obj.Hash() {
+		return fmt.Errorf("hash mismatch")
+	}
+	return nil
+}
+
+func (b *Backend) checkSurvey(e object.TreeEntry) error {
+	data, err := b.readBlob(e.Hash)
+	if err != nil {
+		return err
+	}
+	var survey Survey
+	if err := json.Unmarshal(data, &survey); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	if id := survey["IdentifierUUID"]; id+".survey" != e.Name {
+		return fmt.Errorf("IdentifierUUID '%s' does not match the file name", id)
+	}
+	return nil
+}
+
+// Blobs up to this size are delta compressed when packing. Larger blobs are
+// attachments, which don't compress and are too costly to compare.
+const maxDeltaSize = 64 << 10
+
+// Maximum size of the objects in a single pack written by Repack, since the
+// pack encoder keeps them all in memory
+const maxPackSize = 256 << 20
+
+// Repack packs the objects of the trench reachable from its references, then
+// deletes their loose copies and any older packs. Objects of the shared
+// attachment store are left out, unreachable objects of packs written within
+// the PruneGracePeriod are kept. It returns the number of objects packed.
+func (b *Backend) Repack() (int, error) {
+	if b.ReadOnly {
+		return 0, fmt.Errorf("Forbidden")
+	}
+	reachable, err := b.reachableObjects()
+	if err != nil {
+		return 0, err
+	}
+	return repackObjects(b.r, reachable, time.Now().Add(-PruneGracePeriod))
+}
+
+// repackObjects packs the objects of r that are in keep, and deletes their
+// loose copies and all previous packs. The objects of packs written after
+// cutoff are packed too, as a sync may be about to reference them, while
+// unreachable objects of older packs are dropped.
+func repackObjects(r *git.Repository, keep map[plumbing.Hash]bool, cutoff time.Time) (int, error) {
+	pos, ok := r.Storer.(storer.PackedObjectStorer)
+	if !ok {
+		return 0, git.ErrPackedObjectsNotSupported
+	}
+	los, ok := r.Storer.(storer.LooseObjectStorer)
+	if !ok {
+		return 0, git.ErrLooseObjectsNotSupported
+	}
+	oldPacks, err := pos.ObjectPacks()
+	if err != nil {
+		return 0, err
+	}
+	recent, err := recentPackedObjects(r, oldPacks, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	objects := make(map[plumbing.Hash]bool, len(keep)+len(recent))
+	for h := range keep {
+		objects[h] = true
+	}
+	for h := range recent {
+		objects[h] = true
+	}
+
+	type sizedHash struct {
+		Hash plumbing.Hash
+		Size int64
+	}
+	var small []plumbing.Hash
+	var large []sizedHash
+	for h := range objects {
+		// Objects found through alternates belong to another repository
+		if r.Storer.HasEncodedObject(h) != nil {
+			continue
+		}
+		size, err := r.Storer.EncodedObjectSize(h)
+		if err != nil {
+			return 0, err
+		}
+		if size <= maxDeltaSize {
+			small = append(small, h)
+		} else {
+			large = append(large, sizedHash{h, size})
+		}
+	}
+
+	// Packs to write, each with its delta window
+	type pack struct {
+		Hashes []plumbing.Hash
+		Window uint
+	}
+	packs := []pack{{small, 10}}
+	var batch pack
+	var batchSize int64
+	for _, o := range large {
+		if batchSize+o.Size > maxPackSize && len(batch.Hashes) > 0 {
+			packs = append(packs, batch)
+			batch, batchSize = pack{}, 0
+		}
+		batch.Hashes = append(batch.Hashes, o.Hash)
+		batchSize += o.Size
+	}
+	packs = append(packs, batch)
+
+	newPacks := make(map[plumbing.Hash]bool)
+	for _, p := range packs {
+		if len(p.Hashes) == 0 {
+			continue
+		}
+		h, err := writePack(r, p.Hashes, p.Window)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to write pack: %w", err)
+		}
+		newPacks[h] = true
+	}
+
+	var packed []plumbing.Hash
+	err = los.ForEachObjectHash(func(h plumbing.Hash) error {
+		if keep[h] {
+			packed = append(packed, h)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, h := range packed {
+		if err := los.DeleteLooseObject(h); err != nil {
+			return 0, err
+		}
+	}
+	for _, h := range oldPacks {
+		if !newPacks[h] {
+			if err := pos.DeleteOldObjectPackAndIndex(h, time.Time{}); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(small) + len(large), nil
+}
+
+// recentPackedObjects returns the objects of the packs of r written after
+// cutoff.
+func recentPackedObjects(r *git.Repository, packs []plumbing.Hash, cutoff time.Time) (map[plumbing.Hash]bool, error) {
+	objects := make(map[plumbing.Hash]bool)
+	st, ok := r.Storer.(*filesystem.Storage)
+	if !ok {
+		return objects, nil
+	}
+	fs := st.Filesystem()
+	for _, h := range packs {
+		fi, err := fs.Stat(fs.Join("objects", "pack", "pack-"+h.String()+".pack"))
+		if err != nil {
+			return nil, err
+		}
+		if fi.ModTime().Before(cutoff) {
+			continue
+		}
+
+		f, err := fs.Open(fs.Join("objects", "pack", "pack-"+h.String()+".idx"))
+		if err != nil {
+			return nil, err
+		}
+		idx := idxfile.NewMemoryIndex()
+		err = idxfile.NewDecoder(f).Decode(idx)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		entries, err := idx.Entries()
+		if err != nil {
+			return nil, err
+		}
+		for {
+			e, err := entries.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				entries.Close()
+				return nil, err
+			}
+			objects[e.Hash] = true
+		}
+		entries.Close()
+	}
+	return objects, nil
+}
+
+func writePack(r *git.Repository, hashes []plumbing.Hash, window uint) (plumbing.Hash, error) {
+	pfw, ok := r.Storer.(storer.PackfileWriter)
+	if !ok {
+		return plumbing.ZeroHash, git.ErrPackedObjectsNotSupported
+	}
+	w, err := pfw.PackfileWriter()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	enc := packfile.NewEncoder(w, r.Storer, false)
+	h, err := enc.Encode(hashes, window)
+	if err1 := w.Close(); err == nil {
+		err = err1
+	}
+	return h, err
+}
+
+// RepackSharedStore packs the objects of the shared attachment store of a
+// project that are used by any of its trenches. It returns the number of
+// objects packed.
+func RepackSharedStore(projectDir string) (int, error) {
+	trenches, err := ListTrenchNames(projectDir)
+	if err != nil {
+		return 0, err
+	}
+
+	var shared *git.Repository
+	keep := make(map[plumbing.Hash]bool)
+	for _, trench := range trenches {
+		b, err := NewBackend(projectDir, "admin", trench)
+		if err != nil {
+			return 0, err
+		}
+		objects, err := b.reachableObjects()
+		if err != nil {
+			return 0, fmt.Errorf("Error reading '%s': %w", trench, err)
+		}
+		for h := range objects {
+			keep[h] = true
+		}
+		if b.shared != nil {
+			shared = b.shared
+		}
+	}
+	if shared == nil {
+		return 0, nil
+	}
+	return repackObjects(shared, keep, time.Now().Add(-PruneGracePeriod))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+func newFsckTrench(t *testing.T) (*Backend, []Survey) {
+	b, err := NewBackend(t.TempDir(), "test-user", "T1")
+	assertNoError(t, err)
+	assertNoError(t, b.WriteAttachment("a.jpg", "sum1", []byte("photo data")))
+	surveys := generateSurveys(5)
+	surveys[0]["RelationAttachments"] = "n=a.jpg\nd=sum1"
+	_, err = b.WriteTrench("test-dev", "", []byte("{}"), surveys[:3])
+	assertNoError(t, err)
+	_, err = b.WriteTrench("test-dev", "", []byte("{}"), surveys)
+	assertNoError(t, err)
+	return b, surveys
+}
+
+func countLooseObjects(t *testing.T, b *Backend) int {
+	n := 0
+	los := b.r.Storer.(storer.LooseObjectStorer)
+	assertNoError(t, los.ForEachObjectHash(func(plumbing.Hash) error {
+		n++
+		return nil
+	}))
+	return n
+}
+
+func TestFsck(t *testing.T) {
+	b, surveys := newFsckTrench(t)
+	report, err := b.Fsck()
+	assertNoError(t, err)
+	assertEqual(t, len(report.Problems), 0)
+	assertEqual(t, report.Versions, 2)
+	assertEqual(t, report.Surveys, 5)
+	assertEqual(t, report.Attachments, 1)
+
+	// Lose the attachment
+	assertNoError(t, b.store.Delete("a.jpg", "sum1"))
+	report, err = b.Fsck()
+	assertNoError(t, err)
+	assertEqual(t, strings.Join(report.Problems, "\n"),
+		"Survey "+surveys[0].ID()+": attachment 'a.jpg' (sum1) is missing")
+
+	// Lose a survey blob
+	h := mustSurveyBlob(t, b, surveys[4].ID())
+	s := h.String()
+	objectFile := filepath.Join(b.dir, "T1", "objects", s[:2], s[2:])
+	assertNoError(t, os.Remove(objectFile))
+	b, err = NewBackend(b.dir, "test-user", "T1")
+	assertNoError(t, err)
+	report, err = b.Fsck()
+	assertNoError(t, err)
+	problems := strings.Join(report.Problems, "\n")
+	if !strings.Contains(problems, "Missing object "+s) {
+		t.Errorf("Missing object not reported: %s", problems)
+	}
+}
+
+func mustSurveyBlob(t *testing.T, b *Backend, id string) plumbing.Hash {
+	t.Helper()
+	commit, err := b.r.CommitObject(plumbing.NewHash(b.Head()))
+	assertNoError(t, err)
+	tree, err := commit.Tree()
+	assertNoError(t, err)
+	entry, err := tree.FindEntry("surveys/" + id + ".survey")
+	assertNoError(t, err)
+	return entry.Hash
+}
+
+func TestRepack(t *testing.T) {
+	b, surveys := newFsckTrench(t)
+	unreachable, err := writeBlob(b.r, []byte("upload in progress"))
+	assertNoError(t, err)
+
+	n, err := b.Repack()
+	assertNoError(t, err)
+	if n == 0 {
+		t.Errorf("No objects packed")
+	}
+	assertEqual(t, countLooseObjects(t, b), 1)
+	assertEqual(t, hasPacks(b.r), true)
+
+	// Repacking again replaces the previous packs
+	_, err = b.Repack()
+	assertNoError(t, err)
+	packs, err := b.r.Storer.(storer.PackedObjectStorer).ObjectPacks()
+	assertNoError(t, err)
+	assertEqual(t, len(packs), 1)
+
+	b, err = NewBackend(b.dir, "test-user", "T1")
+	assertNoError(t, err)
+	assertNoError(t, b.r.Storer.HasEncodedObject(unreachable))
+	read, err := b.ReadSurveys()
+	assertNoError(t, err)
+	assertEqualSurveys(t, read, surveys)
+	data, err := b.ReadAttachment("a.jpg", "sum1")
+	assertNoError(t, err)
+	assertEqual(t, string(data), "photo data")
+	report, err := b.Fsck()
+	assertNoError(t, err)
+	assertEqual(t, len(report.Problems), 0)
+}
+
+func TestRepackGracePeriod(t *testing.T) {
+	b, _ := newFsckTrench(t)
+	_, err := b.Repack()
+	assertNoError(t, err)
+
+	// A blob packed by a sync that has not updated its references yet
+	recent, err := writeBlob(b.r, []byte("upload in progress"))
+	assertNoError(t, err)
+	_, err = writePack(b.r, []plumbing.Hash{recent}, 10)
+	assertNoError(t, err)
+	assertNoError(t, b.r.Storer.(storer.LooseObjectStorer).DeleteLooseObject(recent))
+
+	_, err = b.Repack()
+	assertNoError(t, err)
+	b, err = NewBackend(b.dir, "test-user", "T1")
+	assertNoError(t, err)
+	assertNoError(t, b.r.Storer.HasEncodedObject(recent))
+
+	// Once the pack holding it is old, the blob goes
+	packDir := filepath.Join(b.r.Storer.(*filesystem.Storage).Filesystem().Root(), "objects", "pack")
+	files, err := os.ReadDir(packDir)
+	assertNoError(t, err)
+	old := time.Now().Add(-2 * PruneGracePeriod)
+	for _, f := range files {
+		assertNoError(t, os.Chtimes(filepath.Join(packDir, f.Name()), old, old))
+	}
+	_, err = b.Repack()
+	assertNoError(t, err)
+	b, err = NewBackend(b.dir, "test-user", "T1")
+	assertNoError(t, err)
+	if b.r.Storer.HasEncodedObject(recent) == nil {
+		t.Error("Expected the unreachable blob of an old pack to be dropped")
+	}
+}
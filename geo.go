@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Order of the numbers of coordinates written as plain lists
+const (
+	OrderLatLon = "latlon"
+	OrderLonLat = "lonlat" // Also x y for local grids
+)
+
+// Survey fields holding geometry, when not configured
+var DefaultGeometryFields = []string{"Coordinates"}
+
+// Position is a longitude, latitude and optional elevation, or x, y and z.
+type Position []float64
+
+// Geometry is a Point, LineString or Polygon. Points and lines have a single
+// ring, polygons have their outer ring first, followed by any holes.
+type Geometry struct {
+	Type  string
+	Rings [][]Position
+}
+
+func (g *Geometry) MarshalJSON() ([]byte, error) {
+	var coordinates any
+	switch g.Type {
+	case "Point":
+		coordinates = g.Rings[0][0]
+	case "LineString":
+		coordinates = g.Rings[0]
+	default:
+		coordinates = g.Rings
+	}
+	return json.Marshal(map[string]any{"type": g.Type, "coordinates": coordinates})
+}
+
+// ParseGeometry parses the value of a geometry field, either as WKT, e.g.
+// POINT (23.72 37.97), or as a list of positions separated by new lines or
+// semicolons, with their numbers separated by commas or spaces in the given
+// order. A list with a single position is a Point, a closed list of at least
+// four positions is a Polygon, and any other list is a LineString.
+func ParseGeometry(s, order string) (*Geometry, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	if unicode.IsLetter(rune(s[0])) {
+		return parseWKT(s)
+	}
+
+	var ring []Position
+	for _, p := range strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == ';' }) {
+		if strings.TrimSpace(p) == "" {
+			continue
+		}
+		pos, err := parsePosition(p, ", \t\r")
+		if err != nil {
+			return nil, err
+		}
+		if order != OrderLonLat {
+			pos[0], pos[1] = pos[1], pos[0]
+		}
+		ring = append(ring, pos)
+	}
+
+	g := &Geometry{Rings: [][]Position{ring}}
+	switch {
+	case len(ring) == 1:
+		g.Type = "Point"
+	case len(ring) >= 4 && equalPositions(ring[0], ring[len(ring)-1]):
+		g.Type = "Polygon"
+	default:
+		g.Type = "LineString"
+	}
+	return g, nil
+}
+
+func parsePosition(s, separators string) (Position, error) {
+	var pos Position
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return strings.ContainsRune(separators, r) }) {
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid coordinate '%s'", f)
+		}
+		pos = append(pos, v)
+	}
+	if len(pos) < 2 || len(pos) > 3 {
+		return nil, fmt.Errorf("Invalid position '%s'", strings.TrimSpace(s))
+	}
+	return pos, nil
+}
+
+func equalPositions(a, b Position) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// parseWKT parses a POINT, LINESTRING or POLYGON in Well-Known Text.
+func parseWKT(s string) (*Geometry, error) {
+	open := strings.IndexByte(s, '(')
+	if open < 0 || !strings.HasSuffix(s, ")") {
+		return nil, fmt.Errorf("Invalid geometry '%s'", s)
+	}
+	kind := strings.ToUpper(strings.TrimSpace(s[:open]))
+	kind = strings.TrimSuffix(strings.TrimSuffix(kind, " Z"), "Z")
+	body := strings.TrimSpace(s[open+1 : len(s)-1])
+
+	ring := func(s string) ([]Position, error) {
+		var positions []Position
+		for _, p := range strings.Split(s, ",") {
+			pos, err := parsePosition(p, " \t\r\n")
+			if err != nil {
+				return nil, err
+			}
+			positions = append(positions, pos)
+		}
+		return positions, nil
+	}
+
+	g := &Geometry{}
+	switch kind {
+	case "POINT", "LINESTRING":
+		r, err := ring(body)
+		if err != nil {
+			return nil, err
+		}
+		if kind == "POINT" && len(r) != 1 {
+			return nil, fmt.Errorf("Invalid point '%s'", s)
+		}
+		g.Type = map[string]string{"POINT": "Point", "LINESTRING": "LineString"}[kind]
+		g.Rings = [][]Position{r}
+	case "POLYGON":
+		g.Type = "Polygon"
+		for _, part := range strings.Split(body, ")") {
+			part = strings.Trim(strings.TrimSpace(part), ",( \t\r\n")
+			if part == "" {
+				continue
+			}
+			r, err := ring(part)
+			if err != nil {
+				return nil, err
+			}
+			g.Rings = append(g.Rings, r)
+		}
+		if len(g.Rings) == 0 {
+			return nil, fmt.Errorf("Invalid polygon '%s'", s)
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported geometry '%s'", kind)
+	}
+	return g, nil
+}
+
+// Feature is a survey with a geometry.
+type Feature struct {
+	Survey   Survey
+	Geometry *Geometry
+}
+
+// SurveyFeatures returns the surveys with a geometry in one of the geometry
+// fields of the project, along with the problems found parsing the others.
+func SurveyFeatures(surveys []Survey, cfg *GeometryConfig) ([]Feature, []string) {
+	fields, order := DefaultGeometryFields, OrderLatLon
+	if cfg != nil && len(cfg.Fields) > 0 {
+		fields = cfg.Fields
+	}
+	if cfg != nil && cfg.Order != "" {
+		order = cfg.Order
+	}
+
+	var features []Feature
+	var problems []string
+	for _, s := range surveys {
+		for _, field := range fields {
+			g, err := ParseGeometry(s[field], order)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("Survey %s: %s: %s", s.ID(), field, err))
+				continue
+			}
+			if g != nil {
+				features = append(features, Feature{Survey: s, Geometry: g})
+				break
+			}
+		}
+	}
+	return features, problems
+}
+
+// WriteGeoJSON writes features as a GeoJSON FeatureCollection, with the
+// fields of their surveys as properties.
+func WriteGeoJSON(w io.Writer, features []Feature) error {
+	type geoJSONFeature struct {
+		Type       string    `json:"type"`
+		ID         string    `json:"id"`
+		Geometry   *Geometry `json:"geometry"`
+		Properties Survey    `json:"properties"`
+	}
+	collection := struct {
+		Type     string           `json:"type"`
+		Features []geoJSONFeature `json:"features"`
+	}{Type: "FeatureCollection", Features: []geoJSONFeature{}}
+	for _, f := range features {
+		collection.Features = append(collection.Features, geoJSONFeature{
+			Type:       "Feature",
+			ID:         f.Survey.ID(),
+			Geometry:   f.Geometry,
+			Properties: f.Survey,
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	return enc.Encode(collection)
+}
+
+// WriteKML writes features as KML placemarks named after their surveys, with
+// the fields of the surveys as extended data.
+func WriteKML(w io.Writer, name string, features []Feature) error {
+	type data struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:"value"`
+	}
+	type coordinates struct {
+		Coordinates string `xml:"coordinates"`
+	}
+	type boundary struct {
+		LinearRing coordinates `xml:"LinearRing"`
+	}
+	type polygon struct {
+		Outer boundary   `xml:"outerBoundaryIs"`
+		Inner []boundary `xml:"innerBoundaryIs"`
+	}
+	type placemark struct {
+		ID           string       `xml:"id,attr"`
+		Name         string       `xml:"name"`
+		Description  string       `xml:"description,omitempty"`
+		ExtendedData []data       `xml:"ExtendedData>Data"`
+		Point        *coordinates `xml:"Point"`
+		LineString   *coordinates `xml:"LineString"`
+		Polygon      *polygon     `xml:"Polygon"`
+	}
+	doc := struct {
+		XMLName    xml.Name    `xml:"http://www.opengis.net/kml/2.2 kml"`
+		Name       string      `xml:"Document>name"`
+		Placemarks []placemark `xml:"Document>Placemark"`
+	}{Name: name}
+
+	kmlCoordinates := func(ring []Position) coordinates {
+		var points []string
+		for _, p := range ring {
+			var numbers []string
+			for _, v := range p {
+				numbers = append(numbers, strconv.FormatFloat(v, 'f', -1, 64))
+			}
+			points = append(points, strings.Join(numbers, ","))
+		}
+		return coordinates{strings.Join(points, " ")}
+	}
+
+	for _, f := range features {
+		s := f.Survey
+		pm := placemark{ID: s.ID(), Name: s["Identifier"], Description: s["Title"]}
+		if pm.Name == "" {
+			pm.Name = s.ID()
+		}
+		for _, k := range s.Keys().Array() {
+			pm.ExtendedData = append(pm.ExtendedData, data{Name: k, Value: s[k]})
+		}
+		g := f.Geometry
+		switch g.Type {
+		case "Point":
+			c := kmlCoordinates(g.Rings[0][:1])
+			pm.Point = &c
+		case "LineString":
+			c := kmlCoordinates(g.Rings[0])
+			pm.LineString = &c
+		case "Polygon":
+			pm.Polygon = &polygon{Outer: boundary{kmlCoordinates(g.Rings[0])}}
+			for _, hole := range g.Rings[1:] {
+				pm.Polygon.Inner = append(pm.Polygon.Inner, boundary{kmlCoordinates(hole)})
+			}
+		}
+		doc.Placemarks = append(doc.Placemarks, pm)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", " ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
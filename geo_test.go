@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseGeometry(t *testing.T) {
+	tests := []struct {
+		value, order string
+		want         string
+	}{
+		{"37.97, 23.72", "", `{"coordinates":[23.72,37.97],"type":"Point"}`},
+		{"37.97 23.72 80.5", OrderLatLon, `{"coordinates":[23.72,37.97,80.5],"type":"Point"}`},
+		{"1000, 2000", OrderLonLat, `{"coordinates":[1000,2000],"type":"Point"}`},
+		{"0,0\n1,1; 2,2", OrderLonLat, `{"coordinates":[[0,0],[1,1],[2,2]],"type":"LineString"}`},
+		{"0,0;1,0;1,1;0,0", OrderLonLat, `{"coordinates":[[[0,0],[1,0],[1,1],[0,0]]],"type":"Polygon"}`},
+		{"POINT (23.72 37.97)", OrderLatLon, `{"coordinates":[23.72,37.97],"type":"Point"}`},
+		{"POINT Z (1 2 3)", "", `{"coordinates":[1,2,3],"type":"Point"}`},
+		{"linestring(0 0, 1 1)", "", `{"coordinates":[[0,0],[1,1]],"type":"LineString"}`},
+		{"POLYGON ((0 0, 4 0, 4 4, 0 0), (1 1, 2 1, 2 2, 1 1))", "",
+			`{"coordinates":[[[0,0],[4,0],[4,4],[0,0]],[[1,1],[2,1],[2,2],[1,1]]],"type":"Polygon"}`},
+	}
+	for _, test := range tests {
+		g, err := ParseGeometry(test.value, test.order)
+		assertNoError(t, err)
+		data, err := json.Marshal(g)
+		assertNoError(t, err)
+		assertEqual(t, string(data), test.want)
+	}
+
+	g, err := ParseGeometry("  ", "")
+	assertNoError(t, err)
+	assertEqual(t, g == nil, true)
+
+	for _, value := range []string{"37.97", "a, b", "1,2,3,4", "POINT (1 2", "POINT (1 2, 3 4)", "CIRCLE (1 2)"} {
+		if _, err := ParseGeometry(value, ""); err == nil {
+			t.Errorf("Expected an error parsing '%s'", value)
+		}
+	}
+}
+
+func TestSurveyFeatures(t *testing.T) {
+	surveys := []Survey{
+		{"IdentifierUUID": "u1", "Identifier": "1", "Location": "37.97, 23.72"},
+		{"IdentifierUUID": "u2", "Identifier": "2", "Outline": "POLYGON ((0 0, 1 0, 1 1, 0 0))", "Location": "oops"},
+		{"IdentifierUUID": "u3", "Identifier": "3"},
+	}
+	cfg := &GeometryConfig{Fields: []string{"Location", "Outline"}}
+	features, problems := SurveyFeatures(surveys, cfg)
+	assertEqual(t, len(features), 2)
+	assertEqual(t, features[0].Geometry.Type, "Point")
+	assertEqual(t, features[1].Geometry.Type, "Polygon")
+	assertEqual(t, len(problems), 1)
+	assertEqual(t, strings.HasPrefix(problems[0], "Survey u2: Location:"), true)
+
+	features, _ = SurveyFeatures(surveys, nil)
+	assertEqual(t, len(features), 0)
+
+	var buf bytes.Buffer
+	features, _ = SurveyFeatures(surveys, cfg)
+	assertNoError(t, WriteGeoJSON(&buf, features))
+	var collection struct {
+		Type     string
+		Features []struct {
+			Type       string
+			ID         string
+			Geometry   struct{ Type string }
+			Properties map[string]string
+		}
+	}
+	assertNoError(t, json.Unmarshal(buf.Bytes(), &collection))
+	assertEqual(t, collection.Type, "FeatureCollection")
+	assertEqual(t, len(collection.Features), 2)
+	assertEqual(t, collection.Features[0].ID, "u1")
+	assertEqual(t, collection.Features[0].Geometry.Type, "Point")
+	assertEqual(t, collection.Features[1].Properties["Identifier"], "2")
+
+	buf.Reset()
+	assertNoError(t, WriteKML(&buf, "Agora", features))
+	kml := buf.String()
+	for _, s := range []string{
+		`<kml xmlns="http://www.opengis.net/kml/2.2">`,
+		`<Placemark id="u1">`,
+		`<coordinates>23.72,37.97</coordinates>`,
+		`<coordinates>0,0 1,0 1,1 0,0</coordinates>`,
+		`<Data name="Identifier">`,
+	} {
+		if !strings.Contains(kml, s) {
+			t.Errorf("KML is missing %s", s)
+		}
+	}
+	assertEqual(t, strings.Count(kml, "<Placemark"), 2)
+	assertEqual(t, strings.Count(kml, "<Polygon>"), 1)
+}
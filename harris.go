@@ -0,0 +1,487 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Relations used when a project doesn't configure its stratigraphy
+var (
+	DefaultSequenceRelations = []RelationPair{
+		{Later: "Above", Earlier: "Below"},
+		{Later: "Cuts", Earlier: "CutBy"},
+		{Later: "Covers", Earlier: "CoveredBy"},
+		{Later: "Fills", Earlier: "FilledBy"},
+		{Later: "Abuts", Earlier: "AbuttedBy"},
+	}
+	DefaultSameRelations = []string{"SameAs", "Equals"}
+)
+
+// sequence returns the pair of a relation ordering units, and whether the
+// relation makes a survey later than its target.
+func (cfg *StratigraphyConfig) sequence(name string) (RelationPair, bool, bool) {
+	pairs := DefaultSequenceRelations
+	if cfg != nil && len(cfg.Sequence) > 0 {
+		pairs = cfg.Sequence
+	}
+	for _, p := range pairs {
+		if name == p.Later {
+			return p, true, true
+		}
+		if name == p.Earlier {
+			return p, false, true
+		}
+	}
+	return RelationPair{}, false, false
+}
+
+func (cfg *StratigraphyConfig) same(name string) bool {
+	same := DefaultSameRelations
+	if cfg != nil && len(cfg.Same) > 0 {
+		same = cfg.Same
+	}
+	return slices.Contains(same, name)
+}
+
+// reciprocal returns the relation recorded on the target of a stratigraphic
+// relation, e.g. Below for Above, or SameAs for SameAs.
+func (cfg *StratigraphyConfig) reciprocal(name string) (string, bool) {
+	if pair, later, ok := cfg.sequence(name); ok && later {
+		return pair.Earlier, true
+	} else if ok {
+		return pair.Later, true
+	}
+	return name, cfg.same(name)
+}
+
+// HarrisMatrix is the graph of the stratigraphic sequence of surveys. Each
+// node is a unit, made of the surveys related as the same unit, and each
+// edge goes from a later unit down to an earlier one.
+type HarrisMatrix struct {
+	Nodes   []HarrisNode `json:"nodes"`
+	Edges   []HarrisEdge `json:"edges"`
+	Removed int          `json:"removed"` // Edges implied by others, left out
+}
+
+type HarrisNode struct {
+	ID      string   `json:"id"` // Of the first survey of the unit
+	Trench  string   `json:"trench"`
+	Label   string   `json:"label"`   // Identifiers of the surveys, e.g. 12 = 14
+	Surveys []string `json:"surveys"` // IDs of the surveys of the unit
+	Level   int      `json:"level"`   // Length of the longest path from the top
+}
+
+type HarrisEdge struct {
+	From      string   `json:"from"`      // Later unit
+	To        string   `json:"to"`        // Earlier unit
+	Relations []string `json:"relations"` // Recorded between the units, by their later name
+}
+
+// surveyUnits resolves relation targets, which are identifiers of surveys
+// of the same trench. Surveys belong to the trench in their Trench field,
+// or to trench.
+type surveyUnits struct {
+	trench  string
+	surveys []Survey
+	ids     map[[2]string]int // Index of surveys by trench and identifier
+}
+
+func newSurveyUnits(surveys []Survey, trench string) *surveyUnits {
+	u := &surveyUnits{trench: trench, surveys: surveys, ids: make(map[[2]string]int)}
+	for i, s := range surveys {
+		key := [2]string{u.trenchOf(s), s["Identifier"]}
+		if _, ok := u.ids[key]; !ok && s.ID() != "" && s["Identifier"] != "" {
+			u.ids[key] = i
+		}
+	}
+	return u
+}
+
+func (u *surveyUnits) trenchOf(s Survey) string {
+	if s["Trench"] != "" {
+		return s["Trench"]
+	}
+	return u.trench
+}
+
+// target returns the index of the survey a relation of survey i points to.
+func (u *surveyUnits) target(i int, r Relation) (int, bool) {
+	j, ok := u.ids[[2]string{u.trenchOf(u.surveys[i]), r.Target}]
+	return j, ok
+}
+
+// BuildHarrisMatrix returns the Harris matrix of the surveys, keeping only
+// the surveys with stratigraphic relations. Relations to unknown
+// identifiers are left out, and so are the edges implied by others, i.e.
+// the matrix is the transitive reduction of the sequence. Units in a cycle
+// keep all their edges and share a level.
+func BuildHarrisMatrix(surveys []Survey, trench string, cfg *StratigraphyConfig) *HarrisMatrix {
+	u := newSurveyUnits(surveys, trench)
+
+	// Join the parts of the same unit
+	units := newUnionFind(len(surveys))
+
+	type sequenceEdge struct {
+		from, to int
+		name     string
+	}
+	var sequence []sequenceEdge
+	related := make(map[int]bool)
+	for i, s := range surveys {
+		if s.ID() == "" {
+			continue
+		}
+		for _, r := range s.Relations() {
+			j, ok := u.target(i, r)
+			if !ok {
+				continue
+			}
+			if cfg.same(r.Name) {
+				related[i], related[j] = true, true
+				units.union(i, j)
+			} else if pair, later, ok := cfg.sequence(r.Name); ok {
+				related[i], related[j] = true, true
+				if later {
+					sequence = append(sequence, sequenceEdge{i, j, pair.Later})
+				} else {
+					sequence = append(sequence, sequenceEdge{j, i, pair.Later})
+				}
+			}
+		}
+	}
+
+	// One node per unit
+	m := &HarrisMatrix{Nodes: []HarrisNode{}, Edges: []HarrisEdge{}}
+	nodeOf := make(map[int]int)
+	var members [][]int
+	for i := range surveys {
+		if !related[i] {
+			continue
+		}
+		root := units.find(i)
+		n, ok := nodeOf[root]
+		if !ok {
+			n = len(members)
+			nodeOf[root] = n
+			members = append(members, nil)
+		}
+		members[n] = append(members[n], i)
+	}
+	for _, unit := range members {
+		sort.Slice(unit, func(a, b int) bool {
+			return surveys[unit[a]].ID() < surveys[unit[b]].ID()
+		})
+		node := HarrisNode{ID: surveys[unit[0]].ID(), Trench: u.trenchOf(surveys[unit[0]])}
+		var labels []string
+		for _, i := range unit {
+			node.Surveys = append(node.Surveys, surveys[i].ID())
+			labels = append(labels, surveys[i]["Identifier"])
+		}
+		sort.Strings(labels)
+		node.Label = strings.Join(labels, " = ")
+		m.Nodes = append(m.Nodes, node)
+	}
+
+	edges := make(map[[2]int]Set)
+	succ := make([][]int, len(m.Nodes))
+	for _, e := range sequence {
+		from, to := nodeOf[units.find(e.from)], nodeOf[units.find(e.to)]
+		if from == to {
+			continue
+		}
+		key := [2]int{from, to}
+		if edges[key] == nil {
+			edges[key] = make(Set)
+			succ[from] = append(succ[from], to)
+		}
+		edges[key].Insert(e.name)
+	}
+
+	// Reduce the graph of the strongly connected components, which is
+	// acyclic, and keep the edges inside components as they are
+	comp, comps := stronglyConnected(succ)
+	compSucc := make([][]int, len(comps))
+	for from, next := range succ {
+		for _, to := range next {
+			if c, d := comp[from], comp[to]; c != d && !slices.Contains(compSucc[c], d) {
+				compSucc[c] = append(compSucc[c], d)
+			}
+		}
+	}
+	// Components come in reverse topological order, from the bottom
+	reach := make([]bitset, len(comps))
+	for c := range comps {
+		reach[c] = newBitset(len(comps))
+		for _, d := range compSucc[c] {
+			reach[c].set(d)
+			reach[c].union(reach[d])
+		}
+	}
+	implied := func(c, d int) bool {
+		for _, e := range compSucc[c] {
+			if e != d && reach[e].has(d) {
+				return true
+			}
+		}
+		return false
+	}
+	level := make([]int, len(comps))
+	for c := len(comps) - 1; c >= 0; c-- {
+		for _, d := range compSucc[c] {
+			level[d] = max(level[d], level[c]+1)
+		}
+	}
+	for n := range m.Nodes {
+		m.Nodes[n].Level = level[comp[n]]
+	}
+
+	for key, names := range edges {
+		from, to := key[0], key[1]
+		if comp[from] != comp[to] && implied(comp[from], comp[to]) {
+			m.Removed++
+			continue
+		}
+		m.Edges = append(m.Edges, HarrisEdge{From: m.Nodes[from].ID, To: m.Nodes[to].ID, Relations: names.Array()})
+	}
+
+	sort.Slice(m.Nodes, func(i, j int) bool {
+		a, b := m.Nodes[i], m.Nodes[j]
+		if a.Trench != b.Trench {
+			return a.Trench < b.Trench
+		}
+		if a.Level != b.Level {
+			return a.Level < b.Level
+		}
+		if a.Label != b.Label {
+			return a.Label < b.Label
+		}
+		return a.ID < b.ID
+	})
+	order := make(map[string]int)
+	for i, n := range m.Nodes {
+		order[n.ID] = i
+	}
+	sort.Slice(m.Edges, func(i, j int) bool {
+		a, b := m.Edges[i], m.Edges[j]
+		if a.From != b.From {
+			return order[a.From] < order[b.From]
+		}
+		return order[a.To] < order[b.To]
+	})
+	return m
+}
+
+// unionFind groups indexes into disjoint sets.
+type unionFind []int
+
+func newUnionFind(n int) unionFind {
+	u := make(unionFind, n)
+	for i := range u {
+		u[i] = i
+	}
+	return u
+}
+
+// find returns the index representing the set of i.
+func (u unionFind) find(i int) int {
+	if u[i] != i {
+		u[i] = u.find(u[i])
+	}
+	return u[i]
+}
+
+func (u unionFind) union(i, j int) {
+	u[u.find(i)] = u.find(j)
+}
+
+// stronglyConnected returns the component of each node of a graph given by
+// the successors of its nodes, and the nodes of each component, in reverse
+// topological order (Tarjan's algorithm).
+func stronglyConnected(succ [][]int) ([]int, [][]int) {
+	index := make([]int, len(succ))
+	low := make([]int, len(succ))
+	onStack := make([]bool, len(succ))
+	comp := make([]int, len(succ))
+	var stack []int
+	var comps [][]int
+	next := 1
+
+	var visit func(v int)
+	visit = func(v int) {
+		index[v], low[v] = next, next
+		next++
+		stack = append(stack, v)
+		onStack[v] = true
+		for _, w := range succ[v] {
+			if index[w] == 0 {
+				visit(w)
+				low[v] = min(low[v], low[w])
+			} else if onStack[w] {
+				low[v] = min(low[v], index[w])
+			}
+		}
+		if low[v] == index[v] {
+			var nodes []int
+			for {
+				w := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[w] = false
+				comp[w] = len(comps)
+				nodes = append(nodes, w)
+				if w == v {
+					break
+				}
+			}
+			comps = append(comps, nodes)
+		}
+	}
+	for v := range succ {
+		if index[v] == 0 {
+			visit(v)
+		}
+	}
+	return comp, comps
+}
+
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) set(i int) {
+	b[i/64] |= 1 << (i % 64)
+}
+
+func (b bitset) has(i int) bool {
+	return b[i/64]&(1<<(i%64)) != 0
+}
+
+func (b bitset) union(o bitset) {
+	for i := range b {
+		b[i] |= o[i]
+	}
+}
+
+// WriteJSON writes the matrix as indented JSON.
+func (m *HarrisMatrix) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	return enc.Encode(m)
+}
+
+// WriteDOT writes the matrix in the DOT language of Graphviz, with a
+// cluster per trench when there are several.
+func (m *HarrisMatrix) WriteDOT(w io.Writer, name string) error {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "digraph %s {\n", dotQuote(name))
+	buf.WriteString("  node [shape=box];\n")
+	trenches := make(Set)
+	for _, n := range m.Nodes {
+		trenches.Insert(n.Trench)
+	}
+	for i, n := range m.Nodes {
+		indent := "  "
+		if len(trenches) > 1 {
+			indent = "    "
+			if i == 0 || m.Nodes[i-1].Trench != n.Trench {
+				fmt.Fprintf(&buf, "  subgraph %s {\n", dotQuote("cluster_"+n.Trench))
+				fmt.Fprintf(&buf, "    label=%s;\n", dotQuote(n.Trench))
+			}
+		}
+		fmt.Fprintf(&buf, "%s%s [label=%s];\n", indent, dotQuote(n.ID), dotQuote(n.Label))
+		if len(trenches) > 1 && (i == len(m.Nodes)-1 || m.Nodes[i+1].Trench != n.Trench) {
+			buf.WriteString("  }\n")
+		}
+	}
+	for _, e := range m.Edges {
+		fmt.Fprintf(&buf, "  %s -> %s;\n", dotQuote(e.From), dotQuote(e.To))
+	}
+	buf.WriteString("}\n")
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+func dotQuote(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\r", "", "\n", `\n`).Replace(s)
+	return `"` + s + `"`
+}
+
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   struct {
+		ID          string        `xml:"id,attr"`
+		EdgeDefault string        `xml:"edgedefault,attr"`
+		Nodes       []graphMLNode `xml:"node"`
+		Edges       []graphMLEdge `xml:"edge"`
+	} `xml:"graph"`
+}
+
+type graphMLKey struct {
+	ID   string `xml:"id,attr"`
+	For  string `xml:"for,attr"`
+	Name string `xml:"attr.name,attr"`
+	Type string `xml:"attr.type,attr"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+// WriteGraphML writes the matrix as a GraphML document, with the label,
+// trench and level of nodes and the relations of edges as data.
+func (m *HarrisMatrix) WriteGraphML(w io.Writer) error {
+	doc := graphML{
+		XMLNS: "http://graphml.graphdrawing.org/xmlns",
+		Keys: []graphMLKey{
+			{ID: "label", For: "node", Name: "label", Type: "string"},
+			{ID: "trench", For: "node", Name: "trench", Type: "string"},
+			{ID: "level", For: "node", Name: "level", Type: "int"},
+			{ID: "relations", For: "edge", Name: "relations", Type: "string"},
+		},
+	}
+	doc.Graph.ID = "harris"
+	doc.Graph.EdgeDefault = "directed"
+	for _, n := range m.Nodes {
+		doc.Graph.Nodes = append(doc.Graph.Nodes, graphMLNode{ID: n.ID, Data: []graphMLData{
+			{Key: "label", Value: n.Label},
+			{Key: "trench", Value: n.Trench},
+			{Key: "level", Value: strconv.Itoa(n.Level)},
+		}})
+	}
+	for _, e := range m.Edges {
+		doc.Graph.Edges = append(doc.Graph.Edges, graphMLEdge{Source: e.From, Target: e.To, Data: []graphMLData{
+			{Key: "relations", Value: strings.Join(e.Relations, " ")},
+		}})
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestBuildHarrisMatrix(t *testing.T) {
+	surveys := []Survey{
+		{"IdentifierUUID": "u1", "Identifier": "1", "RelationAbove": "2\n3"},
+		{"IdentifierUUID": "u2", "Identifier": "2", "RelationCuts": "3"},
+		{"IdentifierUUID": "u3", "Identifier": "3", "RelationBelow": "2"},
+		{"IdentifierUUID": "u4", "Identifier": "4", "RelationSameAs": "3"},
+		{"IdentifierUUID": "u5", "Identifier": "5", "RelationFilledBy": "4"},
+		{"IdentifierUUID": "u6", "Identifier": "6", "RelationAbove": "99"},
+		{"IdentifierUUID": "u7", "Identifier": "7", "Type": "Find"},
+		// Identifiers belong to their trench, and cycles are kept
+		{"IdentifierUUID": "a1", "Identifier": "1", "Trench": "BA", "RelationAbove": "2"},
+		{"IdentifierUUID": "a2", "Identifier": "2", "Trench": "BA", "RelationAbove": "1"},
+	}
+	m := BuildHarrisMatrix(surveys, "BZ", nil)
+
+	var nodes []string
+	for _, n := range m.Nodes {
+		nodes = append(nodes, fmt.Sprintf("%s:%s@%d", n.Trench, n.Label, n.Level))
+	}
+	assertEqual(t, strings.Join(nodes, ","), "BA:1@0,BA:2@0,BZ:1@0,BZ:2@1,BZ:3 = 4@2,BZ:5@3")
+	var edges []string
+	for _, e := range m.Edges {
+		edges = append(edges, e.From+">"+e.To+":"+strings.Join(e.Relations, "+"))
+	}
+	assertEqual(t, strings.Join(edges, ","), "a1>a2:Above,a2>a1:Above,u1>u2:Above,u2>u3:Above+Cuts,u3>u5:Fills")
+	assertEqual(t, m.Removed, 1)
+	assertEqual(t, strings.Join(m.Nodes[4].Surveys, ","), "u3,u4")
+
+	var buf bytes.Buffer
+	assertNoError(t, m.WriteDOT(&buf, "Agora"))
+	dot := buf.String()
+	for _, s := range []string{
+		"digraph \"Agora\" {\n",
+		"  subgraph \"cluster_BZ\" {\n    label=\"BZ\";\n",
+		"    \"u3\" [label=\"3 = 4\"];\n",
+		"  \"u2\" -> \"u3\";\n",
+	} {
+		if !strings.Contains(dot, s) {
+			t.Errorf("DOT is missing %q", s)
+		}
+	}
+	if strings.Contains(dot, "\"u1\" -> \"u3\"") {
+		t.Error("DOT has an implied edge")
+	}
+
+	buf.Reset()
+	assertNoError(t, m.WriteGraphML(&buf))
+	var doc graphML
+	assertNoError(t, xml.Unmarshal(buf.Bytes(), &doc))
+	assertEqual(t, len(doc.Graph.Nodes), 6)
+	assertEqual(t, len(doc.Graph.Edges), 5)
+	assertEqual(t, doc.Graph.Edges[3].Data[0].Value, "Above Cuts")
+
+	// Projects can name their own relations
+	cfg := &StratigraphyConfig{Sequence: []RelationPair{{Later: "Over", Earlier: "Under"}}}
+	m = BuildHarrisMatrix([]Survey{
+		{"IdentifierUUID": "u1", "Identifier": "1", "RelationOver": "2", "RelationAbove": "3"},
+		{"IdentifierUUID": "u2", "Identifier": "2"},
+		{"IdentifierUUID": "u3", "Identifier": "3"},
+	}, "BZ", cfg)
+	assertEqual(t, len(m.Nodes), 2)
+	assertEqual(t, m.Edges[0].Relations[0], "Over")
+}
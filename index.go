@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// Directory inside a project holding its search index, one file per trench
+const SearchIndexDir = ".index"
+
+// Version of the format of index files, older files are rebuilt
+const searchIndexFormat = 1
+
+// Search indexes of the projects used so far, by project directory
+var searchIndexes = struct {
+	sync.Mutex
+	m map[string]*SearchIndex
+}{m: make(map[string]*SearchIndex)}
+
+func projectSearchIndex(projectDir string) *SearchIndex {
+	searchIndexes.Lock()
+	defer searchIndexes.Unlock()
+	idx, ok := searchIndexes.m[projectDir]
+	if !ok {
+		idx = NewSearchIndex(projectDir)
+		searchIndexes.m[projectDir] = idx
+	}
+	return idx
+}
+
+// ProjectSearchIndex returns the search index of a project, brought up to
+// date with the latest version of its trenches.
+func ProjectSearchIndex(projectDir, user string) (*SearchIndex, error) {
+	idx := projectSearchIndex(projectDir)
+	if err := idx.Refresh(user); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// RemoveSearchIndex deletes the search index of a project, which is rebuilt
+// by the next search.
+func RemoveSearchIndex(projectDir string) error {
+	searchIndexes.Lock()
+	delete(searchIndexes.m, projectDir)
+	searchIndexes.Unlock()
+	return os.RemoveAll(filepath.Join(projectDir, SearchIndexDir))
+}
+
+// indexCommit updates the search index of the project of b after a commit
+// to the trench, reading only the surveys that changed. Trenches not indexed
+// yet are left to the next search, so that syncs never wait for a whole
+// trench to be read. So are failed updates, as the indexed version is then
+// behind the trench.
+func indexCommit(b *Backend) {
+	if b.dir == "" {
+		return
+	}
+	searchIndexes.Lock()
+	idx := searchIndexes.m[b.dir]
+	searchIndexes.Unlock()
+	if idx == nil || idx.indexedVersion(b.Trench) == nil {
+		return
+	}
+	if err := idx.UpdateTrench(b); err != nil {
+		log.Printf("Error indexing %s: %s", b.Trench, err)
+	}
+}
+
+// headVersion returns the latest version of a trench without opening it as a
+// Backend, or "" if it has none.
+func headVersion(projectDir, trench string) (string, error) {
+	st := filesystem.NewStorage(osfs.New(filepath.Join(projectDir, trench)), cache.NewObjectLRUDefault())
+	ref, err := storer.ResolveReference(st, plumbing.HEAD)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return ref.Hash().String(), nil
+}
+
+// SearchIndex is an inverted index of the surveys at the latest version of
+// the trenches of a project. Surveys are indexed by the words of their values
+// and by the whole value of each field. The index of each trench is kept in
+// a file of the project, so that it is loaded without reading the trench.
+type SearchIndex struct {
+	dir      string     // Project directory, empty to keep the index in memory only
+	update   sync.Mutex // Held while updating, so that updates don't interleave
+	mu       sync.RWMutex
+	trenches map[string]*indexedTrench
+	docs     map[string]*searchDoc          // By trench and survey file, see docKey
+	terms    map[string]map[string]struct{} // Doc keys by term
+}
+
+type indexedTrench struct {
+	Version string
+	Files   map[string]plumbing.Hash // Survey files of the version
+}
+
+type searchDoc struct {
+	Trench string
+	Survey Survey
+	Terms  []string
+}
+
+// NewSearchIndex returns an empty index, stored in projectDir unless it is
+// empty.
+func NewSearchIndex(projectDir string) *SearchIndex {
+	return &SearchIndex{
+		dir:      projectDir,
+		trenches: make(map[string]*indexedTrench),
+		docs:     make(map[string]*searchDoc),
+		terms:    make(map[string]map[string]struct{}),
+	}
+}
+
+func docKey(trench, file string) string {
+	return trench + "/" + file
+}
+
+// SearchIndexStats counts what an index holds.
+type SearchIndexStats struct {
+	Trenches int
+	Surveys  int
+	Terms    int
+}
+
+func (s SearchIndexStats) String() string {
+	return fmt.Sprintf("%d trenches, %d surveys, %d terms", s.Trenches, s.Surveys, s.Terms)
+}
+
+func (idx *SearchIndex) Stats() SearchIndexStats {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return SearchIndexStats{Trenches: len(idx.trenches), Surveys: len(idx.docs), Terms: len(idx.terms)}
+}
+
+// indexedVersion returns the version of a trench held by the index, or nil
+// if the trench isn't loaded.
+func (idx *SearchIndex) indexedVersion(trench string) *string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	if t := idx.trenches[trench]; t != nil {
+		return &t.Version
+	}
+	return nil
+}
+
+// Refresh brings the index up to date with the latest version of every
+// trench of the project, and drops deleted trenches. Only the trenches that
+// changed since they were indexed, e.g. by squashing, are read.
+func (idx *SearchIndex) Refresh(user string) error {
+	trenches, err := ListTrenchNames(idx.dir)
+	if err != nil {
+		return err
+	}
+	current := make(Set)
+	for _, trench := range trenches {
+		current.Insert(trench)
+		head, err := headVersion(idx.dir, trench)
+		if err != nil {
+			return fmt.Errorf("Error indexing %s: %w", trench, err)
+		}
+		if v := idx.indexedVersion(trench); v != nil && *v == head {
+			continue
+		}
+		b, err := NewBackend(idx.dir, user, trench)
+		if err != nil {
+			return err
+		}
+		if err := idx.UpdateTrench(b); err != nil {
+			return fmt.Errorf("Error indexing %s: %w", trench, err)
+		}
+	}
+
+	idx.update.Lock()
+	defer idx.update.Unlock()
+	idx.mu.Lock()
+	for trench := range idx.trenches {
+		if !current.Contains(trench) {
+			idx.replaceTrench(trench, &indexedTrench{}, nil)
+			delete(idx.trenches, trench)
+		}
+	}
+	idx.mu.Unlock()
+
+	files, _ := filepath.Glob(filepath.Join(idx.dir, SearchIndexDir, "*.index"))
+	for _, f := range files {
+		if !current.Contains(strings.TrimSuffix(filepath.Base(f), ".index")) {
+			os.Remove(f)
+		}
+	}
+	return nil
+}
+
+// UpdateTrench indexes the latest version of the trench, reading only the
+// surveys that changed since the indexed version.
+func (idx *SearchIndex) UpdateTrench(b *Backend) error {
+	idx.update.Lock()
+	defer idx.update.Unlock()
+
+	idx.mu.RLock()
+	old := idx.trenches[b.Trench]
+	idx.mu.RUnlock()
+	if old == nil && idx.dir != "" {
+		old = idx.loadTrench(b)
+	}
+
+	head, err := b.r.Head()
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		head = plumbing.NewHashReference(plumbing.HEAD, plumbing.ZeroHash)
+	} else if err != nil {
+		return err
+	}
+	t := &indexedTrench{Files: make(map[string]plumbing.Hash)}
+	if !head.Hash().IsZero() {
+		t.Version = head.Hash().String()
+	}
+	if old != nil && old.Version == t.Version {
+		return nil
+	}
+
+	if t.Version != "" {
+		c, err := b.r.CommitObject(head.Hash())
+		if err != nil {
+			return err
+		}
+		entries, err := b.surveyEntries(c)
+		if err != nil {
+			return err
+		}
+		t.Files = entries.Files
+	}
+
+	// Read outside of the lock, searches go on meanwhile
+	changed := make(map[string]*searchDoc)
+	for name, h := range t.Files {
+		if old != nil && old.Files[name] == h {
+			continue
+		}
+		s, err := b.readSurvey(h)
+		if err != nil {
+			return fmt.Errorf("Error reading survey %s: %w", name, err)
+		}
+		changed[name] = &searchDoc{Trench: b.Trench, Survey: s, Terms: surveyTerms(s).Array()}
+	}
+
+	idx.mu.Lock()
+	idx.replaceTrench(b.Trench, t, changed)
+	idx.mu.Unlock()
+
+	if idx.dir != "" {
+		if err := idx.saveTrench(b); err != nil {
+			return fmt.Errorf("Error saving index: %w", err)
+		}
+	}
+	return nil
+}
+
+// replaceTrench swaps the indexed surveys of a trench for those of t, given
+// the surveys that changed. It must be called with the lock held.
+func (idx *SearchIndex) replaceTrench(trench string, t *indexedTrench, changed map[string]*searchDoc) {
+	if old := idx.trenches[trench]; old != nil {
+		for name, h := range old.Files {
+			if t.Files[name] != h {
+				idx.removeDoc(docKey(trench, name))
+			}
+		}
+	}
+	for name, doc := range changed {
+		key := docKey(trench, name)
+		idx.removeDoc(key)
+		idx.docs[key] = doc
+		for _, term := range doc.Terms {
+			if idx.terms[term] == nil {
+				idx.terms[term] = make(map[string]struct{})
+			}
+			idx.terms[term][key] = struct{}{}
+		}
+	}
+	idx.trenches[trench] = t
+}
+
+func (idx *SearchIndex) removeDoc(key string) {
+	doc, ok := idx.docs[key]
+	if !ok {
+		return
+	}
+	for _, term := range doc.Terms {
+		delete(idx.terms[term], key)
+		if len(idx.terms[term]) == 0 {
+			delete(idx.terms, term)
+		}
+	}
+	delete(idx.docs, key)
+}
+
+// storedTrench is the index of a trench as stored in its file, with the
+// survey files containing each term.
+type storedTrench struct {
+	Format  int
+	Version string
+	Files   map[string]plumbing.Hash
+	Surveys map[string]Survey
+	Terms   map[string][]string
+}
+
+func (idx *SearchIndex) trenchFile(trench string) string {
+	return filepath.Join(idx.dir, SearchIndexDir, trench+".index")
+}
+
+// loadTrench adds the stored index of a trench to the index and returns it,
+// or returns nil if there is no usable stored index. Index files are
+// encrypted like the trench.
+func (idx *SearchIndex) loadTrench(b *Backend) *indexedTrench {
+	data, err := os.ReadFile(idx.trenchFile(b.Trench))
+	if err != nil {
+		return nil
+	}
+	if data, err = b.decrypt(data); err != nil {
+		return nil
+	}
+	var st storedTrench
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&st); err != nil || st.Format != searchIndexFormat {
+		return nil
+	}
+
+	changed := make(map[string]*searchDoc, len(st.Surveys))
+	for name, s := range st.Surveys {
+		changed[name] = &searchDoc{Trench: b.Trench, Survey: s}
+	}
+	for term, names := range st.Terms {
+		for _, name := range names {
+			if doc, ok := changed[name]; ok {
+				doc.Terms = append(doc.Terms, term)
+			}
+		}
+	}
+	t := &indexedTrench{Version: st.Version, Files: st.Files}
+	idx.mu.Lock()
+	idx.replaceTrench(b.Trench, t, changed)
+	idx.mu.Unlock()
+	return t
+}
+
+func (idx *SearchIndex) saveTrench(b *Backend) error {
+	idx.mu.RLock()
+	t := idx.trenches[b.Trench]
+	st := storedTrench{
+		Format:  searchIndexFormat,
+		Version: t.Version,
+		Files:   t.Files,
+		Surveys: make(map[string]Survey, len(t.Files)),
+		Terms:   make(map[string][]string),
+	}
+	for name := range t.Files {
+		doc := idx.docs[docKey(b.Trench, name)]
+		if doc == nil {
+			continue
+		}
+		st.Surveys[name] = doc.Survey
+		for _, term := range doc.Terms {
+			st.Terms[term] = append(st.Terms[term], name)
+		}
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&st)
+	idx.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	filename := idx.trenchFile(b.Trench)
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, b.encrypt(buf.Bytes()), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// LinkedDataMapping maps surveys to RDF classes and properties. It is stored
+// in linkeddata.json, next to config.json, and only needs the settings that
+// differ from DefaultLinkedDataMapping. Classes and properties are either
+// full IRIs or prefixed names, e.g. crm:E19_Physical_Object.
+type LinkedDataMapping struct {
+	// IRI under which the project is published, e.g. https://example.org/agora/.
+	// Surveys are <base>surveys/<IdentifierUUID>.
+	Base string `json:"base"`
+
+	Prefixes     map[string]string `json:"prefixes"`
+	Classes      map[string]string `json:"classes"`       // By survey type
+	DefaultClass string            `json:"default_class"` // Of other survey types
+	Fields       map[string]string `json:"fields"`        // Properties of literal fields, others are left out
+	Relations    map[string]string `json:"relations"`     // By relation name, e.g. Above
+
+	Trench     LinkedDataLink `json:"trench"`     // From surveys to their trench
+	Attachment LinkedDataLink `json:"attachment"` // From surveys to their attachments
+}
+
+// LinkedDataLink describes a resource linked from surveys.
+type LinkedDataLink struct {
+	Class    string `json:"class"`
+	Property string `json:"property"`
+}
+
+// Prefix of relations without a mapping, in the project's own vocabulary
+const vocabPrefix = "idig"
+
+func DefaultLinkedDataMapping() *LinkedDataMapping {
+	return &LinkedDataMapping{
+		Prefixes: map[string]string{
+			"crm":        "http://www.cidoc-crm.org/cidoc-crm/",
+			"crmarchaeo": "http://www.cidoc-crm.org/extensions/crmarchaeo/",
+			"rdfs":       "http://www.w3.org/2000/01/rdf-schema#",
+		},
+		Classes: map[string]string{
+			"Context": "crmarchaeo:A8_Stratigraphic_Unit",
+			"Find":    "crm:E19_Physical_Object",
+		},
+		DefaultClass: "crm:E18_Physical_Thing",
+		Fields: map[string]string{
+			"Identifier":  "rdfs:label",
+			"Title":       "crm:P3_has_note",
+			"Description": "crm:P3_has_note",
+		},
+		Relations:  map[string]string{},
+		Trench:     LinkedDataLink{Class: "crm:E27_Site", Property: "crm:P46i_forms_part_of"},
+		Attachment: LinkedDataLink{Class: "crm:E38_Image", Property: "crm:P138i_has_representation"},
+	}
+}
+
+// LoadLinkedDataMapping returns the mapping of a project, which must at least
+// set the base IRI.
+func LoadLinkedDataMapping(projectDir string) (*LinkedDataMapping, error) {
+	mappingFile := filepath.Join(projectDir, "linkeddata.json")
+	m := DefaultLinkedDataMapping()
+	data, err := os.ReadFile(mappingFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("Missing linkeddata.json, it must set the base IRI of the project")
+	} else if err != nil {
+		return nil, fmt.Errorf("Invalid linkeddata.json: %w", err)
+	}
+	// Maps are merged into the defaults
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("Invalid linkeddata.json: %w", err)
+	}
+	if err := m.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid linkeddata.json: %w", err)
+	}
+	return m, nil
+}
+
+func (m *LinkedDataMapping) validate() error {
+	if u, err := url.Parse(m.Base); err != nil || !u.IsAbs() {
+		return fmt.Errorf("Invalid base IRI '%s'", m.Base)
+	}
+	if !strings.HasSuffix(m.Base, "/") && !strings.HasSuffix(m.Base, "#") {
+		m.Base += "/"
+	}
+	if _, ok := m.Prefixes[vocabPrefix]; !ok {
+		m.Prefixes[vocabPrefix] = m.Base + "vocab/"
+	}
+
+	terms := []string{m.DefaultClass, m.Trench.Class, m.Trench.Property, m.Attachment.Class, m.Attachment.Property}
+	for _, maps := range []map[string]string{m.Classes, m.Fields, m.Relations} {
+		for _, t := range maps {
+			terms = append(terms, t)
+		}
+	}
+	for _, t := range terms {
+		if t == "" {
+			continue
+		}
+		if prefix, _, ok := strings.Cut(t, ":"); ok && !strings.Contains(t, "://") {
+			if _, ok := m.Prefixes[prefix]; !ok && prefix != "urn" {
+				return fmt.Errorf("Unknown prefix in '%s'", t)
+			}
+		}
+	}
+	return nil
+}
+
+// Graph is a set of RDF resources described by statements, in the order
+// they were added.
+type Graph struct {
+	Prefixes map[string]string
+	Nodes    []*Node
+	nodes    map[string]*Node
+}
+
+// Node is a resource with its classes and statements.
+type Node struct {
+	ID         string
+	Types      []string
+	Statements []Statement
+}
+
+// Statement is a property of a node, with an IRI or literal value.
+type Statement struct {
+	Property string
+	Value    string
+	Literal  bool
+}
+
+func (g *Graph) node(id string) (*Node, bool) {
+	if n, ok := g.nodes[id]; ok {
+		return n, false
+	}
+	n := &Node{ID: id}
+	g.nodes[id] = n
+	g.Nodes = append(g.Nodes, n)
+	return n, true
+}
+
+func (n *Node) add(property, value string, literal bool) {
+	if property != "" && value != "" {
+		n.Statements = append(n.Statements, Statement{Property: property, Value: value, Literal: literal})
+	}
+}
+
+// LinkedDataGraph describes surveys as linked data following the mapping.
+// Surveys belong to the trench in their Trench field, or to trench, and
+// relations link surveys of the same trench by identifier. Relations to
+// unknown identifiers are left out.
+func LinkedDataGraph(m *LinkedDataMapping, trench string, surveys []Survey) *Graph {
+	g := &Graph{Prefixes: m.Prefixes, nodes: make(map[string]*Node)}
+
+	trenchOf := func(s Survey) string {
+		if s["Trench"] != "" {
+			return s["Trench"]
+		}
+		return trench
+	}
+	ids := make(map[[2]string]string)
+	for _, s := range surveys {
+		if s["Identifier"] != "" {
+			ids[[2]string{trenchOf(s), s["Identifier"]}] = s.ID()
+		}
+	}
+
+	for _, s := range surveys {
+		if s.ID() == "" {
+			continue
+		}
+		t := trenchOf(s)
+		tn, created := g.node(m.Base + "trenches/" + url.PathEscape(t))
+		if created {
+			tn.Types = append(tn.Types, m.Trench.Class)
+			tn.add("rdfs:label", t, true)
+		}
+
+		n, _ := g.node(m.surveyIRI(s.ID()))
+		class := m.Classes[s["Type"]]
+		if class == "" {
+			class = m.DefaultClass
+		}
+		n.Types = append(n.Types, class)
+		for _, k := range s.Keys().Array() {
+			n.add(m.Fields[k], s[k], true)
+		}
+		n.add(m.Trench.Property, tn.ID, false)
+		for _, r := range s.Relations() {
+			id, ok := ids[[2]string{t, r.Target}]
+			if !ok {
+				continue
+			}
+			property := m.Relations[r.Name]
+			if property == "" {
+				property = vocabPrefix + ":" + r.Name
+			}
+			n.add(property, m.surveyIRI(id), false)
+		}
+		for _, a := range s.Attachments() {
+			an, created := g.node(m.Base + "attachments/" + url.PathEscape(a.Checksum) + "/" + url.PathEscape(a.Name))
+			if created {
+				an.Types = append(an.Types, m.Attachment.Class)
+				an.add("rdfs:label", a.Name, true)
+			}
+			n.add(m.Attachment.Property, an.ID, false)
+		}
+	}
+	return g
+}
+
+func (m *LinkedDataMapping) surveyIRI(id string) string {
+	return m.Base + "surveys/" + url.PathEscape(id)
+}
+
+// WriteJSONLD writes the graph as a JSON-LD document with the prefixes as
+// its context.
+func (g *Graph) WriteJSONLD(w io.Writer) error {
+	context := make(map[string]any)
+	for prefix, iri := range g.Prefixes {
+		context[prefix] = iri
+	}
+	graph := []map[string]any{}
+	for _, n := range g.Nodes {
+		node := map[string]any{"@id": n.ID}
+		if types := nonEmpty(n.Types); len(types) == 1 {
+			node["@type"] = types[0]
+		} else if len(types) > 1 {
+			node["@type"] = types
+		}
+		for _, s := range n.Statements {
+			var value any = s.Value
+			if !s.Literal {
+				value = map[string]string{"@id": s.Value}
+			}
+			switch v := node[s.Property].(type) {
+			case nil:
+				node[s.Property] = value
+			case []any:
+				node[s.Property] = append(v, value)
+			default:
+				node[s.Property] = []any{v, value}
+			}
+		}
+		graph = append(graph, node)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	return enc.Encode(map[string]any{"@context": context, "@graph": graph})
+}
+
+// Local names that can be written as prefixed names in Turtle
+var turtleLocalName = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_.-]*[A-Za-z0-9_-])?$`)
+
+// WriteTurtle writes the graph in Turtle, one block per node.
+func (g *Graph) WriteTurtle(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	prefixes := make([]string, 0, len(g.Prefixes))
+	for prefix := range g.Prefixes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		fmt.Fprintf(bw, "@prefix %s: <%s> .\n", prefix, turtleEscapeIRI(g.Prefixes[prefix]))
+	}
+
+	term := func(iri string) string {
+		if prefix, local, ok := strings.Cut(iri, ":"); ok {
+			if _, known := g.Prefixes[prefix]; known && turtleLocalName.MatchString(local) {
+				return iri
+			}
+			if ns, known := g.Prefixes[prefix]; known {
+				iri = ns + local
+			}
+		}
+		return "<" + turtleEscapeIRI(iri) + ">"
+	}
+
+	for _, n := range g.Nodes {
+		fmt.Fprintf(bw, "\n%s", term(n.ID))
+		sep := ""
+		if types := nonEmpty(n.Types); len(types) > 0 {
+			var classes []string
+			for _, t := range types {
+				classes = append(classes, term(t))
+			}
+			fmt.Fprintf(bw, " a %s", strings.Join(classes, ", "))
+			sep = " ;"
+		}
+		for _, s := range n.Statements {
+			value := term(s.Value)
+			if s.Literal {
+				value = turtleLiteral(s.Value)
+			}
+			fmt.Fprintf(bw, "%s\n    %s %s", sep, term(s.Property), value)
+			sep = " ;"
+		}
+		fmt.Fprint(bw, " .\n")
+	}
+	return bw.Flush()
+}
+
+func turtleLiteral(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// turtleEscapeIRI escapes the characters not allowed in IRIs.
+func turtleEscapeIRI(iri string) string {
+	var sb strings.Builder
+	for _, r := range iri {
+		if r <= ' ' || strings.ContainsRune(`<>"{}|^`+"`\\", r) {
+			fmt.Fprintf(&sb, "%%%02X", r)
+		} else {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+func nonEmpty(values []string) []string {
+	var result []string
+	for _, v := range values {
+		if v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
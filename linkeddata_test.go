@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadLinkedDataMapping(t *testing.T) {
+	projectDir := t.TempDir()
+	_, err := LoadLinkedDataMapping(projectDir)
+	if err == nil {
+		t.Error("Expected an error without a mapping")
+	}
+
+	mappingFile := filepath.Join(projectDir, "linkeddata.json")
+	assertNoError(t, os.WriteFile(mappingFile, []byte(`{
+		"base": "https://example.org/agora",
+		"prefixes": {"ex": "https://example.org/terms/"},
+		"classes": {"Find": "ex:Find"},
+		"relations": {"Above": "ex:above"}
+	}`), 0o644))
+	m, err := LoadLinkedDataMapping(projectDir)
+	assertNoError(t, err)
+	assertEqual(t, m.Base, "https://example.org/agora/")
+	assertEqual(t, m.Classes["Find"], "ex:Find")
+	assertEqual(t, m.Classes["Context"], "crmarchaeo:A8_Stratigraphic_Unit")
+	assertEqual(t, m.Prefixes["crm"], "http://www.cidoc-crm.org/cidoc-crm/")
+	assertEqual(t, m.Prefixes["idig"], "https://example.org/agora/vocab/")
+
+	assertNoError(t, os.WriteFile(mappingFile, []byte(`{"base": "https://example.org/", "fields": {"Title": "dc:title"}}`), 0o644))
+	_, err = LoadLinkedDataMapping(projectDir)
+	if err == nil || !strings.Contains(err.Error(), "dc:title") {
+		t.Errorf("Expected an error for an unknown prefix, got %v", err)
+	}
+}
+
+func TestLinkedDataGraph(t *testing.T) {
+	m := DefaultLinkedDataMapping()
+	m.Base = "https://example.org/agora/"
+	m.Relations["Above"] = "crmarchaeo:AP11_has_physical_relation"
+	assertNoError(t, m.validate())
+
+	surveys := []Survey{
+		{"IdentifierUUID": "u1", "Identifier": "1", "Type": "Context", "Title": "Floor \"A\"\nnorth",
+			"RelationAbove": "2\n9", "RelationAttachments": "n=a b.jpg\nd=sum1"},
+		{"IdentifierUUID": "u2", "Identifier": "2", "Type": "Context", "RelationCuts": "1"},
+		{"IdentifierUUID": "u3", "Identifier": "3", "Type": "Pottery", "Material": "Clay"},
+	}
+	g := LinkedDataGraph(m, "BZ 1", surveys)
+	var ids []string
+	for _, n := range g.Nodes {
+		ids = append(ids, strings.TrimPrefix(n.ID, m.Base))
+	}
+	assertEqual(t, strings.Join(ids, ","), "trenches/BZ%201,surveys/u1,attachments/sum1/a%20b.jpg,surveys/u2,surveys/u3")
+
+	var buf bytes.Buffer
+	assertNoError(t, g.WriteTurtle(&buf))
+	ttl := buf.String()
+	for _, s := range []string{
+		"@prefix crm: <http://www.cidoc-crm.org/cidoc-crm/> .\n",
+		"<https://example.org/agora/surveys/u1> a crmarchaeo:A8_Stratigraphic_Unit ;\n",
+		"    crm:P3_has_note \"Floor \\\"A\\\"\\nnorth\" ;\n",
+		"    crmarchaeo:AP11_has_physical_relation <https://example.org/agora/surveys/u2> ;\n",
+		"    crm:P138i_has_representation <https://example.org/agora/attachments/sum1/a%20b.jpg> .\n",
+		"<https://example.org/agora/surveys/u2> a crmarchaeo:A8_Stratigraphic_Unit ;\n",
+		"    idig:Cuts <https://example.org/agora/surveys/u1> .\n",
+		"<https://example.org/agora/surveys/u3> a crm:E18_Physical_Thing ;\n",
+	} {
+		if !strings.Contains(ttl, s) {
+			t.Errorf("Turtle is missing %q", s)
+		}
+	}
+	if strings.Contains(ttl, "surveys/9") || strings.Contains(ttl, "Clay") {
+		t.Error("Turtle has unknown relations or unmapped fields")
+	}
+
+	buf.Reset()
+	assertNoError(t, g.WriteJSONLD(&buf))
+	var doc struct {
+		Context map[string]string `json:"@context"`
+		Graph   []map[string]any  `json:"@graph"`
+	}
+	assertNoError(t, json.Unmarshal(buf.Bytes(), &doc))
+	assertEqual(t, doc.Context["rdfs"], "http://www.w3.org/2000/01/rdf-schema#")
+	assertEqual(t, len(doc.Graph), 5)
+	u1 := doc.Graph[1]
+	assertEqual(t, u1["@id"], any("https://example.org/agora/surveys/u1"))
+	assertEqual(t, u1["@type"], any("crmarchaeo:A8_Stratigraphic_Unit"))
+	assertEqual(t, u1["rdfs:label"], any("1"))
+	trench := u1["crm:P46i_forms_part_of"].(map[string]any)
+	assertEqual(t, trench["@id"], any("https://example.org/agora/trenches/BZ%201"))
+}
@@ -15,6 +15,7 @@ var (
 	ListenAll  bool
 	ListenPort int
 	Verbose    bool
+	Metrics    bool // Serve GET /metrics, which needs no credentials
 )
 
 type Command struct {
@@ -32,6 +33,18 @@ var commands = []Command{
 	{"import", "Import a Preferences file", importCmd},
 	{"log", "List versions", logCmd},
 	{"rollback", "Rollback to a previous version", rollbackCmd},
+	{"gc", "Remove orphaned attachments", gcCmd},
+	{"migrate", "Move attachments to the configured store", migrateCmd},
+	{"usage", "Show storage usage and quotas", usageCmd},
+	{"encrypt", "Encrypt the data of a project", encryptCmd},
+	{"rekey", "Change the encryption key of a project", rekeyCmd},
+	{"fsck", "Check the integrity of trenches", fsckCmd},
+	{"repack", "Pack the objects of trenches to save space", repackCmd},
+	{"squash", "Thin out old versions of trenches", squashCmd},
+	{"export", "Export the surveys of trenches", exportCmd},
+	{"harris", "Export the Harris matrix of a trench or project", harrisCmd},
+	{"archive", "Package a trench version for deposition", archiveCmd},
+	{"reindex", "Rebuild the search index of projects", reindexCmd},
 }
 
 func usage() {
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type AttachmentMetadata struct {
+	MIMEType    string       `json:"mime_type"`
+	Size        int          `json:"size"`
+	Width       int          `json:"width,omitempty"`
+	Height      int          `json:"height,omitempty"`
+	Orientation int          `json:"orientation,omitempty"`
+	CaptureTime *time.Time   `json:"capture_time,omitempty"`
+	CameraMake  string       `json:"camera_make,omitempty"`
+	CameraModel string       `json:"camera_model,omitempty"`
+	GPS         *GPSPosition `json:"gps,omitempty"`
+}
+
+type GPSPosition struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+}
+
+// ParseAttachmentMetadata extracts whatever metadata it can find in data.
+// Missing or malformed EXIF is not an error, those fields are simply left
+// empty.
+func ParseAttachmentMetadata(data []byte) *AttachmentMetadata {
+	m := &AttachmentMetadata{
+		MIMEType: http.DetectContentType(data),
+		Size:     len(data),
+	}
+
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		m.Width = cfg.Width
+		m.Height = cfg.Height
+	}
+
+	tiff := findExif(data)
+	if tiff == nil {
+		return m
+	}
+	exif, err := parseExif(tiff)
+	if err != nil {
+		return m
+	}
+
+	if m.Width == 0 && m.Height == 0 {
+		m.Width = exif.PixelX
+		m.Height = exif.PixelY
+	}
+	if m.MIMEType == "application/octet-stream" && isTIFF(data) {
+		m.MIMEType = "image/tiff"
+	}
+	m.Orientation = exif.Orientation
+	m.CameraMake = exif.Make
+	m.CameraModel = exif.Model
+	m.CaptureTime = exif.CaptureTime()
+	m.GPS = exif.Position()
+	return m
+}
+
+// EXIF tags we care about
+const (
+	tagMake               = 0x010f
+	tagModel              = 0x0110
+	tagOrientation        = 0x0112
+	tagDateTime           = 0x0132
+	tagExifIFD            = 0x8769
+	tagGPSIFD             = 0x8825
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+	tagPixelXDimension    = 0xa002
+	tagPixelYDimension    = 0xa003
+	tagGPSLatitudeRef     = 0x0001
+	tagGPSLatitude        = 0x0002
+	tagGPSLongitudeRef    = 0x0003
+	tagGPSLongitude       = 0x0004
+	tagGPSAltitudeRef     = 0x0005
+	tagGPSAltitude        = 0x0006
+)
+
+const exifDateTime = "2006:01:02 15:04:05"
+
+type exifInfo struct {
+	Make               string
+	Model              string
+	Orientation        int
+	DateTime           string
+	DateTimeOriginal   string
+	OffsetTimeOriginal string
+	PixelX             int
+	PixelY             int
+
+	HasGPS        bool
+	Latitude      float64
+	Longitude     float64
+	HasAltitude   bool
+	Altitude      float64
+	BelowSeaLevel bool
+	LatitudeRef   string
+	LongitudeRef  string
+}
+
+// CaptureTime returns the original capture time. EXIF stores local time
+// without a zone, so unless OffsetTimeOriginal is present the time is
+// reported as UTC.
+func (e *exifInfo) CaptureTime() *time.Time {
+	ts := e.DateTimeOriginal
+	if ts == "" {
+		ts = e.DateTime
+	}
+	if ts == "" {
+		return nil
+	}
+
+	loc := time.UTC
+	if off := e.OffsetTimeOriginal; off != "" {
+		if t, err := time.Parse("-07:00", off); err == nil {
+			_, secs := t.Zone()
+			loc = time.FixedZone(off, secs)
+		}
+	}
+
+	t, err := time.ParseInLocation(exifDateTime, ts, loc)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+func (e *exifInfo) Position() *GPSPosition {
+	if !e.HasGPS {
+		return nil
+	}
+	p := &GPSPosition{Latitude: e.Latitude, Longitude: e.Longitude}
+	if e.LatitudeRef == "S" {
+		p.Latitude = -p.Latitude
+	}
+	if e.LongitudeRef == "W" {
+		p.Longitude = -p.Longitude
+	}
+	if e.HasAltitude {
+		alt := e.Altitude
+		if e.BelowSeaLevel {
+			alt = -alt
+		}
+		p.Altitude = &alt
+	}
+	return p
+}
+
+func isTIFF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("II*\x00")) || bytes.HasPrefix(data, []byte("MM\x00*"))
+}
+
+// findExif returns the TIFF structure holding the EXIF data of a JPEG or a
+// TIFF file, or nil if there is none.
+func findExif(data []byte) []byte {
+	if isTIFF(data) {
+		return data
+	}
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil
+	}
+
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xff {
+			return nil
+		}
+		marker := data[i+1]
+		if marker == 0xff {
+			// Fill byte
+			i++
+			continue
+		}
+		if marker == 0xd8 || marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			// Markers without a payload
+			i += 2
+			continue
+		}
+		if marker == 0xd9 || marker == 0xda {
+			// End of image or start of scan, no more metadata
+			return nil
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return nil
+		}
+		payload := data[i+4 : i+2+length]
+		if marker == 0xe1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			return payload[6:]
+		}
+		i += 2 + length
+	}
+	return nil
+}
+
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+var tiffTypeSize = map[uint16]uint32{
+	1:  1, // BYTE
+	2:  1, // ASCII
+	3:  2, // SHORT
+	4:  4, // LONG
+	5:  8, // RATIONAL
+	7:  1, // UNDEFINED
+	9:  4, // SLONG
+	10: 8, // SRATIONAL
+}
+
+func parseExif(data []byte) (*exifInfo, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("EXIF data too short")
+	}
+	t := &tiffReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("Invalid TIFF byte order")
+	}
+	if t.order.Uint16(data[2:]) != 42 {
+		return nil, fmt.Errorf("Invalid TIFF header")
+	}
+
+	ifd0, err := t.readIFD(t.order.Uint32(data[4:]))
+	if err != nil {
+		return nil, err
+	}
+
+	e := &exifInfo{
+		Make:        ifd0[tagMake].String(),
+		Model:       ifd0[tagModel].String(),
+		Orientation: int(ifd0[tagOrientation].Uint(t.order, 0)),
+		DateTime:    ifd0[tagDateTime].String(),
+	}
+
+	if off, ok := ifd0[tagExifIFD]; ok {
+		if sub, err := t.readIFD(off.Uint(t.order, 0)); err == nil {
+			e.DateTimeOriginal = sub[tagDateTimeOriginal].String()
+			e.OffsetTimeOriginal = sub[tagOffsetTimeOriginal].String()
+			e.PixelX = int(sub[tagPixelXDimension].Uint(t.order, 0))
+			e.PixelY = int(sub[tagPixelYDimension].Uint(t.order, 0))
+		}
+	}
+
+	if off, ok := ifd0[tagGPSIFD]; ok {
+		if gps, err := t.readIFD(off.Uint(t.order, 0)); err == nil {
+			lat, latOK := gps[tagGPSLatitude].Degrees(t.order)
+			lon, lonOK := gps[tagGPSLongitude].Degrees(t.order)
+			if latOK && lonOK {
+				e.HasGPS = true
+				e.Latitude = lat
+				e.Longitude = lon
+				e.LatitudeRef = gps[tagGPSLatitudeRef].String()
+				e.LongitudeRef = gps[tagGPSLongitudeRef].String()
+			}
+			if alt, ok := gps[tagGPSAltitude].Rational(t.order, 0); ok {
+				e.HasAltitude = true
+				e.Altitude = alt
+				e.BelowSeaLevel = gps[tagGPSAltitudeRef].Uint(t.order, 0) == 1
+			}
+		}
+	}
+
+	return e, nil
+}
+
+func (t *tiffReader) readIFD(offset uint32) (map[uint16]*tiffEntry, error) {
+	data := t.data
+	if uint64(offset)+2 > uint64(len(data)) {
+		return nil, fmt.Errorf("IFD offset out of range")
+	}
+	n := uint32(t.order.Uint16(data[offset:]))
+	if uint64(offset)+2+uint64(n)*12 > uint64(len(data)) {
+		return nil, fmt.Errorf("IFD entries out of range")
+	}
+
+	entries := make(map[uint16]*tiffEntry, n)
+	for i := uint32(0); i < n; i++ {
+		p := offset + 2 + i*12
+		tag := t.order.Uint16(data[p:])
+		typ := t.order.Uint16(data[p+2:])
+		count := t.order.Uint32(data[p+4:])
+
+		size, ok := tiffTypeSize[typ]
+		if !ok {
+			continue
+		}
+		total := uint64(size) * uint64(count)
+		var value []byte
+		if total <= 4 {
+			value = data[p+8 : p+8+uint32(total)]
+		} else {
+			start := uint64(t.order.Uint32(data[p+8:]))
+			if start+total > uint64(len(data)) {
+				continue
+			}
+			value = data[start : start+total]
+		}
+		entries[tag] = &tiffEntry{typ: typ, count: count, value: value}
+	}
+	return entries, nil
+}
+
+func (e *tiffEntry) String() string {
+	if e == nil || e.typ != 2 {
+		return ""
+	}
+	s, _, _ := strings.Cut(string(e.value), "\x00")
+	return strings.TrimSpace(s)
+}
+
+func (e *tiffEntry) Uint(order binary.ByteOrder, i int) uint32 {
+	if e == nil || uint32(i) >= e.count {
+		return 0
+	}
+	switch e.typ {
+	case 1, 7:
+		return uint32(e.value[i])
+	case 3:
+		return uint32(order.Uint16(e.value[2*i:]))
+	case 4, 9:
+		return order.Uint32(e.value[4*i:])
+	}
+	return 0
+}
+
+func (e *tiffEntry) Rational(order binary.ByteOrder, i int) (float64, bool) {
+	if e == nil || uint32(i) >= e.count {
+		return 0, false
+	}
+	switch e.typ {
+	case 5:
+		num := order.Uint32(e.value[8*i:])
+		den := order.Uint32(e.value[8*i+4:])
+		if den == 0 {
+			return 0, false
+		}
+		return float64(num) / float64(den), true
+	case 10:
+		num := int32(order.Uint32(e.value[8*i:]))
+		den := int32(order.Uint32(e.value[8*i+4:]))
+		if den == 0 {
+			return 0, false
+		}
+		return float64(num) / float64(den), true
+	}
+	return 0, false
+}
+
+// Degrees converts a GPS coordinate stored as degrees, minutes and seconds
+// rationals into decimal degrees.
+func (e *tiffEntry) Degrees(order binary.ByteOrder) (float64, bool) {
+	if e == nil || e.count < 3 {
+		return 0, false
+	}
+	d, ok1 := e.Rational(order, 0)
+	m, ok2 := e.Rational(order, 1)
+	s, ok3 := e.Rational(order, 2)
+	if !ok1 || !ok2 || !ok3 {
+		return 0, false
+	}
+	return d + m/60 + s/3600, true
+}
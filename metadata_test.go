@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"math"
+	"testing"
+	"time"
+)
+
+type testTag struct {
+	Tag   uint16
+	Type  uint16
+	Count uint32
+	Data  []byte
+}
+
+func asciiTag(tag uint16, s string) testTag {
+	return testTag{tag, 2, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func shortTag(tag uint16, v uint16) testTag {
+	return testTag{tag, 3, 1, binary.LittleEndian.AppendUint16(nil, v)}
+}
+
+func longTag(tag uint16, v uint32) testTag {
+	return testTag{tag, 4, 1, binary.LittleEndian.AppendUint32(nil, v)}
+}
+
+func rationalTag(tag uint16, values ...uint32) testTag {
+	var data []byte
+	for _, v := range values {
+		data = binary.LittleEndian.AppendUint32(data, v)
+	}
+	return testTag{tag, 5, uint32(len(values) / 2), data}
+}
+
+func encodeIFD(start uint32, tags []testTag) []byte {
+	var head, tail []byte
+	dataStart := start + 2 + uint32(len(tags))*12 + 4
+	head = binary.LittleEndian.AppendUint16(head, uint16(len(tags)))
+	for _, t := range tags {
+		head = binary.LittleEndian.AppendUint16(head, t.Tag)
+		head = binary.LittleEndian.AppendUint16(head, t.Type)
+		head = binary.LittleEndian.AppendUint32(head, t.Count)
+		if len(t.Data) <= 4 {
+			value := make([]byte, 4)
+			copy(value, t.Data)
+			head = append(head, value...)
+		} else {
+			head = binary.LittleEndian.AppendUint32(head, dataStart+uint32(len(tail)))
+			tail = append(tail, t.Data...)
+		}
+	}
+	head = binary.LittleEndian.AppendUint32(head, 0)
+	return append(head, tail...)
+}
+
+func buildExif() []byte {
+	exifTags := []testTag{
+		asciiTag(tagDateTimeOriginal, "2023:07:05 12:39:36"),
+		asciiTag(tagOffsetTimeOriginal, "+03:00"),
+	}
+	gpsTags := []testTag{
+		asciiTag(tagGPSLatitudeRef, "N"),
+		rationalTag(tagGPSLatitude, 37, 1, 58, 1, 30, 1),
+		asciiTag(tagGPSLongitudeRef, "E"),
+		rationalTag(tagGPSLongitude, 23, 1, 43, 1, 12, 1),
+		{tagGPSAltitudeRef, 1, 1, []byte{0}},
+		rationalTag(tagGPSAltitude, 755, 10),
+	}
+	ifd0 := func(exifOffset, gpsOffset uint32) []testTag {
+		return []testTag{
+			asciiTag(tagMake, "Apple"),
+			asciiTag(tagModel, "iPad Pro"),
+			shortTag(tagOrientation, 6),
+			longTag(tagExifIFD, exifOffset),
+			longTag(tagGPSIFD, gpsOffset),
+		}
+	}
+
+	exifStart := 8 + uint32(len(encodeIFD(8, ifd0(0, 0))))
+	gpsStart := exifStart + uint32(len(encodeIFD(exifStart, exifTags)))
+
+	tiff := []byte("II*\x00")
+	tiff = binary.LittleEndian.AppendUint32(tiff, 8)
+	tiff = append(tiff, encodeIFD(8, ifd0(exifStart, gpsStart))...)
+	tiff = append(tiff, encodeIFD(exifStart, exifTags)...)
+	tiff = append(tiff, encodeIFD(gpsStart, gpsTags)...)
+	return tiff
+}
+
+func TestAttachmentMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	img := image.NewGray(image.Rect(0, 0, 32, 16))
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Insert an APP1 segment right after SOI
+	payload := append([]byte("Exif\x00\x00"), buildExif()...)
+	app1 := []byte{0xff, 0xe1}
+	app1 = binary.BigEndian.AppendUint16(app1, uint16(len(payload)+2))
+	app1 = append(app1, payload...)
+	data := append([]byte{}, buf.Bytes()[:2]...)
+	data = append(data, app1...)
+	data = append(data, buf.Bytes()[2:]...)
+
+	m := ParseAttachmentMetadata(data)
+	assertEqual(t, m.MIMEType, "image/jpeg")
+	assertEqual(t, m.Size, len(data))
+	assertEqual(t, m.Width, 32)
+	assertEqual(t, m.Height, 16)
+	assertEqual(t, m.Orientation, 6)
+	assertEqual(t, m.CameraMake, "Apple")
+	assertEqual(t, m.CameraModel, "iPad Pro")
+
+	if m.CaptureTime == nil {
+		t.Fatal("Missing capture time")
+	}
+	expected := time.Date(2023, 7, 5, 9, 39, 36, 0, time.UTC)
+	if !m.CaptureTime.Equal(expected) {
+		t.Errorf("%v != %v", m.CaptureTime, expected)
+	}
+
+	if m.GPS == nil {
+		t.Fatal("Missing GPS position")
+	}
+	if math.Abs(m.GPS.Latitude-37.975) > 1e-9 {
+		t.Errorf("Invalid latitude %f", m.GPS.Latitude)
+	}
+	if math.Abs(m.GPS.Longitude-23.72) > 1e-9 {
+		t.Errorf("Invalid longitude %f", m.GPS.Longitude)
+	}
+	if m.GPS.Altitude == nil || math.Abs(*m.GPS.Altitude-75.5) > 1e-9 {
+		t.Errorf("Invalid altitude")
+	}
+}
+
+func TestAttachmentMetadataNoExif(t *testing.T) {
+	m := ParseAttachmentMetadata([]byte("%PDF-1.4 not really"))
+	assertEqual(t, m.MIMEType, "application/pdf")
+	if m.CaptureTime != nil || m.GPS != nil {
+		t.Errorf("Unexpected EXIF metadata")
+	}
+}
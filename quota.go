@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQuotaExceeded = errors.New("Storage quota exceeded")
+	ErrLowDiskSpace  = errors.New("Not enough free disk space")
+)
+
+// checkDiskSpace refuses writes when the free disk space of the project falls
+// below the configured floor.
+func (b *Backend) checkDiskSpace() error {
+	q := b.cfg.Quota
+	if q == nil || q.MinFreeDisk <= 0 || b.dir == "" {
+		return nil
+	}
+	free, err := FreeDiskSpace(b.dir)
+	if err != nil {
+		log.Printf("Warning: cannot check free disk space: %s", err)
+		return nil
+	}
+	if free < int64(q.MinFreeDisk) {
+		return fmt.Errorf("%w: %s left, writes are refused below %s",
+			ErrLowDiskSpace, FormatSize(free), FormatSize(int64(q.MinFreeDisk)))
+	}
+	return nil
+}
+
+// checkQuota makes sure that an attachment of size bytes fits in the quotas
+// of the trench and of the project.
+func (b *Backend) checkQuota(name, checksum string, size int64) error {
+	q := b.cfg.Quota
+	if q == nil {
+		return nil
+	}
+
+	if limit := int64(q.TrenchAttachments); limit > 0 {
+		sizes, err := b.cachedAttachmentSizes([]string{b.Trench})
+		if err != nil {
+			return err
+		}
+		if used := totalSize(sizes); used+size > limit {
+			return fmt.Errorf("%w: trench '%s' uses %s of %s, upload is %s", ErrQuotaExceeded,
+				b.Trench, FormatSize(used), FormatSize(limit), FormatSize(size))
+		}
+	}
+
+	if limit := int64(q.ProjectAttachments); limit > 0 && b.dir != "" {
+		trenches, err := ListTrenchNames(b.dir)
+		if err != nil {
+			return err
+		}
+		sizes, err := b.cachedAttachmentSizes(trenches)
+		if err != nil {
+			return err
+		}
+		if _, ok := sizes[b.usageKey(name, checksum)]; ok {
+			// Already stored for another trench
+			return nil
+		}
+		if used := totalSize(sizes); used+size > limit {
+			return fmt.Errorf("%w: project uses %s of %s, upload is %s", ErrQuotaExceeded,
+				FormatSize(used), FormatSize(limit), FormatSize(size))
+		}
+	}
+	return nil
+}
+
+func totalSize(sizes map[string]int64) int64 {
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	return total
+}
+
+// attachmentSizes returns the sizes of the attachments of the trench by
+// usage key.
+func (b *Backend) attachmentSizes() (map[string]int64, error) {
+	attachments, err := b.ListAttachments()
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64, len(attachments))
+	for _, a := range attachments {
+		sizes[b.usageKey(a.Name, a.Checksum)] = a.Size
+	}
+	return sizes, nil
+}
+
+// usageKey identifies the stored copy of an attachment within a project.
+// Trenches share the copies of the shared attachment store, and have their
+// own copies in the other stores.
+func (b *Backend) usageKey(name, checksum string) string {
+	if b.shared != nil {
+		return attachmentKey(name, checksum)
+	}
+	return b.Trench + "/" + attachmentKey(name, checksum)
+}
+
+// Cached attachment sizes are listed again after this long, to pick up the
+// changes made by other processes, such as gc
+const UsageCacheTTL = 10 * time.Minute
+
+// Attachment sizes of the trenches of each project by usage key, so that
+// quota checks don't list every attachment store on each upload. Backends
+// keep the sizes of their own trench up to date as they write and delete.
+var usageCache = struct {
+	sync.Mutex
+	trenches map[[2]string]*trenchSizes // By project directory and trench
+}{trenches: make(map[[2]string]*trenchSizes)}
+
+type trenchSizes struct {
+	listed time.Time
+	sizes  map[string]int64
+}
+
+// cachedAttachmentSizes returns the sizes of the attachments of some trenches
+// of the project by usage key. Trenches not listed within UsageCacheTTL are
+// listed first.
+func (b *Backend) cachedAttachmentSizes(trenches []string) (map[string]int64, error) {
+	if b.dir == "" {
+		return b.attachmentSizes()
+	}
+
+	for _, trench := range trenches {
+		key := [2]string{b.dir, trench}
+		usageCache.Lock()
+		t := usageCache.trenches[key]
+		usageCache.Unlock()
+		if t != nil && time.Since(t.listed) < UsageCacheTTL {
+			continue
+		}
+
+		tb := b
+		if trench != b.Trench {
+			var err error
+			if tb, err = NewBackend(b.dir, b.User, trench); err != nil {
+				return nil, err
+			}
+		}
+		listed := time.Now()
+		sizes, err := tb.attachmentSizes()
+		if err != nil {
+			return nil, fmt.Errorf("Error listing attachments of '%s': %w", trench, err)
+		}
+		usageCache.Lock()
+		usageCache.trenches[key] = &trenchSizes{listed: listed, sizes: sizes}
+		usageCache.Unlock()
+	}
+
+	usageCache.Lock()
+	defer usageCache.Unlock()
+	sizes := make(map[string]int64)
+	for _, trench := range trenches {
+		maps.Copy(sizes, usageCache.trenches[[2]string{b.dir, trench}].sizes)
+	}
+	return sizes, nil
+}
+
+// updateUsage records the size of an attachment written to the trench, or
+// its removal when size is negative.
+func (b *Backend) updateUsage(name, checksum string, size int64) {
+	usageCache.Lock()
+	defer usageCache.Unlock()
+	t := usageCache.trenches[[2]string{b.dir, b.Trench}]
+	if t == nil || b.dir == "" {
+		return
+	}
+	if size < 0 {
+		delete(t.sizes, b.usageKey(name, checksum))
+	} else {
+		t.sizes[b.usageKey(name, checksum)] = size
+	}
+}
+
+type TrenchUsage struct {
+	Name            string
+	Attachments     int
+	AttachmentBytes int64
+	RepositoryBytes int64 // Size of the trench repository on disk
+
+	sizes map[string]int64 // Attachment sizes by usage key
+}
+
+type Usage []TrenchUsage
+
+// AttachmentBytes returns the size of the attachments of all trenches, with
+// attachments of the shared store counted once.
+func (u Usage) AttachmentBytes() int64 {
+	sizes := make(map[string]int64)
+	for _, t := range u {
+		maps.Copy(sizes, t.sizes)
+	}
+	return totalSize(sizes)
+}
+
+// ProjectUsage returns the storage used by each trench of a project.
+// Attachments of the shared store count for each trench using them.
+func ProjectUsage(projectDir string) (Usage, error) {
+	trenches, err := ListTrenchNames(projectDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var usage Usage
+	for _, trench := range trenches {
+		b, err := NewBackend(projectDir, "admin", trench)
+		if err != nil {
+			return nil, err
+		}
+		sizes, err := b.attachmentSizes()
+		if err != nil {
+			return nil, fmt.Errorf("Error listing attachments of '%s': %w", trench, err)
+		}
+		repoSize, err := dirSize(filepath.Join(projectDir, trench))
+		if err != nil {
+			return nil, err
+		}
+		usage = append(usage, TrenchUsage{
+			Name:            trench,
+			Attachments:     len(sizes),
+			AttachmentBytes: totalSize(sizes),
+			RepositoryBytes: repoSize,
+			sizes:           sizes,
+		})
+	}
+	return usage, nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Prefix of the survey fields relating a survey to others
+const relationPrefix = "Relation"
+
+// Relation is a relation of a survey to another survey of the trench, e.g.
+// Above 12 when the survey's RelationAbove field lists identifier 12.
+type Relation struct {
+	Name   string // Field without the Relation prefix, e.g. Above
+	Target string // Identifier of the other survey
+}
+
+// Relations returns the relations of the survey, listed one identifier per
+// line in its Relation* fields, sorted by name. RelationAttachments lists
+// attachments rather than surveys and is not a relation.
+func (s Survey) Relations() []Relation {
+	var relations []Relation
+	for key, value := range s {
+		name, ok := strings.CutPrefix(key, relationPrefix)
+		if !ok || name == "" || key == "RelationAttachments" {
+			continue
+		}
+		for _, target := range strings.Split(value, "\n") {
+			if target = strings.TrimSpace(target); target != "" {
+				relations = append(relations, Relation{Name: name, Target: target})
+			}
+		}
+	}
+	sort.SliceStable(relations, func(i, j int) bool {
+		return relations[i].Name < relations[j].Name
+	})
+	return relations
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+var (
+	ErrInvalidVersion   = errors.New("Invalid version")
+	ErrAmbiguousVersion = errors.New("Ambiguous version")
+)
+
+// Shortest hash prefix accepted as a version
+const minVersionPrefix = 4
+
+// ResolveVersion returns the version named by s, which can be:
+//
+//   - a full or abbreviated hash, e.g. 48aba5c
+//   - HEAD, a tag or a branch
+//   - a date or RFC 3339 timestamp, naming the latest version at that time,
+//     e.g. 2024-06-01 for the version at the end of that day
+//
+// followed by any number of ~N or ^ to go back N or 1 versions, e.g. HEAD~3.
+// It fails with ErrAmbiguousVersion when s names more than one version.
+func (b *Backend) ResolveVersion(s string) (*object.Commit, error) {
+	base, path := s, ""
+	if i := strings.IndexAny(s, "~^"); i >= 0 {
+		base, path = s[:i], s[i:]
+	}
+
+	var c *object.Commit
+	var err error
+	if len(base) == 40 {
+		// Full hash, by far the most common
+		c, err = b.r.CommitObject(plumbing.NewHash(base))
+	} else {
+		c, err = b.resolveName(base)
+	}
+	if errors.Is(err, ErrAmbiguousVersion) {
+		return nil, err
+	} else if err != nil || c == nil {
+		return nil, fmt.Errorf("%w %s", ErrInvalidVersion, s)
+	}
+
+	for path != "" {
+		n := 1
+		op := path[0]
+		path = path[1:]
+		digits := len(path) - len(strings.TrimLeft(path, "0123456789"))
+		if digits > 0 {
+			n, _ = strconv.Atoi(path[:digits])
+			path = path[digits:]
+		}
+		if op == '^' && n > 1 {
+			return nil, fmt.Errorf("%w %s: versions have a single parent", ErrInvalidVersion, s)
+		}
+		if op == '^' && digits > 0 && n == 0 {
+			continue
+		}
+		for ; n > 0; n-- {
+			if len(c.ParentHashes) == 0 {
+				return nil, fmt.Errorf("%w %s: history is too short", ErrInvalidVersion, s)
+			}
+			if c, err = b.r.CommitObject(c.ParentHashes[0]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return c, nil
+}
+
+// resolveName resolves a version without ~ or ^.
+func (b *Backend) resolveName(name string) (*object.Commit, error) {
+	if name == "" {
+		return nil, ErrInvalidVersion
+	}
+
+	found := make(map[plumbing.Hash]*object.Commit)
+	add := func(h plumbing.Hash) {
+		if c, err := b.peelCommit(h); err == nil {
+			found[c.Hash] = c
+		}
+	}
+
+	if name == "HEAD" {
+		head, err := b.r.Head()
+		if err != nil {
+			return nil, err
+		}
+		add(head.Hash())
+	}
+	for _, refName := range []string{name, "refs/tags/" + name, "refs/heads/" + name} {
+		if !strings.HasPrefix(refName, "refs/") {
+			continue
+		}
+		if ref, err := b.r.Storer.Reference(plumbing.ReferenceName(refName)); err == nil && ref.Type() == plumbing.HashReference {
+			add(ref.Hash())
+		}
+	}
+	if len(name) >= minVersionPrefix && isHex(name) {
+		hashes, err := b.hashesWithPrefix(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range hashes {
+			add(h)
+		}
+	}
+	if len(found) == 0 {
+		if t, err := ParseVersionTime(name, true); err == nil {
+			return b.versionAtTime(t)
+		}
+		return nil, ErrInvalidVersion
+	}
+
+	if len(found) > 1 {
+		var candidates []string
+		for h := range found {
+			candidates = append(candidates, Prefix(h.String(), 12))
+		}
+		sort.Strings(candidates)
+		return nil, fmt.Errorf("%w %s, it could be %s", ErrAmbiguousVersion, name, strings.Join(candidates, ", "))
+	}
+	for _, c := range found {
+		return c, nil
+	}
+	return nil, ErrInvalidVersion
+}
+
+// peelCommit returns the commit h points to, directly or through tags.
+func (b *Backend) peelCommit(h plumbing.Hash) (*object.Commit, error) {
+	for {
+		obj, err := b.r.Storer.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			return nil, err
+		}
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			return object.DecodeCommit(b.r.Storer, obj)
+		case plumbing.TagObject:
+			tag, err := object.DecodeTag(b.r.Storer, obj)
+			if err != nil {
+				return nil, err
+			}
+			h = tag.Target
+		default:
+			return nil, ErrInvalidVersion
+		}
+	}
+}
+
+// hashesWithPrefix returns the hashes of the objects of the trench starting
+// with the hex prefix. The filesystem storage looks them up in the object
+// directory and pack indexes, without reading any object.
+func (b *Backend) hashesWithPrefix(prefix string) ([]plumbing.Hash, error) {
+	prefix = strings.ToLower(prefix)
+	type prefixSearcher interface {
+		HashesWithPrefix(prefix []byte) ([]plumbing.Hash, error)
+	}
+
+	var hashes []plumbing.Hash
+	if ps, ok := b.r.Storer.(prefixSearcher); ok {
+		// Only whole bytes can be searched, check the last digit below
+		raw, err := hex.DecodeString(prefix[:len(prefix)&^1])
+		if err != nil {
+			return nil, err
+		}
+		if hashes, err = ps.HashesWithPrefix(raw); err != nil {
+			return nil, err
+		}
+	} else {
+		it, err := b.r.Storer.IterEncodedObjects(plumbing.AnyObject)
+		if err != nil {
+			return nil, err
+		}
+		err = it.ForEach(func(obj plumbing.EncodedObject) error {
+			hashes = append(hashes, obj.Hash())
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	matches := hashes[:0]
+	for _, h := range hashes {
+		if strings.HasPrefix(h.String(), prefix) {
+			matches = append(matches, h)
+		}
+	}
+	return matches, nil
+}
+
+// versionAtTime returns the latest version made at or before t.
+func (b *Backend) versionAtTime(t time.Time) (*object.Commit, error) {
+	head, err := b.r.Head()
+	if err != nil {
+		return nil, err
+	}
+	for h := head.Hash(); ; {
+		c, err := b.r.CommitObject(h)
+		if err != nil {
+			return nil, err
+		}
+		if !c.Author.When.After(t) {
+			return c, nil
+		}
+		if len(c.ParentHashes) == 0 {
+			return nil, ErrInvalidVersion
+		}
+		h = c.ParentHashes[0]
+	}
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s + strings.Repeat("0", len(s)&1))
+	return err == nil
+}
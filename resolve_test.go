@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func TestResolveVersion(t *testing.T) {
+	disk, err := NewBackend(t.TempDir(), "test-user", "T1")
+	assertNoError(t, err)
+	memory, err := NewMemoryBackend("test-user", "T1")
+	assertNoError(t, err)
+
+	for _, b := range []*Backend{disk, memory} {
+		surveys := generateSurveys(3)
+		for i := range surveys {
+			_, err := b.WriteTrench("test-dev", "", []byte("{}"), surveys[:i+1])
+			assertNoError(t, err)
+		}
+		versions, err := b.ListVersions()
+		assertNoError(t, err)
+		assertNoError(t, b.r.Storer.SetReference(plumbing.NewHashReference("refs/tags/season-1",
+			plumbing.NewHash(versions[1].Version))))
+
+		resolve := func(s string) string {
+			t.Helper()
+			c, err := b.ResolveVersion(s)
+			assertNoError(t, err)
+			if c == nil {
+				return ""
+			}
+			return c.Hash.String()
+		}
+		assertEqual(t, resolve(versions[0].Version), versions[0].Version)
+		assertEqual(t, resolve(Prefix(versions[1].Version, 7)), versions[1].Version)
+		assertEqual(t, resolve(Prefix(versions[2].Version, 6)), versions[2].Version)
+		assertEqual(t, resolve("HEAD"), versions[0].Version)
+		assertEqual(t, resolve("HEAD~2"), versions[2].Version)
+		assertEqual(t, resolve("HEAD^^"), versions[2].Version)
+		assertEqual(t, resolve("HEAD~0"), versions[0].Version)
+		assertEqual(t, resolve("season-1"), versions[1].Version)
+		assertEqual(t, resolve("refs/tags/season-1~1"), versions[2].Version)
+		assertEqual(t, resolve(time.Now().Add(time.Hour).Format(time.RFC3339)), versions[0].Version)
+
+		for _, s := range []string{"", "HEAD~3", "HEAD^2", "abc", "zzzzzzz", "0000000", "1999-01-01", "season-2"} {
+			_, err := b.ResolveVersion(s)
+			if !errors.Is(err, ErrInvalidVersion) {
+				t.Errorf("Expected invalid version for '%s', got %v", s, err)
+			}
+		}
+	}
+}
+
+func TestResolveAmbiguousVersion(t *testing.T) {
+	b, err := NewBackend(t.TempDir(), "test-user", "T1")
+	assertNoError(t, err)
+
+	// Write versions until two share their first 4 digits
+	byPrefix := make(map[string]plumbing.Hash)
+	var prefix string
+	for i := 0; prefix == ""; i++ {
+		sig := object.Signature{Name: "test-dev", Email: "test-user", When: time.Unix(0, 0)}
+		commit := object.Commit{Author: sig, Committer: sig, Message: fmt.Sprint(i), TreeHash: plumbing.ZeroHash}
+		obj := b.r.Storer.NewEncodedObject()
+		assertNoError(t, commit.Encode(obj))
+		h, err := b.r.Storer.SetEncodedObject(obj)
+		assertNoError(t, err)
+		p := Prefix(h.String(), 4)
+		if other, ok := byPrefix[p]; ok {
+			_, err := b.ResolveVersion(Prefix(other.String(), 12))
+			assertNoError(t, err)
+			prefix = p
+		}
+		byPrefix[p] = h
+	}
+
+	_, err = b.ResolveVersion(prefix)
+	if !errors.Is(err, ErrAmbiguousVersion) {
+		t.Errorf("Expected ambiguous version for '%s', got %v", prefix, err)
+	}
+}
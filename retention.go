@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Default number of days during which every version is kept
+const DefaultRetentionDays = 30
+
+var ErrHeadChanged = errors.New("Trench was synced while squashing, try again")
+
+// RetentionPolicy decides which versions of a trench to keep when squashing
+// its history. Versions newer than Recent are all kept. Older versions are
+// thinned out to the last version of each day. Tagged versions and the
+// latest version are always kept.
+type RetentionPolicy struct {
+	Recent time.Duration
+}
+
+func DefaultRetentionPolicy() RetentionPolicy {
+	return RetentionPolicy{Recent: DefaultRetentionDays * 24 * time.Hour}
+}
+
+// SquashSummary describes the versions of a trench kept by a squash.
+type SquashSummary struct {
+	Versions int // Before squashing
+	Recent   int // Kept because they are recent
+	Daily    int // Kept as the last version of their day
+	Tagged   int // Kept only because they are tagged
+}
+
+func (s SquashSummary) Kept() int {
+	return s.Recent + s.Daily + s.Tagged
+}
+
+func (s SquashSummary) String() string {
+	return fmt.Sprintf("%d versions -> %d (%d recent, %d daily, %d tagged)",
+		s.Versions, s.Kept(), s.Recent, s.Daily, s.Tagged)
+}
+
+// Squash rewrites the history of the trench keeping only the versions
+// selected by policy. Each kept version holds the same surveys, preferences
+// and attachments as before, and tags are moved to the rewritten versions.
+// The versions before the first removed one keep their hashes. With dryRun,
+// the history is left untouched and only the summary is returned.
+//
+// The removed versions stay in the repository until it is pruned, so devices
+// that last synced one of them can still pull.
+func (b *Backend) Squash(policy RetentionPolicy, now time.Time, dryRun bool) (*SquashSummary, error) {
+	if b.ReadOnly && !dryRun {
+		return nil, fmt.Errorf("Forbidden")
+	}
+	summary := &SquashSummary{}
+
+	head, err := b.r.Head()
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return summary, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Versions only have one parent, newest first
+	var commits []*object.Commit
+	for h := head.Hash(); ; {
+		c, err := b.r.CommitObject(h)
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, c)
+		if len(c.ParentHashes) == 0 {
+			break
+		}
+		h = c.ParentHashes[0]
+	}
+	summary.Versions = len(commits)
+
+	tags, err := b.tags()
+	if err != nil {
+		return nil, err
+	}
+	tagged := make(map[plumbing.Hash]bool)
+	for _, t := range tags {
+		tagged[t.Commit] = true
+	}
+
+	cutoff := now.Add(-policy.Recent)
+	keep := make([]bool, len(commits))
+	lastDay := ""
+	for i, c := range commits {
+		day := c.Author.When.Format(time.DateOnly)
+		switch {
+		case !c.Author.When.Before(cutoff):
+			summary.Recent++
+			keep[i] = true
+		case day != lastDay:
+			summary.Daily++
+			keep[i] = true
+		case tagged[c.Hash]:
+			summary.Tagged++
+			keep[i] = true
+		}
+		lastDay = day
+	}
+	if dryRun || summary.Kept() == summary.Versions {
+		return summary, nil
+	}
+
+	// Rewrite oldest first
+	commitMap := make(map[plumbing.Hash]plumbing.Hash)
+	parent, rewritten := plumbing.ZeroHash, false
+	for i := len(commits) - 1; i >= 0; i-- {
+		c := commits[i]
+		if !keep[i] {
+			rewritten = true
+			continue
+		}
+		if !rewritten {
+			commitMap[c.Hash] = c.Hash
+			parent = c.Hash
+			continue
+		}
+		commit := object.Commit{
+			Author:    c.Author,
+			Committer: c.Committer,
+			Message:   c.Message,
+			TreeHash:  c.TreeHash,
+		}
+		if !parent.IsZero() {
+			commit.ParentHashes = []plumbing.Hash{parent}
+		}
+		obj := b.r.Storer.NewEncodedObject()
+		if err := commit.Encode(obj); err != nil {
+			return nil, err
+		}
+		if parent, err = b.r.Storer.SetEncodedObject(obj); err != nil {
+			return nil, err
+		}
+		commitMap[c.Hash] = parent
+	}
+
+	// A sync may have moved HEAD in the meantime, only replace what we read
+	newHead := plumbing.NewHashReference(head.Name(), commitMap[head.Hash()])
+	if err := b.r.Storer.CheckAndSetReference(newHead, head); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrHeadChanged, err)
+	}
+
+	for _, t := range tags {
+		h, ok := commitMap[t.Commit]
+		if !ok || h == t.Commit {
+			continue
+		}
+		if t.Tag != nil {
+			tag := *t.Tag
+			tag.Target = h
+			obj := b.r.Storer.NewEncodedObject()
+			if err := tag.Encode(obj); err != nil {
+				return nil, err
+			}
+			if h, err = b.r.Storer.SetEncodedObject(obj); err != nil {
+				return nil, err
+			}
+		}
+		if err := b.r.Storer.SetReference(plumbing.NewHashReference(t.Name, h)); err != nil {
+			return nil, err
+		}
+	}
+	return summary, nil
+}
+
+// trenchTag is a tag pointing to a version of the trench.
+type trenchTag struct {
+	Name   plumbing.ReferenceName
+	Commit plumbing.Hash
+	Tag    *object.Tag // Nil for lightweight tags
+}
+
+// tags returns the tags of the trench that point to versions.
+func (b *Backend) tags() ([]trenchTag, error) {
+	refs, err := b.r.Tags()
+	if err != nil {
+		return nil, err
+	}
+	var tags []trenchTag
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		t := trenchTag{Name: ref.Name(), Commit: ref.Hash()}
+		if tag, err := b.r.TagObject(ref.Hash()); err == nil {
+			if tag.TargetType != plumbing.CommitObject {
+				return nil
+			}
+			t.Tag, t.Commit = tag, tag.Target
+		} else if _, err := b.r.CommitObject(ref.Hash()); err != nil {
+			return nil
+		}
+		tags = append(tags, t)
+		return nil
+	})
+	return tags, err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// backdate rewrites the versions of the trench, oldest first, with dates.
+func backdate(t *testing.T, b *Backend, dates []time.Time) []plumbing.Hash {
+	t.Helper()
+	versions, err := b.ListVersions()
+	assertNoError(t, err)
+	assertEqual(t, len(versions), len(dates))
+
+	var hashes []plumbing.Hash
+	parent := plumbing.ZeroHash
+	for i, date := range dates {
+		c, err := b.r.CommitObject(plumbing.NewHash(versions[len(versions)-1-i].Version))
+		assertNoError(t, err)
+		c.Author.When, c.Committer.When = date, date
+		c.ParentHashes = nil
+		if !parent.IsZero() {
+			c.ParentHashes = []plumbing.Hash{parent}
+		}
+		obj := b.r.Storer.NewEncodedObject()
+		assertNoError(t, c.Encode(obj))
+		parent, err = b.r.Storer.SetEncodedObject(obj)
+		assertNoError(t, err)
+		hashes = append(hashes, parent)
+	}
+	assertNoError(t, b.updateHEAD(parent))
+	return hashes
+}
+
+func treeOf(t *testing.T, b *Backend, h plumbing.Hash) plumbing.Hash {
+	t.Helper()
+	c, err := b.r.CommitObject(h)
+	assertNoError(t, err)
+	return c.TreeHash
+}
+
+func TestSquash(t *testing.T) {
+	b, err := NewBackend(t.TempDir(), "test-user", "T1")
+	assertNoError(t, err)
+	surveys := generateSurveys(6)
+	for i := range surveys {
+		_, err := b.WriteTrench("test-dev", "", []byte("{}"), surveys[:i+1])
+		assertNoError(t, err)
+	}
+
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	day := func(days, hour int) time.Time {
+		return time.Date(2024, 6, 1-days, hour, 0, 0, 0, time.UTC)
+	}
+	hashes := backdate(t, b, []time.Time{
+		day(40, 10), // Removed
+		day(40, 12), // Last of the day, annotated tag
+		day(35, 9),  // Tagged
+		day(35, 11), // Last of the day
+		day(5, 8),   // Recent
+		now.Add(-time.Hour),
+	})
+	assertNoError(t, b.r.Storer.SetReference(plumbing.NewHashReference("refs/tags/season-1", hashes[2])))
+	_, err = b.r.CreateTag("v1", hashes[1], &git.CreateTagOptions{
+		Tagger:  &object.Signature{Name: "test", Email: "test", When: now},
+		Message: "Season 1",
+	})
+	assertNoError(t, err)
+
+	summary, err := b.Squash(DefaultRetentionPolicy(), now, true)
+	assertNoError(t, err)
+	assertEqual(t, summary.String(), "6 versions -> 5 (2 recent, 2 daily, 1 tagged)")
+	assertEqual(t, b.Head(), hashes[5].String())
+
+	_, err = b.Squash(DefaultRetentionPolicy(), now, false)
+	assertNoError(t, err)
+	versions, err := b.ListVersions()
+	assertNoError(t, err)
+	assertEqual(t, len(versions), 5)
+	for i, j := range []int{5, 4, 3, 2, 1} {
+		h := plumbing.NewHash(versions[i].Version)
+		assertEqual(t, treeOf(t, b, h), treeOf(t, b, hashes[j]))
+		read, err := b.ReadSurveysAtVersion(versions[i].Version)
+		assertNoError(t, err)
+		assertEqualSurveys(t, read, surveys[:j+1])
+	}
+
+	ref, err := b.r.Reference("refs/tags/season-1", false)
+	assertNoError(t, err)
+	assertEqual(t, ref.Hash().String(), versions[3].Version)
+	tag, err := b.r.Tag("v1")
+	assertNoError(t, err)
+	tagObject, err := b.r.TagObject(tag.Hash())
+	assertNoError(t, err)
+	assertEqual(t, tagObject.Target.String(), versions[4].Version)
+	assertEqual(t, tagObject.Message, "Season 1\n")
+
+	// Nothing left to squash
+	head := b.Head()
+	summary, err = b.Squash(DefaultRetentionPolicy(), now, false)
+	assertNoError(t, err)
+	assertEqual(t, summary.Kept(), summary.Versions)
+	assertEqual(t, b.Head(), head)
+}
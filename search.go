@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var ErrInvalidQuery = errors.New("Invalid query")
+
+// Default and maximum number of results of a search
+const (
+	DefaultSearchLimit = 100
+	MaxSearchLimit     = 1000
+)
+
+// Terms of whole field values are prefixed by the field, which words can't
+// contain.
+func fieldTerm(field, value string) string {
+	return field + "=" + strings.ToLower(value)
+}
+
+// surveyTerms returns the words of the values of a survey, lowercased, and
+// a term for each field value.
+func surveyTerms(s Survey) Set {
+	terms := make(Set)
+	for k, v := range s {
+		terms.Insert(fieldTerm(k, v))
+		for _, w := range searchWords(v) {
+			terms.Insert(w)
+		}
+	}
+	return terms
+}
+
+func searchWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// SearchFilter compares a survey field to a value. Op is one of =, !=, <, <=,
+// >, >=. With =, a value ending with * matches values starting with the rest.
+type SearchFilter struct {
+	Field string
+	Op    string
+	Value string
+}
+
+func (f SearchFilter) String() string {
+	return f.Field + f.Op + f.Value
+}
+
+func (f SearchFilter) prefix() (string, bool) {
+	if f.Op == "=" && strings.HasSuffix(f.Value, "*") {
+		return strings.TrimSuffix(f.Value, "*"), true
+	}
+	return "", false
+}
+
+func (f SearchFilter) match(s Survey) bool {
+	v, ok := s[f.Field]
+	if prefix, isPrefix := f.prefix(); isPrefix {
+		return ok && strings.HasPrefix(strings.ToLower(v), strings.ToLower(prefix))
+	}
+	switch f.Op {
+	case "=":
+		return ok && strings.EqualFold(v, f.Value)
+	case "!=":
+		return !strings.EqualFold(v, f.Value)
+	}
+	if !ok || v == "" {
+		return false
+	}
+	// Numbers compare as numbers, anything else such as dates as text
+	cmp := strings.Compare(v, f.Value)
+	if a, err := strconv.ParseFloat(v, 64); err == nil {
+		if b, err := strconv.ParseFloat(f.Value, 64); err == nil {
+			cmp = 0
+			if a < b {
+				cmp = -1
+			} else if a > b {
+				cmp = 1
+			}
+		}
+	}
+	switch f.Op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// SearchQuery selects surveys by the words of their values and by filters on
+// their fields. Words ending with * match any word starting with the rest.
+type SearchQuery struct {
+	Text     string
+	Filters  []SearchFilter
+	Trenches []string // All trenches when empty
+	Limit    int
+	Offset   int
+}
+
+// ParseSearchQuery parses a raw URL query such as
+// Type=Find&Material=Bronze&Date>=2026-06-01&q=pin. The parameters q, trench,
+// limit and offset set the text, trenches and page of results, any other
+// parameter filters a field.
+func ParseSearchQuery(rawQuery string) (SearchQuery, error) {
+	q := SearchQuery{Limit: DefaultSearchLimit}
+	for _, part := range strings.Split(rawQuery, "&") {
+		if part == "" {
+			continue
+		}
+		i := strings.IndexAny(part, "=<>!")
+		if i <= 0 {
+			return q, fmt.Errorf("%w '%s'", ErrInvalidQuery, part)
+		}
+		op := "="
+		for _, o := range []string{"!=", "<=", ">=", "=", "<", ">"} {
+			if strings.HasPrefix(part[i:], o) {
+				op = o
+				break
+			}
+		}
+		if !strings.HasPrefix(part[i:], op) {
+			return q, fmt.Errorf("%w '%s'", ErrInvalidQuery, part)
+		}
+		field, err := url.QueryUnescape(part[:i])
+		if err != nil {
+			return q, fmt.Errorf("%w '%s'", ErrInvalidQuery, part)
+		}
+		value, err := url.QueryUnescape(part[i+len(op):])
+		if err != nil {
+			return q, fmt.Errorf("%w '%s'", ErrInvalidQuery, part)
+		}
+		// Clients encoding the field as a query key send Date%3E=x for Date>=x
+		if n := len(field) - 1; op == "=" && n >= 0 && strings.ContainsRune("<>!", rune(field[n])) {
+			field, op = field[:n], field[n:]+op
+		}
+		if field == "" {
+			return q, fmt.Errorf("%w '%s'", ErrInvalidQuery, part)
+		}
+
+		switch {
+		case field == "q" && op == "=":
+			q.Text = strings.TrimSpace(q.Text + " " + value)
+		case field == "trench" && op == "=":
+			q.Trenches = append(q.Trenches, value)
+		case (field == "limit" || field == "offset") && op == "=":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || (field == "limit" && (n == 0 || n > MaxSearchLimit)) {
+				return q, fmt.Errorf("%w %s '%s'", ErrInvalidQuery, field, value)
+			}
+			if field == "limit" {
+				q.Limit = n
+			} else {
+				q.Offset = n
+			}
+		default:
+			q.Filters = append(q.Filters, SearchFilter{Field: field, Op: op, Value: value})
+		}
+	}
+	return q, nil
+}
+
+// SearchResult is a survey found by a search.
+type SearchResult struct {
+	Trench string `json:"trench"`
+	Survey Survey `json:"survey"`
+}
+
+// Search returns a page of the surveys matching q, ordered by trench, type
+// and identifier, along with the number of matching surveys.
+func (idx *SearchIndex) Search(q SearchQuery) ([]SearchResult, int) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	// Narrow down with the index, then check every filter
+	var candidates map[string]struct{}
+	narrowed := false
+	narrow := func(keys map[string]struct{}) {
+		if !narrowed {
+			candidates, narrowed = keys, true
+			return
+		}
+		next := make(map[string]struct{})
+		for k := range candidates {
+			if _, ok := keys[k]; ok {
+				next[k] = struct{}{}
+			}
+		}
+		candidates = next
+	}
+	for _, w := range strings.Fields(q.Text) {
+		keys := make(map[string]struct{})
+		if prefix, ok := strings.CutSuffix(w, "*"); ok {
+			prefix = strings.ToLower(prefix)
+			for term, docs := range idx.terms {
+				if strings.HasPrefix(term, prefix) && !strings.Contains(term, "=") {
+					for k := range docs {
+						keys[k] = struct{}{}
+					}
+				}
+			}
+			narrow(keys)
+			continue
+		}
+		for _, word := range searchWords(w) {
+			narrow(idx.terms[word])
+		}
+	}
+	for _, f := range q.Filters {
+		if _, isPrefix := f.prefix(); f.Op == "=" && !isPrefix {
+			narrow(idx.terms[fieldTerm(f.Field, f.Value)])
+		}
+	}
+	if !narrowed {
+		candidates = make(map[string]struct{}, len(idx.docs))
+		for k := range idx.docs {
+			candidates[k] = struct{}{}
+		}
+	}
+
+	trenches := make(Set)
+	for _, t := range q.Trenches {
+		trenches.Insert(t)
+	}
+	var results []SearchResult
+	for k := range candidates {
+		doc := idx.docs[k]
+		if doc == nil || (len(trenches) > 0 && !trenches.Contains(doc.Trench)) {
+			continue
+		}
+		matched := true
+		for _, f := range q.Filters {
+			if !f.match(doc.Survey) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			results = append(results, SearchResult{Trench: doc.Trench, Survey: doc.Survey})
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Trench != b.Trench {
+			return a.Trench < b.Trench
+		}
+		if a.Survey["Type"] != b.Survey["Type"] {
+			return a.Survey["Type"] < b.Survey["Type"]
+		}
+		if a.Survey["Identifier"] != b.Survey["Identifier"] {
+			return a.Survey["Identifier"] < b.Survey["Identifier"]
+		}
+		return a.Survey.ID() < b.Survey.ID()
+	})
+	total := len(results)
+	// Offset can be up to the largest int, don't add to it before clamping
+	offset := min(q.Offset, total)
+	results = results[offset:min(offset+q.Limit, total)]
+
+	// Indexed surveys are shared, hand out copies
+	page := make([]SearchResult, len(results))
+	for i, r := range results {
+		page[i] = SearchResult{Trench: r.Trench, Survey: cloneSurveys([]Survey{r.Survey})[0]}
+	}
+	return page, total
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	q, err := ParseSearchQuery("Type=Find&Material=Bronze*&Date%3E=2026-06-01&Weight<10&Phase!=&q=bronze+pin&trench=BZ&limit=5")
+	assertNoError(t, err)
+	assertEqual(t, q.Text, "bronze pin")
+	assertEqual(t, strings.Join(q.Trenches, ","), "BZ")
+	assertEqual(t, q.Limit, 5)
+	var filters []string
+	for _, f := range q.Filters {
+		filters = append(filters, f.String())
+	}
+	assertEqual(t, strings.Join(filters, " "), "Type=Find Material=Bronze* Date>=2026-06-01 Weight<10 Phase!=")
+
+	// Operators encoded with the field, as url.Values does
+	for raw, want := range map[string]string{
+		"Date%3E=2026-06-01": "Date >= 2026-06-01",
+		"Date%3C=2026-06-01": "Date <= 2026-06-01",
+		"Phase%21=":          "Phase != ",
+		"Title=a%3Db":        "Title = a=b",
+	} {
+		q, err := ParseSearchQuery(raw)
+		assertNoError(t, err)
+		if len(q.Filters) != 1 {
+			t.Fatalf("Expected one filter parsing '%s'", raw)
+		}
+		f := q.Filters[0]
+		assertEqual(t, f.Field+" "+f.Op+" "+f.Value, want)
+	}
+
+	for _, raw := range []string{"Type", "=Find", "%3E=1", "limit=0", "limit=x", "offset=-1", "Title=%zz"} {
+		if _, err := ParseSearchQuery(raw); err == nil {
+			t.Errorf("Expected an error parsing '%s'", raw)
+		}
+	}
+
+	// Offsets past the end leave an empty page
+	q, err = ParseSearchQuery("offset=9223372036854775807&limit=10")
+	assertNoError(t, err)
+	results, total := NewSearchIndex("").Search(q)
+	assertEqual(t, len(results), 0)
+	assertEqual(t, total, 0)
+}
+
+func TestSearchIndex(t *testing.T) {
+	projectDir := t.TempDir()
+	bz, err := NewBackend(projectDir, "test-user", "BZ")
+	assertNoError(t, err)
+	_, err = bz.WriteTrench("test-dev", "", nil, []Survey{
+		{"IdentifierUUID": "u1", "Identifier": "1", "Type": "Find", "Material": "Bronze", "Title": "Bronze pin", "Date": "2026-06-02", "Weight": "9.5"},
+		{"IdentifierUUID": "u2", "Identifier": "2", "Type": "Find", "Material": "Iron", "Title": "Nail", "Date": "2026-05-30", "Weight": "12"},
+		{"IdentifierUUID": "u3", "Identifier": "3", "Type": "Context", "Title": "Floor with bronze slag"},
+	})
+	assertNoError(t, err)
+	ba, err := NewBackend(projectDir, "test-user", "BA")
+	assertNoError(t, err)
+	_, err = ba.WriteTrench("test-dev", "", nil, []Survey{
+		{"IdentifierUUID": "u4", "Identifier": "1", "Type": "Find", "Material": "Bronze alloy", "Title": "Coin", "Date": "2026-07-01"},
+	})
+	assertNoError(t, err)
+
+	idx, err := ProjectSearchIndex(projectDir, "test-user")
+	assertNoError(t, err)
+	search := func(rawQuery string) string {
+		q, err := ParseSearchQuery(rawQuery)
+		assertNoError(t, err)
+		results, total := idx.Search(q)
+		var ids []string
+		for _, r := range results {
+			ids = append(ids, r.Trench+":"+r.Survey.ID())
+		}
+		return strings.Join(ids, ",") + " " + strings.Repeat("+", total)
+	}
+
+	assertEqual(t, search("q=bronze"), "BA:u4,BZ:u3,BZ:u1 +++")
+	assertEqual(t, search("q=BRONZE+pin"), "BZ:u1 +")
+	assertEqual(t, search("q=bro*"), "BA:u4,BZ:u3,BZ:u1 +++")
+	assertEqual(t, search("Type=Find&Material=bronze"), "BZ:u1 +")
+	assertEqual(t, search("Type=Find&Material=Bronze*"), "BA:u4,BZ:u1 ++")
+	assertEqual(t, search("Type=find&Date>=2026-06-01"), "BA:u4,BZ:u1 ++")
+	assertEqual(t, search("Weight<10"), "BZ:u1 +")
+	assertEqual(t, search("Weight>=9.5&Weight<=12"), "BZ:u1,BZ:u2 ++")
+	assertEqual(t, search("Type!=Find"), "BZ:u3 +")
+	assertEqual(t, search("q=bronze&trench=BZ&limit=1&offset=1"), "BZ:u1 ++")
+	assertEqual(t, search("q=silver"), " ")
+	assertEqual(t, search("q=bronze&offset=9223372036854775807"), " +++")
+
+	// Commits update the index
+	_, err = bz.WriteTrench("test-dev", "", nil, []Survey{
+		{"IdentifierUUID": "u1", "Identifier": "1", "Type": "Find", "Material": "Silver", "Title": "Silver pin"},
+		{"IdentifierUUID": "u2", "Identifier": "2", "Type": "Find", "Material": "Iron", "Title": "Nail", "Date": "2026-05-30", "Weight": "12"},
+	})
+	assertNoError(t, err)
+	assertEqual(t, search("q=silver"), "BZ:u1 +")
+	assertEqual(t, search("q=bronze"), "BA:u4 +")
+	assertEqual(t, search("q=nail"), "BZ:u2 +")
+
+	// Results are copies
+	results, _ := idx.Search(SearchQuery{Text: "nail", Limit: 1})
+	results[0].Survey["Title"] = "Changed"
+	assertEqual(t, search("q=nail"), "BZ:u2 +")
+
+	// Rollbacks too
+	assertNoError(t, bz.Rollback("HEAD~1"))
+	assertEqual(t, search("q=silver"), " ")
+	assertEqual(t, search("q=bronze"), "BA:u4,BZ:u3,BZ:u1 +++")
+}
+
+func TestSearchIndexFiles(t *testing.T) {
+	projectDir := t.TempDir()
+	bz, err := NewBackend(projectDir, "test-user", "BZ")
+	assertNoError(t, err)
+	surveys := generateSurveys(50)
+	surveys[0]["Title"] = "Bronze pin"
+	_, err = bz.WriteTrench("test-dev", "", nil, surveys)
+	assertNoError(t, err)
+	// Syncs leave trenches not indexed yet to the first search
+	assertEqual(t, FileExists(filepath.Join(projectDir, SearchIndexDir, "BZ.index")), false)
+	_, err = ProjectSearchIndex(projectDir, "test-user")
+	assertNoError(t, err)
+	assertEqual(t, FileExists(filepath.Join(projectDir, SearchIndexDir, "BZ.index")), true)
+
+	// A new index loads the stored one instead of reading the trench
+	idx := NewSearchIndex(projectDir)
+	assertEqual(t, idx.loadTrench(bz) != nil, true)
+	results, total := idx.Search(SearchQuery{Text: "bronze", Limit: 10})
+	assertEqual(t, total, 1)
+	assertEqual(t, results[0].Survey.ID(), surveys[0].ID())
+
+	// Versions made while the index wasn't watching are picked up on refresh
+	surveys[1]["Title"] = "Bronze coin"
+	assertNoError(t, RemoveSearchIndex(projectDir))
+	_, err = bz.WriteTrench("test-dev", "", nil, surveys[:2])
+	assertNoError(t, err)
+	assertNoError(t, idx.Refresh("test-user"))
+	_, total = idx.Search(SearchQuery{Text: "bronze", Limit: 10})
+	assertEqual(t, total, 2)
+	assertEqual(t, idx.Stats().Surveys, 2)
+
+	// Deleted trenches are dropped
+	assertNoError(t, os.RemoveAll(filepath.Join(projectDir, "BZ")))
+	assertNoError(t, idx.Refresh("test-user"))
+	assertEqual(t, idx.Stats().String(), "0 trenches, 0 surveys, 0 terms")
+	assertEqual(t, FileExists(filepath.Join(projectDir, SearchIndexDir, "BZ.index")), false)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Tables written by WriteProjectSQLite besides the tables of survey types
+var sqliteSchema = []string{
+	`CREATE TABLE trenches (
+		name TEXT PRIMARY KEY,
+		version TEXT NOT NULL,
+		date TEXT NOT NULL,
+		user TEXT,
+		device TEXT,
+		surveys INTEGER NOT NULL
+	)`,
+	`CREATE TABLE versions (
+		trench TEXT NOT NULL,
+		version TEXT NOT NULL,
+		date TEXT NOT NULL,
+		user TEXT,
+		device TEXT,
+		message TEXT,
+		added INTEGER NOT NULL,
+		changed INTEGER NOT NULL,
+		removed INTEGER NOT NULL,
+		PRIMARY KEY (trench, version)
+	)`,
+	`CREATE TABLE relations (
+		trench TEXT NOT NULL,
+		survey TEXT NOT NULL,
+		relation TEXT NOT NULL,
+		target TEXT NOT NULL,
+		target_survey TEXT
+	)`,
+	`CREATE INDEX relations_survey ON relations (survey)`,
+	`CREATE TABLE attachments (
+		trench TEXT NOT NULL,
+		survey TEXT NOT NULL,
+		name TEXT NOT NULL,
+		checksum TEXT NOT NULL,
+		data BLOB
+	)`,
+	`CREATE INDEX attachments_survey ON attachments (survey)`,
+}
+
+// SQLiteSummary counts what WriteProjectSQLite exported.
+type SQLiteSummary struct {
+	Trenches int
+	Surveys  int
+	Types    int
+}
+
+func (s SQLiteSummary) String() string {
+	return fmt.Sprintf("%d trenches, %d surveys of %d types", s.Trenches, s.Surveys, s.Types)
+}
+
+// WriteProjectSQLite writes a version of every trench of a project to a new
+// SQLite database at dbPath, replacing any existing file. Surveys are stored
+// in a table per type, with a column per field in the order of the
+// preferences, along with tables of trenches, versions, relations and
+// attachments. The content of attachments is only included with
+// withAttachments. Trenches without the version, e.g. trenches created after
+// a date, are left out.
+func WriteProjectSQLite(dbPath, projectDir, user, version string, withAttachments bool) (*SQLiteSummary, error) {
+	trenches, err := ListTrenchNames(projectDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Write next to the destination, so that a failed export leaves it alone
+	tmpPath := dbPath + ".tmp"
+	os.Remove(tmpPath)
+	defer os.Remove(tmpPath)
+	db, err := sql.Open("sqlite", tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	for _, stmt := range sqliteSchema {
+		if _, err := tx.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	summary := &SQLiteSummary{}
+	surveysByType := make(map[string][]Survey)
+	var types []string
+	fields := []string{"Trench"}
+	for _, trench := range trenches {
+		b, err := NewBackend(projectDir, user, trench)
+		if err != nil {
+			return nil, err
+		}
+		c, err := b.ResolveVersion(version)
+		if errors.Is(err, ErrInvalidVersion) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Error reading '%s': %w", trench, err)
+		}
+
+		surveys, f, err := b.ExportSurveys(c.Hash.String(), "")
+		if err != nil {
+			return nil, fmt.Errorf("Error reading '%s': %w", trench, err)
+		}
+		fields = append(fields, f...)
+		if err := insertTrench(tx, b, c.Hash.String(), surveys, withAttachments); err != nil {
+			return nil, fmt.Errorf("Error exporting '%s': %w", trench, err)
+		}
+		for _, s := range surveys {
+			if s["Trench"] == "" {
+				s["Trench"] = trench
+			}
+			if _, ok := surveysByType[s["Type"]]; !ok {
+				types = append(types, s["Type"])
+			}
+			surveysByType[s["Type"]] = append(surveysByType[s["Type"]], s)
+		}
+		summary.Trenches++
+		summary.Surveys += len(surveys)
+	}
+	if summary.Trenches == 0 && len(trenches) > 0 {
+		return nil, fmt.Errorf("%w %s: no trench has it", ErrInvalidVersion, version)
+	}
+
+	tables := surveyTables(types)
+	for _, t := range types {
+		if err := insertSurveyTable(tx, tables[t], surveysByType[t], fields); err != nil {
+			return nil, fmt.Errorf("Error exporting type '%s': %w", t, err)
+		}
+	}
+	summary.Types = len(types)
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if err := db.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// insertTrench adds the rows of a trench to the trenches, versions, relations
+// and attachments tables.
+func insertTrench(tx *sql.Tx, b *Backend, version string, surveys []Survey, withAttachments bool) error {
+	versions, _, err := b.QueryVersions(VersionQuery{Cursor: version})
+	if err != nil {
+		return err
+	}
+	v := versions[0]
+	_, err = tx.Exec("INSERT INTO trenches VALUES (?, ?, ?, ?, ?, ?)",
+		b.Trench, v.Version, v.Date.Format(time.RFC3339), v.User, v.Device, len(surveys))
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		_, err := tx.Exec("INSERT INTO versions VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			b.Trench, v.Version, v.Date.Format(time.RFC3339), v.User, v.Device, v.Message, v.Added, v.Changed, v.Removed)
+		if err != nil {
+			return err
+		}
+	}
+
+	ids := make(map[string]string)
+	for _, s := range surveys {
+		if s["Identifier"] != "" {
+			ids[s["Identifier"]] = s.ID()
+		}
+	}
+	for _, s := range surveys {
+		for _, r := range s.Relations() {
+			var target sql.NullString
+			if id, ok := ids[r.Target]; ok {
+				target = sql.NullString{String: id, Valid: true}
+			}
+			_, err := tx.Exec("INSERT INTO relations VALUES (?, ?, ?, ?, ?)", b.Trench, s.ID(), r.Name, r.Target, target)
+			if err != nil {
+				return err
+			}
+		}
+		for _, a := range s.Attachments() {
+			var data []byte
+			if withAttachments {
+				if data, err = b.ReadAttachmentAtVersion(a.Name, a.Checksum, version); err != nil {
+					return fmt.Errorf("Error reading attachment '%s': %w", a.Name, err)
+				}
+			}
+			_, err := tx.Exec("INSERT INTO attachments VALUES (?, ?, ?, ?, ?)", b.Trench, s.ID(), a.Name, a.Checksum, data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// insertSurveyTable creates the table of a survey type and adds its surveys.
+func insertSurveyTable(tx *sql.Tx, name string, surveys []Survey, fields []string) error {
+	// Column names are case insensitive, keep the first of a kind
+	var columns []string
+	seen := make(Set)
+	for _, c := range SurveyColumns(surveys, fields) {
+		if !seen.Contains(strings.ToLower(c)) {
+			seen.Insert(strings.ToLower(c))
+			columns = append(columns, c)
+		}
+	}
+
+	var defs, params []string
+	for _, c := range columns {
+		defs = append(defs, sqliteQuote(c)+" TEXT")
+		params = append(params, "?")
+	}
+	table := sqliteQuote(name)
+	if _, err := tx.Exec(fmt.Sprintf("CREATE TABLE %s (%s)", table, strings.Join(defs, ", "))); err != nil {
+		return err
+	}
+	if seen.Contains("identifieruuid") {
+		index := sqliteQuote(name + "_uuid")
+		if _, err := tx.Exec(fmt.Sprintf(`CREATE INDEX %s ON %s ("IdentifierUUID")`, index, table)); err != nil {
+			return err
+		}
+	}
+
+	insert, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s VALUES (%s)", table, strings.Join(params, ", ")))
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	row := make([]any, len(columns))
+	for _, s := range surveys {
+		for i, c := range columns {
+			if v, ok := s[c]; ok {
+				row[i] = v
+			} else {
+				row[i] = nil
+			}
+		}
+		if _, err := insert.Exec(row...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// surveyTables returns the name of the table of each survey type. Names are
+// case insensitive in SQLite, so a type whose name is already taken by another
+// table or index, whatever its case, gets a suffix. Types keeping their name
+// come first so that the names do not depend on the order of the surveys.
+// SQLite keeps names starting with "sqlite_" for itself, those get a prefix.
+func surveyTables(types []string) map[string]string {
+	used := make(Set)
+	for _, name := range []string{"trenches", "versions", "relations", "relations_survey", "attachments", "attachments_survey"} {
+		used.Insert(name)
+	}
+	available := func(name string) bool {
+		name = strings.ToLower(name)
+		return !used.Contains(name) && !used.Contains(name+"_uuid")
+	}
+	tables := make(map[string]string)
+	use := func(t, name string) {
+		used.Insert(strings.ToLower(name))
+		used.Insert(strings.ToLower(name) + "_uuid")
+		tables[t] = name
+	}
+	base := func(t string) string {
+		if t == "" {
+			return "Untyped"
+		} else if strings.HasPrefix(strings.ToLower(t), "sqlite_") {
+			return "Survey_" + t
+		}
+		return t
+	}
+
+	sorted := slices.Sorted(slices.Values(types))
+	for _, t := range sorted {
+		if name := base(t); available(name) {
+			use(t, name)
+		}
+	}
+	for _, t := range sorted {
+		if _, ok := tables[t]; ok {
+			continue
+		}
+		name := base(t) + "_surveys"
+		for i := 2; !available(name); i++ {
+			name = fmt.Sprintf("%s_surveys%d", base(t), i)
+		}
+		use(t, name)
+	}
+	return tables
+}
+
+func sqliteQuote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSurveyRelations(t *testing.T) {
+	s := Survey{
+		"RelationBelow":       "2\n 3 \n",
+		"RelationAbove":       "1",
+		"RelationAttachments": "n=a.jpg\nd=sum1",
+		"Relation":            "x",
+		"Title":               "Wall",
+	}
+	var relations []string
+	for _, r := range s.Relations() {
+		relations = append(relations, r.Name+" "+r.Target)
+	}
+	assertEqual(t, strings.Join(relations, ","), "Above 1,Below 2,Below 3")
+}
+
+func TestWriteProjectSQLite(t *testing.T) {
+	projectDir := t.TempDir()
+	bz, err := NewBackend(projectDir, "test-user", "BZ")
+	assertNoError(t, err)
+	assertNoError(t, bz.WriteAttachment("a.jpg", "sum1", []byte("photo")))
+	_, err = bz.WriteTrench("test-dev", "", []byte(testPreferences), []Survey{
+		{"IdentifierUUID": "u1", "Identifier": "1", "Type": "Context", "Title": "Floor", "RelationAbove": "2\n9"},
+		{"IdentifierUUID": "u2", "Identifier": "2", "Type": "Context", "Title": "Fill", "RelationBelow": "1"},
+	})
+	assertNoError(t, err)
+	_, err = bz.WriteTrench("test-dev", "", []byte(testPreferences), []Survey{
+		{"IdentifierUUID": "u1", "Identifier": "1", "Type": "Context", "Title": "Floor", "RelationAbove": "2\n9"},
+		{"IdentifierUUID": "u2", "Identifier": "2", "Type": "Context", "Title": "Fill", "RelationBelow": "1"},
+		{"IdentifierUUID": "u3", "Identifier": "3", "Type": "Find", "Material": "Bronze",
+			"RelationAttachments": "n=a.jpg\nd=sum1"},
+	})
+	assertNoError(t, err)
+	ba, err := NewBackend(projectDir, "test-user", "BA")
+	assertNoError(t, err)
+	_, err = ba.WriteTrench("test-dev", "", nil, []Survey{
+		{"IdentifierUUID": "u4", "Identifier": "1", "Type": "Context", "Trench": "BA 1", "Zeta": "z"},
+	})
+	assertNoError(t, err)
+	_, err = NewBackend(projectDir, "test-user", "Empty")
+	assertNoError(t, err)
+
+	dbPath := filepath.Join(t.TempDir(), "Agora.db")
+	summary, err := WriteProjectSQLite(dbPath, projectDir, "test-user", "HEAD", true)
+	assertNoError(t, err)
+	assertEqual(t, summary.String(), "2 trenches, 4 surveys of 2 types")
+
+	db, err := sql.Open("sqlite", dbPath)
+	assertNoError(t, err)
+	defer db.Close()
+	query := func(q string) string {
+		rows, err := db.Query(q)
+		assertNoError(t, err)
+		defer rows.Close()
+		columns, err := rows.Columns()
+		assertNoError(t, err)
+		var result []string
+		for rows.Next() {
+			values := make([]sql.NullString, len(columns))
+			ptrs := make([]any, len(values))
+			for i := range values {
+				ptrs[i] = &values[i]
+			}
+			assertNoError(t, rows.Scan(ptrs...))
+			var row []string
+			for _, v := range values {
+				row = append(row, v.String)
+			}
+			result = append(result, strings.Join(row, "|"))
+		}
+		assertNoError(t, rows.Err())
+		return strings.Join(result, "\n")
+	}
+
+	assertEqual(t, query("SELECT name, surveys FROM trenches ORDER BY name"), "BA|1\nBZ|3")
+	assertEqual(t, query("SELECT trench, added FROM versions ORDER BY trench, added"), "BA|1\nBZ|1\nBZ|2")
+	assertEqual(t, query(`SELECT * FROM "Context" ORDER BY "IdentifierUUID"`),
+		"BZ|1|Context|Floor|u1|2\n9||\nBZ|2|Context|Fill|u2||1|\nBA 1|1|Context||u4|||z")
+	assertEqual(t, query(`SELECT "Trench", "Material" FROM "Find"`), "BZ|Bronze")
+	assertEqual(t, query("SELECT survey, relation, target, target_survey FROM relations ORDER BY survey, target"),
+		"u1|Above|2|u2\nu1|Above|9|\nu2|Below|1|u1")
+	assertEqual(t, query("SELECT survey, name, checksum, data FROM attachments"), "u3|a.jpg|sum1|photo")
+
+	// The trenches at a date before any version
+	_, err = WriteProjectSQLite(dbPath, projectDir, "test-user", "2000-01-01", false)
+	if err == nil {
+		t.Error("Expected an error exporting a version no trench has")
+	}
+	assertEqual(t, query("SELECT count(*) FROM trenches"), "2")
+}
+
+func TestSQLiteTableNames(t *testing.T) {
+	projectDir := t.TempDir()
+	b, err := NewBackend(projectDir, "test-user", "BZ")
+	assertNoError(t, err)
+	_, err = b.WriteTrench("test-dev", "", nil, []Survey{
+		{"IdentifierUUID": "u1", "Type": "Find"},
+		{"IdentifierUUID": "u2", "Type": "find"},
+		{"IdentifierUUID": "u3", "Type": "Trenches_surveys"},
+		{"IdentifierUUID": "u4", "Type": "Trenches"},
+		{"IdentifierUUID": "u5", "Type": "Find_uuid"},
+		{"IdentifierUUID": "u6", "Type": "sqlite_master"},
+		{"IdentifierUUID": "u7"},
+	})
+	assertNoError(t, err)
+
+	dbPath := filepath.Join(t.TempDir(), "Agora.db")
+	summary, err := WriteProjectSQLite(dbPath, projectDir, "test-user", "HEAD", false)
+	assertNoError(t, err)
+	assertEqual(t, summary.String(), "1 trenches, 7 surveys of 7 types")
+
+	db, err := sql.Open("sqlite", dbPath)
+	assertNoError(t, err)
+	defer db.Close()
+	var tables []string
+	for _, table := range []string{"Find", "find_surveys", "Trenches_surveys", "Trenches_surveys2", "Find_uuid_surveys", "Survey_sqlite_master", "Untyped"} {
+		var uuid string
+		assertNoError(t, db.QueryRow(fmt.Sprintf(`SELECT "IdentifierUUID" FROM %s`, sqliteQuote(table))).Scan(&uuid))
+		tables = append(tables, uuid)
+	}
+	assertEqual(t, strings.Join(tables, ","), "u1,u2,u3,u4,u5,u6,u7")
+}
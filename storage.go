@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// AttachmentStore keeps the contents of the attachments of a trench.
+// Attachments are identified by their name and checksum, as sent by iDig.
+type AttachmentStore interface {
+	Exists(name, checksum string) (bool, error) // False only when not found
+	Read(name, checksum string) ([]byte, error)
+	Write(name, checksum string, data []byte) error
+	Delete(name, checksum string) error
+	List() ([]Attachment, error) // Attachments with their Size set
+}
+
+// Attachment store types
+const (
+	StoreGit        = "git"
+	StoreFilesystem = "filesystem"
+	StoreS3         = "s3"
+)
+
+// NewAttachmentStore returns the attachment store configured for a project.
+// The git store keeps attachments in r, or in shared if not nil.
+func NewAttachmentStore(cfg *ProjectConfig, projectDir, trench string, r, shared *git.Repository) (AttachmentStore, error) {
+	if !cfg.ExternalAttachments() {
+		blobs := r
+		if shared != nil {
+			blobs = shared
+		}
+		return &GitAttachmentStore{r: r, blobs: blobs}, nil
+	}
+
+	sc := cfg.AttachmentStore
+	switch sc.Type {
+	case StoreFilesystem:
+		dir := sc.Path
+		if dir == "" {
+			dir = ".files"
+		}
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(projectDir, dir)
+		}
+		return &FileAttachmentStore{dir: filepath.Join(dir, trench)}, nil
+	case StoreS3:
+		client, err := NewS3Client(sc)
+		if err != nil {
+			return nil, err
+		}
+		prefix := sc.Prefix
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		return &S3AttachmentStore{client: client, prefix: prefix + trench + "/"}, nil
+	default:
+		return nil, fmt.Errorf("Invalid attachment store type '%s'", sc.Type)
+	}
+}
+
+// attachmentKey encodes name and checksum into a string that is safe to use
+// as a file name, a reference name or an object key.
+func attachmentKey(name, checksum string) string {
+	enc := base64.URLEncoding.WithPadding(base64.NoPadding)
+	return enc.EncodeToString([]byte(fmt.Sprintf("%s/%s", name, checksum)))
+}
+
+func parseAttachmentKey(key string) (Attachment, bool) {
+	enc := base64.URLEncoding.WithPadding(base64.NoPadding)
+	decoded, err := enc.DecodeString(key)
+	if err != nil {
+		return Attachment{}, false
+	}
+	name, checksum, ok := strings.Cut(string(decoded), "/")
+	return Attachment{Name: name, Checksum: checksum}, ok
+}
+
+func attachmentReference(name, checksum string) string {
+	return fmt.Sprintf("refs/attachments/%s", attachmentKey(name, checksum))
+}
+
+// Versions reference attachments kept outside of git through small pointer
+// blobs in their attachments tree.
+const attachmentPointerHeader = "idig-attachment-pointer\n"
+
+func attachmentPointer(name, checksum string) []byte {
+	data, _ := json.Marshal(Attachment{Name: name, Checksum: checksum})
+	return append([]byte(attachmentPointerHeader), data...)
+}
+
+func parseAttachmentPointer(data []byte) (Attachment, bool) {
+	rest, ok := strings.CutPrefix(string(data), attachmentPointerHeader)
+	if !ok {
+		return Attachment{}, false
+	}
+	var a Attachment
+	if err := json.Unmarshal([]byte(rest), &a); err != nil {
+		return Attachment{}, false
+	}
+	return a, true
+}
+
+// GitAttachmentStore keeps each attachment as a blob, with a reference under
+// refs/attachments/ in the trench repository.
+type GitAttachmentStore struct {
+	r     *git.Repository // Trench repository, holding the references
+	blobs *git.Repository // Repository holding the blobs
+}
+
+func (s *GitAttachmentStore) Exists(name, checksum string) (bool, error) {
+	_, err := s.Blob(name, checksum)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Blob returns the hash of the blob holding an attachment.
+func (s *GitAttachmentStore) Blob(name, checksum string) (plumbing.Hash, error) {
+	refName := attachmentReference(name, checksum)
+	ref, err := s.r.Reference(plumbing.ReferenceName(refName), false)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("Attachment '%s' not found: %w", name, err)
+	}
+	return ref.Hash(), nil
+}
+
+func (s *GitAttachmentStore) Read(name, checksum string) ([]byte, error) {
+	h, err := s.Blob(name, checksum)
+	if err != nil {
+		return nil, err
+	}
+	// The trench repository can read shared blobs through its alternates
+	return readBlob(s.r, h)
+}
+
+func (s *GitAttachmentStore) Write(name, checksum string, data []byte) error {
+	h, err := writeBlob(s.blobs, data)
+	if err != nil {
+		return fmt.Errorf("Failed to write git blob: %w", err)
+	}
+
+	refName := attachmentReference(name, checksum)
+	ref := plumbing.NewReferenceFromStrings(refName, h.String())
+	err = s.r.Storer.SetReference(ref)
+	if err != nil {
+		return fmt.Errorf("Failed to create attachment reference: %w", err)
+	}
+	return nil
+}
+
+func (s *GitAttachmentStore) Delete(name, checksum string) error {
+	refName := attachmentReference(name, checksum)
+	return s.r.Storer.RemoveReference(plumbing.ReferenceName(refName))
+}
+
+func (s *GitAttachmentStore) List() ([]Attachment, error) {
+	refs, err := s.r.References()
+	if err != nil {
+		return nil, err
+	}
+
+	var attachments []Attachment
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		key, ok := strings.CutPrefix(ref.Name().String(), "refs/attachments/")
+		if !ok {
+			return nil
+		}
+		a, ok := parseAttachmentKey(key)
+		if !ok {
+			return nil
+		}
+		if blob, err := s.r.BlobObject(ref.Hash()); err == nil {
+			a.Size = blob.Size
+		}
+		a.Modified = referenceTime(s.r, ref.Name())
+		attachments = append(attachments, a)
+		return nil
+	})
+
+	return attachments, err
+}
+
+// referenceTime returns when a loose reference of r was written, or the
+// zero time when unknown.
+func referenceTime(r *git.Repository, name plumbing.ReferenceName) time.Time {
+	st, ok := r.Storer.(*filesystem.Storage)
+	if !ok {
+		return time.Time{}
+	}
+	fi, err := st.Filesystem().Stat(name.String())
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// FileAttachmentStore keeps each attachment as a file in a directory.
+type FileAttachmentStore struct {
+	dir string
+}
+
+func (s *FileAttachmentStore) path(name, checksum string) string {
+	return filepath.Join(s.dir, attachmentKey(name, checksum))
+}
+
+func (s *FileAttachmentStore) Exists(name, checksum string) (bool, error) {
+	_, err := os.Stat(s.path(name, checksum))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *FileAttachmentStore) Read(name, checksum string) ([]byte, error) {
+	data, err := os.ReadFile(s.path(name, checksum))
+	if err != nil {
+		return nil, fmt.Errorf("Attachment '%s' not found: %w", name, err)
+	}
+	return data, nil
+}
+
+func (s *FileAttachmentStore) Write(name, checksum string, data []byte) error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so readers never see partial data
+	f, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to write attachment '%s': %w", name, err)
+	}
+	return os.Rename(f.Name(), s.path(name, checksum))
+}
+
+func (s *FileAttachmentStore) Delete(name, checksum string) error {
+	return os.Remove(s.path(name, checksum))
+}
+
+func (s *FileAttachmentStore) List() ([]Attachment, error) {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var attachments []Attachment
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		a, ok := parseAttachmentKey(e.Name())
+		if !ok {
+			continue
+		}
+		if fi, err := e.Info(); err == nil {
+			a.Size = fi.Size()
+			a.Modified = fi.ModTime()
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, nil
+}
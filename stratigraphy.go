@@ -0,0 +1,333 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Kinds of stratigraphic problems
+const (
+	StratigraphyCycle         = "cycle"         // Units above themselves, e.g. 1 above 2 above 3 above 1
+	StratigraphyContradiction = "contradiction" // Two surveys both above and below each other, or the same unit and above
+	StratigraphyUnknown       = "unknown"       // Relations to identifiers not in the trench
+	StratigraphyReciprocal    = "reciprocal"    // Relations missing from the related survey, e.g. Below on the survey Above it
+)
+
+// Stratigraphic problems reported as warnings after syncing, the others
+// are only counted
+const MaxSyncStratigraphyWarnings = 20
+
+// StratigraphyProblem is an inconsistency of the stratigraphic relations of
+// surveys.
+type StratigraphyProblem struct {
+	Kind    string   `json:"kind"`
+	Trench  string   `json:"trench"`
+	Surveys []string `json:"surveys"` // IDs of the surveys involved
+	Message string   `json:"message"`
+}
+
+func (p StratigraphyProblem) String() string {
+	return p.Message
+}
+
+// CheckStratigraphy returns the problems of the relations of the surveys,
+// by trench. Relations to unknown identifiers are checked for all Relation*
+// fields, the others only for the relations of the stratigraphy.
+func CheckStratigraphy(surveys []Survey, trench string, cfg *StratigraphyConfig) []StratigraphyProblem {
+	u := newSurveyUnits(surveys, trench)
+	problems := []StratigraphyProblem{}
+	add := func(kind string, involved []int, format string, args ...any) {
+		p := StratigraphyProblem{Kind: kind, Trench: u.trenchOf(surveys[involved[0]]), Message: fmt.Sprintf(format, args...)}
+		for _, i := range involved {
+			if id := surveys[i].ID(); !slices.Contains(p.Surveys, id) {
+				p.Surveys = append(p.Surveys, id)
+			}
+		}
+		problems = append(problems, p)
+	}
+
+	recorded := make([]Set, len(surveys))
+	for i, s := range surveys {
+		recorded[i] = make(Set)
+		for _, r := range s.Relations() {
+			recorded[i].Insert(r.Name + "\n" + r.Target)
+		}
+	}
+
+	// Relations between each pair of surveys: forward when the first one of
+	// the pair is later, backward when the second one is, or the same unit
+	type statement struct {
+		from, to int // Later survey, or the surveys of the same unit
+		text     string
+	}
+	type claims struct {
+		forward, backward, same []statement
+	}
+	pairs := make(map[[2]int]*claims)
+	units := newUnionFind(len(surveys))
+
+	for i, s := range surveys {
+		if s.ID() == "" {
+			continue
+		}
+		id := s["Identifier"]
+		for _, r := range s.Relations() {
+			j, ok := u.target(i, r)
+			if !ok {
+				add(StratigraphyUnknown, []int{i}, "Unknown identifier: %s %s %s", id, r.Name, r.Target)
+				continue
+			}
+			reciprocal, ok := cfg.reciprocal(r.Name)
+			if !ok {
+				continue
+			}
+			_, later, isSequence := cfg.sequence(r.Name)
+			text := fmt.Sprintf("%s %s %s", id, r.Name, r.Target)
+			if i == j {
+				add(StratigraphyContradiction, []int{i}, "Relation to itself: %s", text)
+				continue
+			}
+
+			if !recorded[j].Contains(reciprocal + "\n" + id) {
+				add(StratigraphyReciprocal, []int{i, j}, "Missing reciprocal relation: %s %s %s (for %s)", r.Target, reciprocal, id, text)
+			}
+
+			key := [2]int{min(i, j), max(i, j)}
+			c := pairs[key]
+			if c == nil {
+				c = &claims{}
+				pairs[key] = c
+			}
+			st := statement{from: i, to: j, text: text}
+			if !isSequence {
+				c.same = append(c.same, st)
+				units.union(i, j)
+				continue
+			}
+			if !later {
+				st.from, st.to = j, i
+			}
+			if st.from == key[0] {
+				c.forward = append(c.forward, st)
+			} else {
+				c.backward = append(c.backward, st)
+			}
+		}
+	}
+
+	// Contradictions, in the order of the surveys
+	keys := make([][2]int, 0, len(pairs))
+	for key := range pairs {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		if keys[a][0] != keys[b][0] {
+			return keys[a][0] < keys[b][0]
+		}
+		return keys[a][1] < keys[b][1]
+	})
+	texts := func(groups ...[]statement) []string {
+		var t []string
+		for _, g := range groups {
+			for _, st := range g {
+				t = append(t, st.text)
+			}
+		}
+		return t
+	}
+	contradictory := make(map[[2]int]bool)
+	for _, key := range keys {
+		c := pairs[key]
+		kinds := 0
+		for _, g := range [][]statement{c.forward, c.backward, c.same} {
+			if len(g) > 0 {
+				kinds++
+			}
+		}
+		if kinds > 1 {
+			contradictory[key] = true
+			add(StratigraphyContradiction, key[:], "Contradictory relations: %s", strings.Join(texts(c.forward, c.backward, c.same), ", "))
+		}
+	}
+
+	// Cycles between units, leaving out the contradictions already found
+	nodeOf := make(map[int]int)
+	var roots []int
+	node := func(i int) int {
+		root := units.find(i)
+		n, ok := nodeOf[root]
+		if !ok {
+			n = len(roots)
+			nodeOf[root] = n
+			roots = append(roots, root)
+		}
+		return n
+	}
+	var sequence []statement
+	for _, key := range keys {
+		if !contradictory[key] {
+			sequence = append(sequence, pairs[key].forward...)
+			sequence = append(sequence, pairs[key].backward...)
+		}
+	}
+	for _, st := range sequence {
+		node(st.from)
+		node(st.to)
+	}
+	edges := make(map[[2]int]statement)
+	succ := make([][]int, len(roots))
+	for _, st := range sequence {
+		from, to := node(st.from), node(st.to)
+		if _, ok := edges[[2]int{from, to}]; !ok && from != to {
+			edges[[2]int{from, to}] = st
+			succ[from] = append(succ[from], to)
+		}
+	}
+	comp, comps := stronglyConnected(succ)
+	for c := len(comps) - 1; c >= 0; c-- {
+		if len(comps[c]) < 2 {
+			continue
+		}
+		// Shortest way back to the first unit of the component
+		start := slices.Min(comps[c])
+		prev := map[int]int{start: -1}
+		queue := []int{start}
+		end := -1
+		for len(queue) > 0 && end < 0 {
+			v := queue[0]
+			queue = queue[1:]
+			for _, w := range succ[v] {
+				if w == start {
+					end = v
+					break
+				}
+				if _, seen := prev[w]; !seen && comp[w] == c {
+					prev[w] = v
+					queue = append(queue, w)
+				}
+			}
+		}
+		path := []statement{edges[[2]int{end, start}]}
+		for v := end; prev[v] >= 0; v = prev[v] {
+			path = append(path, edges[[2]int{prev[v], v}])
+		}
+		slices.Reverse(path)
+		var involved []int
+		for _, st := range path {
+			involved = append(involved, st.from, st.to)
+		}
+		add(StratigraphyCycle, involved, "Cycle: %s", strings.Join(texts(path), ", "))
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Trench < problems[j].Trench
+	})
+	return problems
+}
+
+// maintains reports whether the server keeps the reciprocals of a relation
+// in step, given either relation of its pair.
+func (cfg *StratigraphyConfig) maintains(name string) bool {
+	if cfg == nil {
+		return false
+	}
+	reciprocal, ok := cfg.reciprocal(name)
+	return ok && (slices.Contains(cfg.Reciprocals, name) || slices.Contains(cfg.Reciprocals, reciprocal))
+}
+
+// MaintainReciprocals returns the surveys of a trench with the reciprocals
+// of the relations listed in cfg.Reciprocals kept in step with old, the
+// surveys of the previous version. Relations removed since old take their
+// reciprocals with them, then missing reciprocals are added. Relations
+// point to surveys of the same Trench field, see surveyUnits. Changed surveys
+// are copies. The number of relations added or removed is returned.
+func MaintainReciprocals(old, surveys []Survey, trench string, cfg *StratigraphyConfig) ([]Survey, int) {
+	if cfg == nil || len(cfg.Reciprocals) == 0 {
+		return surveys, 0
+	}
+	u := newSurveyUnits(surveys, trench)
+	// Relations as Trench, Identifier, Name and Target on separate lines
+	relations := func(surveys []Survey) Set {
+		set := make(Set)
+		for _, s := range surveys {
+			id := s["Identifier"]
+			for _, r := range s.Relations() {
+				if id != "" && r.Target != id && cfg.maintains(r.Name) {
+					set.Insert(u.trenchOf(s) + "\n" + id + "\n" + r.Name + "\n" + r.Target)
+				}
+			}
+		}
+		return set
+	}
+	before, after := relations(old), relations(surveys)
+
+	result := slices.Clone(surveys)
+	cloned := make(map[int]bool)
+	// edit changes the list of identifiers of a relation of the survey with
+	// a trench and identifier, if there is one
+	edit := func(survey [2]string, name string, change func(targets []string) []string) bool {
+		i, ok := u.ids[survey]
+		if !ok {
+			return false
+		}
+		if !cloned[i] {
+			result[i] = maps.Clone(result[i])
+			cloned[i] = true
+		}
+		field := relationPrefix + name
+		var targets []string
+		for _, t := range strings.Split(result[i][field], "\n") {
+			if t = strings.TrimSpace(t); t != "" {
+				targets = append(targets, t)
+			}
+		}
+		if targets = change(targets); len(targets) > 0 {
+			result[i][field] = strings.Join(targets, "\n")
+		} else {
+			delete(result[i], field)
+		}
+		return true
+	}
+
+	changes := 0
+	for _, r := range before.Array() {
+		if after.Contains(r) {
+			continue
+		}
+		parts := strings.Split(r, "\n")
+		tr, id, name, target := parts[0], parts[1], parts[2], parts[3]
+		reciprocal, _ := cfg.reciprocal(name)
+		key := tr + "\n" + target + "\n" + reciprocal + "\n" + id
+		// Unless the recorder added the reciprocal back meanwhile
+		if !after.Contains(key) || !before.Contains(key) {
+			continue
+		}
+		removed := edit([2]string{tr, target}, reciprocal, func(targets []string) []string {
+			return slices.DeleteFunc(targets, func(t string) bool { return t == id })
+		})
+		if removed {
+			delete(after, key)
+			changes++
+		}
+	}
+	for _, r := range after.Array() {
+		parts := strings.Split(r, "\n")
+		tr, id, name, target := parts[0], parts[1], parts[2], parts[3]
+		reciprocal, _ := cfg.reciprocal(name)
+		key := tr + "\n" + target + "\n" + reciprocal + "\n" + id
+		if after.Contains(key) {
+			continue
+		}
+		added := edit([2]string{tr, target}, reciprocal, func(targets []string) []string {
+			return append(targets, id)
+		})
+		if added {
+			after.Insert(key)
+			changes++
+		}
+	}
+	return result, changes
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckStratigraphy(t *testing.T) {
+	check := func(surveys ...Survey) string {
+		for i, s := range surveys {
+			s["IdentifierUUID"] = s["Trench"] + "u" + s["Identifier"]
+			surveys[i] = s
+		}
+		var messages []string
+		for _, p := range CheckStratigraphy(surveys, "BZ", nil) {
+			messages = append(messages, p.Trench+": "+p.Message)
+		}
+		return strings.Join(messages, "\n")
+	}
+
+	assertEqual(t, check(
+		Survey{"Identifier": "1", "RelationAbove": "2"},
+		Survey{"Identifier": "2", "RelationBelow": "1", "RelationSameAs": "3"},
+		Survey{"Identifier": "3", "RelationSameAs": "2", "RelationContemporaryWith": "1"},
+	), "")
+
+	assertEqual(t, check(
+		Survey{"Identifier": "1", "RelationAbove": "9", "RelationContemporaryWith": "8"},
+	), "BZ: Unknown identifier: 1 Above 9\nBZ: Unknown identifier: 1 ContemporaryWith 8")
+
+	assertEqual(t, check(
+		Survey{"Identifier": "1", "RelationCuts": "2"},
+		Survey{"Identifier": "2"},
+	), "BZ: Missing reciprocal relation: 2 CutBy 1 (for 1 Cuts 2)")
+
+	assertEqual(t, check(
+		Survey{"Identifier": "1", "RelationAbove": "1\n2", "RelationBelow": "2"},
+		Survey{"Identifier": "2", "RelationAbove": "1", "RelationBelow": "1"},
+	), "BZ: Relation to itself: 1 Above 1\nBZ: Contradictory relations: 1 Above 2, 2 Below 1, 1 Below 2, 2 Above 1")
+
+	assertEqual(t, check(
+		Survey{"Identifier": "1", "RelationAbove": "2", "RelationBelow": "3"},
+		Survey{"Identifier": "2", "RelationAbove": "3", "RelationBelow": "1"},
+		Survey{"Identifier": "3", "RelationAbove": "1", "RelationBelow": "2"},
+	), "BZ: Cycle: 1 Above 2, 2 Above 3, 1 Below 3")
+
+	// Parts of the same unit can't be above each other, even through others
+	assertEqual(t, check(
+		Survey{"Identifier": "1", "RelationSameAs": "2", "RelationAbove": "3"},
+		Survey{"Identifier": "2", "RelationSameAs": "1", "RelationBelow": "3"},
+		Survey{"Identifier": "3", "RelationBelow": "1", "RelationAbove": "2"},
+	), "BZ: Cycle: 1 Above 3, 2 Below 3")
+
+	// Identifiers belong to their trench
+	assertEqual(t, check(
+		Survey{"Identifier": "1", "RelationAbove": "2"},
+		Survey{"Identifier": "2", "Trench": "BA", "RelationBelow": "1"},
+	), "BA: Unknown identifier: 2 Below 1\nBZ: Unknown identifier: 1 Above 2")
+}
+
+func TestMaintainReciprocals(t *testing.T) {
+	cfg := &StratigraphyConfig{Reciprocals: []string{"Above", "SameAs"}}
+	surveys := []Survey{
+		{"IdentifierUUID": "u1", "Identifier": "1", "RelationAbove": "2\n9", "RelationCuts": "3"},
+		{"IdentifierUUID": "u2", "Identifier": "2", "RelationBelow": "5"},
+		{"IdentifierUUID": "u3", "Identifier": "3", "RelationSameAs": "1"},
+	}
+	maintained, changes := MaintainReciprocals(nil, surveys, "BZ", cfg)
+	assertEqual(t, changes, 2)
+	assertEqual(t, maintained[1]["RelationBelow"], "5\n1")
+	assertEqual(t, maintained[0]["RelationSameAs"], "3")
+	assertEqual(t, maintained[2]["RelationCutBy"], "")
+	// The surveys sent are left alone
+	assertEqual(t, surveys[1]["RelationBelow"], "5")
+	assertEqual(t, surveys[0]["RelationSameAs"], "")
+
+	// Removing either side of a relation removes the other
+	old := maintained
+	surveys = cloneSurveys(old)
+	delete(surveys[0], "RelationAbove")
+	delete(surveys[2], "RelationSameAs")
+	maintained, changes = MaintainReciprocals(old, surveys, "BZ", cfg)
+	assertEqual(t, changes, 2)
+	assertEqual(t, maintained[1]["RelationBelow"], "5")
+	_, ok := maintained[0]["RelationSameAs"]
+	assertEqual(t, ok, false)
+
+	_, changes = MaintainReciprocals(old, old, "BZ", cfg)
+	assertEqual(t, changes, 0)
+	_, changes = MaintainReciprocals(nil, surveys, "BZ", nil)
+	assertEqual(t, changes, 0)
+
+	// Surveys recorded with a Trench field other than the trench name
+	surveys = []Survey{
+		{"IdentifierUUID": "u1", "Identifier": "1", "Trench": "BZ 2024", "RelationAbove": "2"},
+		{"IdentifierUUID": "u2", "Identifier": "2", "Trench": "BZ 2024"},
+		{"IdentifierUUID": "u3", "Identifier": "2", "Trench": "BZ 2023"},
+	}
+	maintained, changes = MaintainReciprocals(nil, surveys, "BZ", cfg)
+	assertEqual(t, changes, 1)
+	assertEqual(t, maintained[1]["RelationBelow"], "1")
+	assertEqual(t, maintained[2]["RelationBelow"], "")
+
+	old = maintained
+	surveys = cloneSurveys(old)
+	delete(surveys[0], "RelationAbove")
+	maintained, changes = MaintainReciprocals(old, surveys, "BZ", cfg)
+	assertEqual(t, changes, 1)
+	assertEqual(t, maintained[1]["RelationBelow"], "")
+}
+
+func TestWriteTrenchReciprocals(t *testing.T) {
+	b, err := NewMemoryBackend("test-user", "BZ")
+	assertNoError(t, err)
+	b.cfg.Stratigraphy = &StratigraphyConfig{Reciprocals: []string{"Below"}}
+
+	surveys := []Survey{
+		{"IdentifierUUID": "u1", "Identifier": "1", "RelationAbove": "2"},
+		{"IdentifierUUID": "u2", "Identifier": "2"},
+	}
+	version, err := b.WriteTrench("test-dev", "", nil, surveys)
+	assertNoError(t, err)
+	if version == b.Head() {
+		t.Fatal("Expected a version by the server after the pushed one")
+	}
+
+	// The pushed version is kept as sent
+	pushed, err := b.ReadSurveysAtVersion(version)
+	assertNoError(t, err)
+	assertEqual(t, pushed[1]["RelationBelow"], "")
+	head, err := b.ResolveVersion("HEAD")
+	assertNoError(t, err)
+	assertEqual(t, head.Author.Name, ServerDevice)
+	assertEqual(t, head.Message, "Update reciprocal relations")
+	assertEqual(t, head.ParentHashes[0].String(), version)
+	latest, err := b.ReadSurveys()
+	assertNoError(t, err)
+	assertEqual(t, latest[1]["RelationBelow"], "1")
+	assertEqual(t, surveys[1]["RelationBelow"], "")
+}
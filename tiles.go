@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// Directory inside a project caching the tiles of image attachments, by blob
+// hash
+const TilesDir = ".tiles"
+
+const (
+	TileSize      = 256
+	maxTilePixels = 1 << 29 // 512 megapixels, decoded images take 1.5 to 8 bytes per pixel
+)
+
+var (
+	ErrUnsupportedImage = errors.New("Unsupported image")
+	ErrTileNotFound     = errors.New("Tile not found")
+	ErrTilesPending     = errors.New("Tiles are being generated")
+)
+
+// Only one pyramid is generated at a time, to bound memory use
+var tilesMu sync.Mutex
+
+// Tile pyramids being generated in the background, and the images found to
+// be unsupported, by tiles directory
+var tileJobs = struct {
+	sync.Mutex
+	running map[string]bool
+	failed  map[string]error
+}{running: make(map[string]bool), failed: make(map[string]error)}
+
+// TileInfo describes the tile pyramid of an image. Level 0 fits in a single
+// tile and every level doubles the size of the previous one, up to MaxZoom
+// which has the size of the image. Tiles at the right and bottom edges are
+// smaller than TileSize.
+type TileInfo struct {
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	TileSize int    `json:"tile_size"`
+	MaxZoom  int    `json:"max_zoom"`
+	Format   string `json:"format"`
+}
+
+// attachmentHash returns the hash of the blob referencing an attachment in
+// the attachments tree of a version.
+func (b *Backend) attachmentHash(name, checksum string) (plumbing.Hash, error) {
+	if gs, ok := b.store.(*GitAttachmentStore); ok {
+		return gs.Blob(name, checksum)
+	}
+	if exists, err := b.store.Exists(name, checksum); err != nil {
+		return plumbing.ZeroHash, err
+	} else if !exists {
+		return plumbing.ZeroHash, fmt.Errorf("Attachment '%s' not found", name)
+	}
+	return plumbing.ComputeHash(plumbing.BlobObject, b.encrypt(attachmentPointer(name, checksum))), nil
+}
+
+func (b *Backend) tilesDir(name, checksum string) (string, error) {
+	if b.dir == "" {
+		return "", fmt.Errorf("Tiles are not available for this trench")
+	}
+	h, err := b.attachmentHash(name, checksum)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(b.dir, TilesDir, h.String()), nil
+}
+
+// ReadTileInfo returns the tile pyramid of an image attachment. Until its
+// tiles are generated in the background, it returns ErrTilesPending.
+func (b *Backend) ReadTileInfo(name, checksum string) (*TileInfo, error) {
+	dir, err := b.tiles(name, checksum)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "info.json"))
+	if err != nil {
+		return nil, err
+	}
+	var info TileInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// ReadTile returns a JPEG tile of an image attachment. Until its tiles are
+// generated in the background, it returns ErrTilesPending.
+func (b *Backend) ReadTile(name, checksum string, z, x, y int) ([]byte, error) {
+	dir, err := b.tiles(name, checksum)
+	if err != nil {
+		return nil, err
+	}
+	tileFile := filepath.Join(dir, strconv.Itoa(z), strconv.Itoa(x), strconv.Itoa(y)+".jpg")
+	data, err := os.ReadFile(tileFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrTileNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return b.decrypt(data)
+}
+
+// DeleteTiles deletes the cached tiles of an attachment.
+func (b *Backend) DeleteTiles(name, checksum string) error {
+	dir, err := b.tilesDir(name, checksum)
+	if err != nil {
+		return err
+	}
+	tileJobs.Lock()
+	delete(tileJobs.failed, dir)
+	tileJobs.Unlock()
+	return os.RemoveAll(dir)
+}
+
+// tiles returns the directory holding the tiles of an attachment. When they
+// are missing, it starts generating them in the background and returns
+// ErrTilesPending.
+func (b *Backend) tiles(name, checksum string) (string, error) {
+	dir, err := b.tilesDir(name, checksum)
+	if err != nil {
+		return "", err
+	}
+	if FileExists(filepath.Join(dir, "info.json")) {
+		return dir, nil
+	}
+
+	tileJobs.Lock()
+	defer tileJobs.Unlock()
+	if err := tileJobs.failed[dir]; err != nil {
+		return "", err
+	}
+	if !tileJobs.running[dir] {
+		tileJobs.running[dir] = true
+		go func() {
+			err := b.GenerateTiles(name, checksum)
+			tileJobs.Lock()
+			defer tileJobs.Unlock()
+			delete(tileJobs.running, dir)
+			// Other errors may not last, the next request tries again
+			if errors.Is(err, ErrUnsupportedImage) {
+				tileJobs.failed[dir] = err
+			} else if err != nil {
+				log.Printf("Error generating tiles of '%s': %s", name, err)
+			}
+		}()
+	}
+	return "", ErrTilesPending
+}
+
+// GenerateTiles writes the tile pyramid of an image attachment, unless it
+// already exists.
+func (b *Backend) GenerateTiles(name, checksum string) error {
+	dir, err := b.tilesDir(name, checksum)
+	if err != nil {
+		return err
+	}
+
+	tilesMu.Lock()
+	defer tilesMu.Unlock()
+	if FileExists(filepath.Join(dir, "info.json")) {
+		return nil
+	}
+
+	data, err := b.ReadAttachment(name, checksum)
+	if err != nil {
+		return err
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrUnsupportedImage, err)
+	}
+	if cfg.Width*cfg.Height > maxTilePixels {
+		return fmt.Errorf("%w: %dx%d is too large", ErrUnsupportedImage, cfg.Width, cfg.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrUnsupportedImage, err)
+	}
+	data = nil
+
+	// Write all tiles next to the final directory and move them in place, so
+	// that readers never see a partial pyramid
+	if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	info, err := writeTiles(tmp, img, b.encrypt)
+	if err != nil {
+		return fmt.Errorf("Failed to write tiles of '%s': %w", name, err)
+	}
+	info.Format = format
+	infoData, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "info.json"), infoData, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dir)
+}
+
+// writeTiles writes the tile pyramid of img to dir as <z>/<x>/<y>.jpg,
+// passing each tile through seal. It goes through img a row of tiles at a
+// time, each row being scaled down into the levels below, so that only a
+// row of tiles per level is held in memory besides img.
+func writeTiles(dir string, img image.Image, seal func([]byte) []byte) (*TileInfo, error) {
+	bounds := img.Bounds()
+	info := &TileInfo{Width: bounds.Dx(), Height: bounds.Dy(), TileSize: TileSize}
+	for size := max(info.Width, info.Height); size > TileSize; size = (size + 1) / 2 {
+		info.MaxZoom++
+	}
+
+	var levels []*tileLevel
+	for z := 0; z <= info.MaxZoom; z++ {
+		// Halving rounds up, so does dividing by a power of two
+		shift := info.MaxZoom - z
+		w := (info.Width + 1<<shift - 1) >> shift
+		h := (info.Height + 1<<shift - 1) >> shift
+		l := &tileLevel{dir: dir, z: z, height: h, seal: seal, row: image.NewRGBA(image.Rect(0, 0, w, TileSize))}
+		if z > 0 {
+			l.next = levels[z-1]
+		}
+		levels = append(levels, l)
+	}
+
+	top := levels[info.MaxZoom]
+	for y := 0; y < info.Height; y += TileSize {
+		r := image.Rect(0, 0, info.Width, min(TileSize, info.Height-y))
+		draw.Draw(top.row, r, img, bounds.Min.Add(image.Pt(0, y)), draw.Src)
+		// JPEG has no transparency, show transparent areas of plans as white
+		flatten(top.row.SubImage(r))
+		top.rows = r.Dy()
+		if err := top.flush(); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// tileLevel is a level of a pyramid being written by writeTiles, holding its
+// current row of tiles.
+type tileLevel struct {
+	dir    string
+	z      int
+	height int
+	seal   func([]byte) []byte
+	row    *image.RGBA
+	rows   int // Rows of pixels filled in row
+	y      int // Index of row
+	next   *tileLevel
+}
+
+// add scales the first rows of pixels of src down to half their size into
+// the row of l, writing it once full.
+func (l *tileLevel) add(src *image.RGBA, rows int) error {
+	n := halveRows(l.row, l.rows, src, rows)
+	l.rows += n
+	if l.rows == TileSize || l.y*TileSize+l.rows == l.height {
+		return l.flush()
+	}
+	return nil
+}
+
+// flush writes the tiles of the row of l and passes it on to the next level.
+func (l *tileLevel) flush() error {
+	lb := image.Rect(0, 0, l.row.Bounds().Dx(), l.rows)
+	for x := 0; x*TileSize < lb.Dx(); x++ {
+		colDir := filepath.Join(l.dir, strconv.Itoa(l.z), strconv.Itoa(x))
+		if err := os.MkdirAll(colDir, 0o755); err != nil {
+			return err
+		}
+		r := image.Rect(x*TileSize, 0, (x+1)*TileSize, TileSize).Intersect(lb)
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, l.row.SubImage(r), &jpeg.Options{Quality: 85}); err != nil {
+			return err
+		}
+		tileFile := filepath.Join(colDir, strconv.Itoa(l.y)+".jpg")
+		if err := os.WriteFile(tileFile, l.seal(buf.Bytes()), 0o644); err != nil {
+			return err
+		}
+	}
+
+	rows := l.rows
+	l.rows = 0
+	l.y++
+	if l.next != nil {
+		return l.next.add(l.row, rows)
+	}
+	return nil
+}
+
+// flatten draws img over white. Decoded RGBA and NRGBA images, which are
+// the large ones, are changed in place rather than copied.
+func flatten(img image.Image) image.Image {
+	b := img.Bounds()
+	switch m := img.(type) {
+	case *image.RGBA:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row := m.Pix[m.PixOffset(b.Min.X, y):][:4*b.Dx()]
+			for i := 0; i < len(row); i += 4 {
+				// Premultiplied colors leave room for the white
+				white := 255 - row[i+3]
+				row[i] += white
+				row[i+1] += white
+				row[i+2] += white
+				row[i+3] = 255
+			}
+		}
+		return m
+	case *image.NRGBA:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row := m.Pix[m.PixOffset(b.Min.X, y):][:4*b.Dx()]
+			for i := 0; i < len(row); i += 4 {
+				a := uint32(row[i+3])
+				for c := i; c < i+3; c++ {
+					row[c] = uint8((uint32(row[c])*a + 255*(255-a) + 127) / 255)
+				}
+				row[i+3] = 255
+			}
+		}
+		return m
+	}
+	flat := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, b.Min, draw.Over)
+	return flat
+}
+
+// halveRows scales the first rows of pixels of src down to half their size,
+// rounding up, into dst from row y by averaging squares of 2×2 pixels. It
+// returns the number of rows written.
+func halveRows(dst *image.RGBA, y int, src *image.RGBA, rows int) int {
+	w := src.Bounds().Dx()
+	n := (rows + 1) / 2
+	for dy := 0; dy < n; dy++ {
+		r0 := src.Pix[2*dy*src.Stride:]
+		r1 := src.Pix[min(2*dy+1, rows-1)*src.Stride:]
+		out := dst.Pix[(y+dy)*dst.Stride:]
+		for dx := 0; dx < (w+1)/2; dx++ {
+			x0, x1 := 8*dx, 4*min(2*dx+1, w-1)
+			for c := 0; c < 4; c++ {
+				sum := uint32(r0[x0+c]) + uint32(r0[x1+c]) + uint32(r1[x0+c]) + uint32(r1[x1+c])
+				out[4*dx+c] = uint8((sum + 2) / 4)
+			}
+		}
+	}
+	return n
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTiles(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 600, 300))
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 600; x++ {
+			img.Set(x, y, color.NRGBA{uint8(x), uint8(y), 0, 255})
+		}
+	}
+	var buf bytes.Buffer
+	assertNoError(t, png.Encode(&buf, img))
+
+	b, err := NewBackend(t.TempDir(), "test-user", "T1")
+	assertNoError(t, err)
+	assertNoError(t, b.WriteAttachment("plan.png", "sum1", buf.Bytes()))
+
+	_, err = b.ReadTileInfo("plan.png", "sum1")
+	if !errors.Is(err, ErrTilesPending) {
+		t.Errorf("Expected pending tiles, got %v", err)
+	}
+	info, err := waitForTiles(b, "plan.png", "sum1")
+	assertNoError(t, err)
+	assertEqual(t, *info, TileInfo{Width: 600, Height: 300, TileSize: 256, MaxZoom: 2, Format: "png"})
+
+	for _, tc := range []struct {
+		Z, X, Y, Width, Height int
+	}{
+		{0, 0, 0, 150, 75},
+		{1, 1, 0, 44, 150},
+		{2, 0, 0, 256, 256},
+		{2, 2, 1, 88, 44},
+	} {
+		data, err := b.ReadTile("plan.png", "sum1", tc.Z, tc.X, tc.Y)
+		assertNoError(t, err)
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+		assertNoError(t, err)
+		assertEqual(t, cfg.Width, tc.Width)
+		assertEqual(t, cfg.Height, tc.Height)
+	}
+
+	_, err = b.ReadTile("plan.png", "sum1", 2, 3, 0)
+	if !errors.Is(err, ErrTileNotFound) {
+		t.Errorf("Expected missing tile, got %v", err)
+	}
+
+	assertNoError(t, b.WriteAttachment("notes.txt", "sum1", []byte("not an image")))
+	_, err = waitForTiles(b, "notes.txt", "sum1")
+	if !errors.Is(err, ErrUnsupportedImage) {
+		t.Errorf("Expected unsupported image, got %v", err)
+	}
+}
+
+// waitForTiles returns the tile pyramid of an attachment once generated.
+func waitForTiles(b *Backend, name, checksum string) (*TileInfo, error) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		info, err := b.ReadTileInfo(name, checksum)
+		if !errors.Is(err, ErrTilesPending) || time.Now().After(deadline) {
+			return info, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWriteTiles(t *testing.T) {
+	// Several rows of tiles, with the bottom half transparent
+	img := image.NewNRGBA(image.Rect(10, 20, 1310, 720))
+	for y := 20; y < 720; y++ {
+		for x := 10; x < 1310; x++ {
+			if y < 370 {
+				img.Set(x, y, color.NRGBA{200, 100, 0, 255})
+			}
+		}
+	}
+	dir := t.TempDir()
+	info, err := writeTiles(dir, img, func(data []byte) []byte { return data })
+	assertNoError(t, err)
+	assertEqual(t, *info, TileInfo{Width: 1300, Height: 700, TileSize: 256, MaxZoom: 3})
+
+	// Every tile of every level is written, with the colors of the image
+	for z, size := range []image.Point{{163, 88}, {325, 175}, {650, 350}, {1300, 700}} {
+		for x := 0; x*TileSize < size.X; x++ {
+			for y := 0; y*TileSize < size.Y; y++ {
+				data, err := os.ReadFile(filepath.Join(dir, strconv.Itoa(z), strconv.Itoa(x), strconv.Itoa(y)+".jpg"))
+				assertNoError(t, err)
+				tile, err := jpeg.Decode(bytes.NewReader(data))
+				assertNoError(t, err)
+				tb := tile.Bounds()
+				assertEqual(t, tb.Dx(), min(TileSize, size.X-x*TileSize))
+				assertEqual(t, tb.Dy(), min(TileSize, size.Y-y*TileSize))
+
+				top, bottom := y*TileSize, y*TileSize+tb.Dy()-1
+				for _, py := range []int{top, bottom} {
+					want := color.RGBA{200, 100, 0, 255}
+					if py >= size.Y/2 {
+						want = color.RGBA{255, 255, 255, 255}
+					}
+					// The edge between the halves is blurred
+					if py > size.Y/2-8 && py < size.Y/2+8 {
+						continue
+					}
+					got := color.RGBAModel.Convert(tile.At(tb.Dx()/2, py-top)).(color.RGBA)
+					if absDiff(got.R, want.R) > 8 || absDiff(got.G, want.G) > 8 || absDiff(got.B, want.B) > 8 {
+						t.Errorf("Tile %d/%d/%d row %d: %v != %v", z, x, y, py, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+func TestFlatten(t *testing.T) {
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 3, 1))
+	nrgba.Set(0, 0, color.NRGBA{0, 0, 0, 0})
+	nrgba.Set(1, 0, color.NRGBA{0, 100, 200, 128})
+	nrgba.Set(2, 0, color.NRGBA{10, 20, 30, 255})
+	rgba := image.NewRGBA(image.Rect(0, 0, 3, 1))
+	for x := 0; x < 3; x++ {
+		rgba.Set(x, 0, nrgba.At(x, 0))
+	}
+	paletted := image.NewPaletted(image.Rect(0, 0, 3, 1), color.Palette{color.Transparent, color.Black})
+	paletted.SetColorIndex(1, 0, 1)
+
+	for _, img := range []image.Image{nrgba, rgba, paletted} {
+		flat := flatten(img)
+		assertEqual(t, color.RGBAModel.Convert(flat.At(0, 0)), color.Color(color.RGBA{255, 255, 255, 255}))
+		if img != paletted {
+			// Changed in place
+			assertEqual(t, flat, img)
+			assertEqual(t, color.RGBAModel.Convert(flat.At(1, 0)), color.Color(color.RGBA{127, 177, 227, 255}))
+			assertEqual(t, color.RGBAModel.Convert(flat.At(2, 0)), color.Color(color.RGBA{10, 20, 30, 255}))
+		} else {
+			assertEqual(t, color.RGBAModel.Convert(flat.At(1, 0)), color.Color(color.RGBA{0, 0, 0, 255}))
+		}
+	}
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"net"
 	"os"
 	"sort"
+	"strconv"
+	"strings"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -56,6 +59,87 @@ func Prefix(s string, n int) string {
 	}
 }
 
+func FormatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// ByteSize is a number of bytes. In JSON it can be given as a number, or as a
+// string with a unit such as "500 MB" or "2GiB".
+type ByteSize int64
+
+func (n *ByteSize) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var i int64
+		if err := json.Unmarshal(data, &i); err != nil {
+			return fmt.Errorf("Invalid size %s", data)
+		}
+		*n = ByteSize(i)
+		return nil
+	}
+	size, err := ParseSize(s)
+	*n = ByteSize(size)
+	return err
+}
+
+func ParseSize(s string) (int64, error) {
+	units := map[string]int64{
+		"":    1,
+		"b":   1,
+		"k":   1e3,
+		"kb":  1e3,
+		"m":   1e6,
+		"mb":  1e6,
+		"g":   1e9,
+		"gb":  1e9,
+		"t":   1e12,
+		"tb":  1e12,
+		"kib": 1 << 10,
+		"mib": 1 << 20,
+		"gib": 1 << 30,
+		"tib": 1 << 40,
+	}
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	num, unit := s[:i], strings.ToLower(strings.TrimSpace(s[i:]))
+	f, err := strconv.ParseFloat(num, 64)
+	mult, ok := units[unit]
+	if err != nil || !ok || f < 0 {
+		return 0, fmt.Errorf("Invalid size '%s'", s)
+	}
+	return int64(f * float64(mult)), nil
+}
+
+// safeFilename turns s into something that can be used as a single path
+// component, falling back to def if nothing usable is left.
+func safeFilename(s, def string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || r < 0x20 {
+			return '_'
+		}
+		return r
+	}, s)
+	s = strings.TrimLeft(strings.TrimSpace(s), ".")
+	if s == "" {
+		return def
+	}
+	return s
+}
+
 type Set map[string]struct{}
 
 func (s Set) Array() []string {
@@ -71,6 +155,11 @@ func (s Set) Insert(k string) {
 	s[k] = struct{}{}
 }
 
+func (s Set) Contains(k string) bool {
+	_, ok := s[k]
+	return ok
+}
+
 func (s Set) Union(a Set) Set {
 	u := make(Set)
 	for k := range s {
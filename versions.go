@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+// Default and maximum number of versions listed by the API at once. Counting
+// the changes of each version reads the surveys of its parent.
+const (
+	DefaultVersionLimit = 100
+	MaxVersionLimit     = 1000
+)
+
+type TrenchVersion struct {
+	Version string    `json:"version"`
+	Date    time.Time `json:"date"`
+	Message string    `json:"message,omitempty"`
+	User    string    `json:"user"`
+	Device  string    `json:"device"`
+	Added   int       `json:"added"`   // Surveys added since the previous version
+	Changed int       `json:"changed"` // Surveys changed since the previous version
+	Removed int       `json:"removed"` // Surveys removed since the previous version
+}
+
+// VersionQuery selects versions of a trench. Zero values don't filter.
+type VersionQuery struct {
+	Limit  int       // Maximum number of versions to return
+	Cursor string    // Version to start from, as returned by a previous query
+	Since  time.Time // Only versions made at or after
+	Until  time.Time // Only versions made before
+	User   string
+	Device string
+}
+
+func (q VersionQuery) match(c *object.Commit) bool {
+	if !q.Until.IsZero() && !c.Author.When.Before(q.Until) {
+		return false
+	}
+	if q.User != "" && !strings.EqualFold(c.Author.Email, q.User) {
+		return false
+	}
+	if q.Device != "" && c.Author.Name != q.Device {
+		return false
+	}
+	return true
+}
+
+// QueryVersions returns the versions of the trench matching q, newest first.
+// When there are more versions than q.Limit, it also returns the cursor to
+// pass to get the next ones. Since versions are made in order, the walk
+// stops at the first version older than q.Since.
+func (b *Backend) QueryVersions(q VersionQuery) ([]TrenchVersion, string, error) {
+	var start plumbing.Hash
+	if q.Cursor != "" {
+		c, err := b.ResolveVersion(q.Cursor)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w %s", ErrInvalidCursor, q.Cursor)
+		}
+		start = c.Hash
+	} else {
+		head, err := b.r.Head()
+		if errors.Is(err, plumbing.ErrReferenceNotFound) {
+			return nil, "", nil
+		} else if err != nil {
+			return nil, "", fmt.Errorf("Error getting version list: %w", err)
+		}
+		start = head.Hash()
+	}
+
+	versions := []TrenchVersion{}
+	var parent *surveyEntries
+	for h := start; !h.IsZero(); {
+		c, err := b.r.CommitObject(h)
+		if err != nil {
+			return nil, "", fmt.Errorf("Error getting version list: %w", err)
+		}
+		if !q.Since.IsZero() && c.Author.When.Before(q.Since) {
+			break
+		}
+		if q.Limit > 0 && len(versions) == q.Limit && q.match(c) {
+			return versions, c.Hash.String(), nil
+		}
+
+		h = plumbing.ZeroHash
+		if len(c.ParentHashes) > 0 {
+			h = c.ParentHashes[0]
+		}
+		if !q.match(c) {
+			parent = nil
+			continue
+		}
+		// The entries of this version were read as the parent of the previous
+		var entries *surveyEntries
+		if parent != nil && parent.Commit == c.Hash {
+			entries = parent
+		}
+		v, err := b.trenchVersion(c, entries, &parent)
+		if err != nil {
+			return nil, "", err
+		}
+		versions = append(versions, v)
+	}
+	return versions, "", nil
+}
+
+// surveyEntries are the survey files of a version, by name.
+type surveyEntries struct {
+	Commit plumbing.Hash
+	Files  map[string]plumbing.Hash
+}
+
+func (b *Backend) surveyEntries(c *object.Commit) (*surveyEntries, error) {
+	entries := &surveyEntries{Commit: c.Hash, Files: make(map[string]plumbing.Hash)}
+	rootTree, err := b.r.TreeObject(c.TreeHash)
+	if err != nil {
+		return nil, err
+	}
+	surveysTree, err := rootTree.Tree("surveys")
+	if errors.Is(err, object.ErrDirectoryNotFound) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, e := range surveysTree.Entries {
+		if strings.HasPrefix(e.Name, ".") || !e.Mode.IsFile() {
+			continue
+		}
+		entries.Files[e.Name] = e.Hash
+	}
+	return entries, nil
+}
+
+// trenchVersion describes version c, counting the surveys changed since its
+// parent. The survey entries of c are read unless given, and the entries
+// read for its parent are stored in parent when not nil.
+func (b *Backend) trenchVersion(c *object.Commit, entries *surveyEntries, parent **surveyEntries) (TrenchVersion, error) {
+	v := TrenchVersion{
+		Version: c.Hash.String(),
+		Date:    c.Author.When,
+		Message: c.Message,
+		User:    c.Author.Email,
+		Device:  c.Author.Name,
+	}
+
+	var err error
+	if entries == nil {
+		if entries, err = b.surveyEntries(c); err != nil {
+			return v, fmt.Errorf("Error reading version %s: %w", v.Version, err)
+		}
+	}
+	old := &surveyEntries{}
+	if len(c.ParentHashes) > 0 {
+		p, err := b.r.CommitObject(c.ParentHashes[0])
+		if err != nil {
+			return v, fmt.Errorf("Error reading version %s: %w", c.ParentHashes[0], err)
+		}
+		if old, err = b.surveyEntries(p); err != nil {
+			return v, fmt.Errorf("Error reading version %s: %w", p.Hash, err)
+		}
+	}
+	if parent != nil {
+		*parent = old
+	}
+
+	for name, h := range entries.Files {
+		if oldHash, ok := old.Files[name]; !ok {
+			v.Added++
+		} else if oldHash != h {
+			v.Changed++
+		}
+	}
+	for name := range old.Files {
+		if _, ok := entries.Files[name]; !ok {
+			v.Removed++
+		}
+	}
+	return v, nil
+}
+
+// ParseVersionTime parses the bounds of a VersionQuery, either a RFC 3339
+// timestamp or a date in the server's time zone. With endOfDay, a date means
+// the end of that day, so that an Until date includes it.
+func ParseVersionTime(s string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateTime, s, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid time '%s', expected e.g. 2024-06-01 or 2024-06-01T12:00:00Z", s)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryVersions(t *testing.T) {
+	b, err := NewBackend(t.TempDir(), "test-user", "T1")
+	assertNoError(t, err)
+	surveys := generateSurveys(4)
+	_, err = b.WriteTrench("ipad-1", "", []byte("{}"), surveys[:2])
+	assertNoError(t, err)
+	surveys[1] = Survey{"IdentifierUUID": surveys[1].ID(), "Title": "Changed"}
+	_, err = b.WriteTrench("ipad-2", "", []byte("{}"), surveys[:3])
+	assertNoError(t, err)
+	b.User = "other-user"
+	_, err = b.WriteTrench("ipad-1", "Import", []byte("{}"), surveys[1:])
+	assertNoError(t, err)
+
+	versions, next, err := b.QueryVersions(VersionQuery{})
+	assertNoError(t, err)
+	assertEqual(t, next, "")
+	assertEqual(t, len(versions), 3)
+	v := versions[0]
+	assertEqual(t, v.Device, "ipad-1")
+	assertEqual(t, v.User, "other-user")
+	assertEqual(t, v.Message, "Import")
+	assertEqual(t, [3]int{v.Added, v.Changed, v.Removed}, [3]int{1, 0, 1})
+	v = versions[1]
+	assertEqual(t, [3]int{v.Added, v.Changed, v.Removed}, [3]int{1, 1, 0})
+	v = versions[2]
+	assertEqual(t, [3]int{v.Added, v.Changed, v.Removed}, [3]int{2, 0, 0})
+
+	single, err := b.VersionAt(versions[1].Version)
+	assertNoError(t, err)
+	assertEqual(t, single, versions[1])
+
+	// Pages
+	var pages []string
+	q := VersionQuery{Limit: 2}
+	for {
+		page, next, err := b.QueryVersions(q)
+		assertNoError(t, err)
+		var ids []string
+		for _, v := range page {
+			ids = append(ids, Prefix(v.Version, 7))
+		}
+		pages = append(pages, strings.Join(ids, ","))
+		if next == "" {
+			break
+		}
+		q.Cursor = next
+	}
+	assertEqual(t, strings.Join(pages, " "), Prefix(versions[0].Version, 7)+","+
+		Prefix(versions[1].Version, 7)+" "+Prefix(versions[2].Version, 7))
+
+	// Filters
+	filtered, next, err := b.QueryVersions(VersionQuery{Device: "ipad-1", Limit: 1})
+	assertNoError(t, err)
+	assertEqual(t, len(filtered), 1)
+	assertEqual(t, next, versions[2].Version)
+	filtered, _, err = b.QueryVersions(VersionQuery{User: "test-user"})
+	assertNoError(t, err)
+	assertEqual(t, len(filtered), 2)
+	filtered, _, err = b.QueryVersions(VersionQuery{Since: time.Now().Add(time.Hour)})
+	assertNoError(t, err)
+	assertEqual(t, len(filtered), 0)
+	filtered, _, err = b.QueryVersions(VersionQuery{Until: time.Now().Add(-time.Hour)})
+	assertNoError(t, err)
+	assertEqual(t, len(filtered), 0)
+
+	_, _, err = b.QueryVersions(VersionQuery{Cursor: "0000000"})
+	if err == nil {
+		t.Errorf("Expected invalid cursor error")
+	}
+}
+
+func TestParseVersionTime(t *testing.T) {
+	day, err := ParseVersionTime("2024-06-01", false)
+	assertNoError(t, err)
+	assertEqual(t, day, time.Date(2024, 6, 1, 0, 0, 0, 0, time.Local))
+	end, err := ParseVersionTime("2024-06-01", true)
+	assertNoError(t, err)
+	assertEqual(t, end, time.Date(2024, 6, 2, 0, 0, 0, 0, time.Local))
+	ts, err := ParseVersionTime("2024-06-01T12:30:00Z", true)
+	assertNoError(t, err)
+	assertEqual(t, ts.Equal(time.Date(2024, 6, 1, 12, 30, 0, 0, time.UTC)), true)
+	_, err = ParseVersionTime("yesterday", false)
+	if err == nil {
+		t.Errorf("Expected invalid time error")
+	}
+}